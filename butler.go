@@ -1,96 +1,343 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"sync"
 	"time"
 
+	"github.com/hekmon/cunits/v2"
 	"github.com/hekmon/transmissionrpc"
 )
 
-func butler(stopSignal <-chan struct{}, wg *sync.WaitGroup) {
+// butler runs the batches on schedule until ctx is done
+func butler(ctx context.Context, wg *sync.WaitGroup, beatInterval time.Duration) {
 	defer wg.Done()
-	// Create the ticker
-	logger.Infof("[Butler] Will work every %v", conf.Butler.CheckFrequency)
-	tick := time.NewTicker(conf.Butler.CheckFrequency)
-	defer tick.Stop()
-	// Start first batch
-	butlerBatch()
-	// Wait for ticks or cancellation
+	defer liveness.stop()
+	logger.Infof("[Butler] Will work %s", currentConf().Butler.describeSchedule())
+	// Start first batch right away
+	schedule.setNextRun(time.Now())
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	// Wake up regularly to prove the loop is alive to the watchdog (if enabled)
+	var beat <-chan time.Time
+	if beatInterval > 0 {
+		beatTicker := time.NewTicker(beatInterval)
+		defer beatTicker.Stop()
+		beat = beatTicker.C
+	}
+	// Wait for the next run, reschedules or cancellation
 	for {
+		liveness.beat()
 		select {
-		case <-tick.C:
-			butlerBatch()
-		case <-stopSignal:
+		case <-timer.C:
+			results := butlerBatches(ctx, currentConf().Butler.DryRun)
+			timer.Reset(time.Until(scheduleNextRun(results)))
+			updateSystemdStatus()
+		case <-rescheduleButler:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			logger.Infof("[Butler] Schedule changed: will now work %s", currentConf().Butler.describeSchedule())
+			timer.Reset(time.Until(scheduleNextRun(nil)))
+			updateSystemdStatus()
+		case <-beat:
+		case <-ctx.Done():
 			logger.Debug("[Butler] stop signal received")
 			return
 		}
 	}
 }
 
-var fields = []string{"id", "name", "totalSize", "status", "doneDate", "seedRatioLimit", "seedRatioMode", "uploadRatio"}
+// scheduleNextRun computes and logs the next run: the next scheduled one or the opening of the
+// maintenance window of actions postponed by the batches if it comes first
+func scheduleNextRun(results []*batchResult) (next time.Time) {
+	now := time.Now()
+	next = currentConf().Butler.nextRun(now)
+	var reason string
+	for _, result := range results {
+		if result == nil || result.nextWindow.IsZero() || !result.nextWindow.After(now) || !result.nextWindow.Before(next) {
+			continue
+		}
+		next = result.nextWindow
+		reason = fmt.Sprintf(" for the postponed %s candidates", result.nextWindowAction)
+	}
+	schedule.setNextRun(next)
+	logger.Infof("[Butler] Next run scheduled at %s (in %v)%s", next.Format("2006-01-02 15:04:05"), next.Sub(now).Round(time.Second), reason)
+	return
+}
+
+// labels are fetched apart as transmissionrpc rejects the fields it does not know, see fetchLabels()
+var fields = []string{"id", "name", "totalSize", "status", "doneDate", "seedRatioLimit", "seedRatioMode", "uploadRatio", "trackers", "secondsSeeding", "rateUpload", "hashString", "downloadDir", "activityDate", "uploadedEver"}
 
-func butlerBatch() {
+// batch inspects and handles all the torrents of the instance, butlerRun must be held by the caller.
+// Once ctx is done, the batch stops before its next step (RPC calls in flight are not interrupted).
+func (inst *instance) batch(ctx context.Context, dryRun bool) (result *batchResult) {
+	// Prepare the batch report
+	result = newBatchResult(inst.name, dryRun)
+	inst = inst.withContext(ctx)
+	defer func() {
+		result.Duration = time.Since(result.Start)
+		inst.log.Infof("Batch summary: %s", result)
+		metrics.batch(result)
+		inst.status.setLastBatch(result)
+		inst.checkDegraded(result)
+	}()
+	// The server may have been upgraded while it was unreachable
+	if !inst.status.isVersionChecked() {
+		reachable, err := inst.checkVersion()
+		if !reachable {
+			result.Error = fmt.Sprintf("can't check the transmission server RPC version: %v", err)
+			result.ErrorClass = classifyRPCError(err)
+			return
+		}
+		if err != nil {
+			inst.log.Errorf("Can't use this transmission server: %v", err)
+			result.Error = err.Error()
+			result.ErrorClass = rpcErrorVersion
+			inst.notify(notification{
+				Priority: priorityHigh,
+				Title:    "Incompatible transmission server",
+				Message:  fmt.Sprintf("Nothing will be done until it is fixed: %v", err),
+				Event:    "incompatible version",
+			})
+			return
+		}
+	}
 	// Check that global ratio limit is activated and set with correct value
-	logger.Debug("[Butler] Fetching session data")
-	session, err := transmission.SessionArgumentsGet()
+	inst.log.Debug("Fetching session data")
+	session, err := inst.client.SessionArgumentsGet()
 	if err == nil {
-		globalRatio(session)
+		inst.globalRatio(session, dryRun)
 	} else {
-		logger.Errorf("[Butler] Can't check global ratio: can't get sessions values: %v", err)
+		metrics.rpcError(inst.name, "session-get")
+		inst.log.Errorf("Can't check global ratio: can't get sessions values: %v", err)
+		inst.checkConnectionLoss(err)
 	}
 	// Get all torrents status
-	logger.Debug("[Butler] Fetching torrents metadata")
-	torrents, err := transmission.TorrentGet(fields, nil)
+	if inst.canceled(ctx, result) {
+		return
+	}
+	inst.log.Debug("Fetching torrents metadata")
+	torrents, err := inst.client.TorrentGet(fields, nil)
+	if err != nil {
+		metrics.rpcError(inst.name, "torrent-get")
+		inst.log.Errorf("Can't retrieve torrent(s) metadata: %v", err)
+		if inst.canceled(ctx, result) {
+			return
+		}
+		result.Error = fmt.Sprintf("can't retrieve torrent(s) metadata: %v", err)
+		result.ErrorClass = classifyRPCError(err)
+		inst.checkConnectionLoss(err)
+		return
+	}
+	inst.log.Infof("Fetched %d torrent(s) metadata", len(torrents))
+	result.Torrents = len(torrents)
+	// a dry run leaves the state untouched (the idle periods only move on with real batches)
+	if !dryRun {
+		state.prune(inst.name, torrents)
+		state.recordActivity(inst.name, torrents, inst.clock())
+	}
+	metrics.torrents(inst.name, torrents)
+	// Protected torrents must be known for sure before doing anything
+	if inst.canceled(ctx, result) {
+		return
+	}
+	labels, err := inst.fetchLabels(nil)
 	if err != nil {
-		logger.Errorf("[Butler] Can't retrieve torrent(s) metadata: %v", err)
+		inst.log.Errorf("Can't retrieve torrent(s) labels: %v", err)
+		result.Error = fmt.Sprintf("can't retrieve torrent(s) labels: %v", err)
+		result.ErrorClass = classifyRPCError(err)
 		return
 	}
-	logger.Infof("[Butler] Fetched %d torrent(s) metadata", len(torrents))
+	inst = inst.withLabels(labels)
+	protected := inst.getProtectedTorrents(torrents)
 	// Inspect each torrent
-	freeseedCandidates, globalratioCandidates, customratioCandidates, todeleteCandidates := inspectTorrents(torrents)
-	// Updates what need to be updated
-	handleFreeseedCandidates(freeseedCandidates)
-	handleGlobalratioCandidates(globalratioCandidates)
-	handleCustomratioCandidates(customratioCandidates)
-	handleTodeleteCandidates(todeleteCandidates, session.DownloadDir)
+	candidates, protectedCandidates := inst.inspectTorrents(ctx, torrents, protected)
+	if inst.canceled(ctx, result) {
+		return
+	}
+	if inst.butler.Protection != nil {
+		result.Actions[actionProtected] = inst.handleProtectedCandidates(protectedCandidates)
+	}
+	// Updates what need to be updated (unless canceled or outside of their maintenance windows)
+	if inst.proceed(ctx, actionFreeSeed, len(candidates[actionFreeSeed]), result) {
+		result.Actions[actionFreeSeed] = inst.handleFreeseedCandidates(candidates[actionFreeSeed], dryRun)
+	}
+	if inst.proceed(ctx, actionGlobalRatio, len(candidates[actionGlobalRatio]), result) {
+		result.Actions[actionGlobalRatio] = inst.handleGlobalratioCandidates(candidates[actionGlobalRatio], dryRun)
+	}
+	if inst.proceed(ctx, actionCustomRatio, len(candidates[actionCustomRatio]), result) {
+		result.Actions[actionCustomRatio] = inst.handleCustomratioCandidates(ctx, candidates[actionCustomRatio], dryRun)
+	}
+	if inst.proceed(ctx, actionPolicyRatio, len(candidates[actionPolicyRatio]), result) {
+		result.Actions[actionPolicyRatio] = inst.handlePolicyratioCandidates(ctx, candidates[actionPolicyRatio], dryRun)
+	}
+	if inst.butler.hasRuleAction(ruleActionStop, ruleActionPause) && inst.proceed(ctx, actionStop, len(candidates[actionStop]), result) {
+		result.Actions[actionStop] = inst.handleStopCandidates(candidates[actionStop], dryRun)
+	}
+	if inst.butler.hasRuleAction(ruleActionMove) && inst.proceed(ctx, actionMove, len(candidates[actionMove]), result) {
+		result.Actions[actionMove] = inst.handleMoveCandidates(ctx, candidates[actionMove], dryRun)
+	}
+	var dwnldDir *string
+	if session != nil {
+		dwnldDir = session.DownloadDir
+	}
+	// torrents already freeing space must not be evicted too
+	var todeleteCandidates []*transmissionrpc.Torrent
+	if inst.proceed(ctx, actionDelete, len(candidates[actionDelete]), result) {
+		result.Actions[actionDelete] = inst.handleTodeleteCandidates(ctx, candidates[actionDelete], dwnldDir, dryRun)
+		todeleteCandidates = append(todeleteCandidates, candidates[actionDelete]...)
+	}
+	if (inst.butler.IdleTime > 0 || len(candidates[actionIdle]) > 0) && inst.proceed(ctx, actionIdle, len(candidates[actionIdle]), result) {
+		result.Actions[actionIdle] = inst.handleIdleCandidates(ctx, candidates[actionIdle], dryRun)
+		if inst.butler.IdleAction == idleActionDelete {
+			todeleteCandidates = append(todeleteCandidates, candidates[actionIdle]...)
+		}
+	}
+	// Evict seeding torrents if free space is below the configured floor
+	if inst.canceled(ctx, result) {
+		return
+	}
+	if inst.butler.Eviction != nil {
+		result.Actions[actionPurge], result.Actions[actionEvict] = inst.evictTorrents(ctx, torrents, todeleteCandidates, protected, dwnldDir, result, dryRun)
+	} else {
+		if inst.butler.Quarantine != nil {
+			result.Actions[actionPurge], _ = inst.purgeQuarantine(ctx, 0, result, dryRun)
+		}
+		if currentConf().HTTP.Listen != "" && dwnldDir != nil {
+			// keep the free space metric up to date
+			if _, err = inst.getFreeSpace(*dwnldDir); err != nil {
+				inst.log.Errorf("Can't check free space in '%s' dir: %v", *dwnldDir, err)
+			}
+		}
+	}
+	if inst.canceled(ctx, result) {
+		return
+	}
+	result.Success = true
+	return
 }
 
-func globalRatio(session *transmissionrpc.SessionArguments) {
+// canceled returns true once ctx is done, the batch is then marked as aborted
+func (inst *instance) canceled(ctx context.Context, result *batchResult) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	if result.ErrorClass != rpcErrorCanceled {
+		inst.log.Warningf("Aborting the batch: %v", ctx.Err())
+		result.Error = fmt.Sprintf("aborted: %v", ctx.Err())
+		result.ErrorClass = rpcErrorCanceled
+	}
+	return true
+}
+
+// proceed returns true if the candidates of an action can be handled now: the batch is not canceled
+// and the action is within its maintenance windows
+func (inst *instance) proceed(ctx context.Context, action string, candidates int, result *batchResult) bool {
+	return !inst.canceled(ctx, result) && !inst.postpone(action, candidates, result)
+}
+
+func (inst *instance) globalRatio(session *transmissionrpc.SessionArguments, dryRun bool) {
 	var updateRatio, updateRatioEnabled bool
 	// Ratio value
 	if session.SeedRatioLimit != nil {
-		if *session.SeedRatioLimit != conf.Butler.TargetRatio {
-			logger.Infof("[Butler] Global ratio is invalid (%f instead of %f): scheduling update",
-				*session.SeedRatioLimit, conf.Butler.TargetRatio)
+		if *session.SeedRatioLimit != inst.butler.TargetRatio {
+			inst.log.Infof("Global ratio is invalid (%f instead of %f): scheduling update",
+				*session.SeedRatioLimit, inst.butler.TargetRatio)
 			updateRatio = true
 		} else {
-			logger.Debugf("[Butler] Session SeedRatioLimit: %v", *session.SeedRatioLimit)
+			inst.log.Debugf("Session SeedRatioLimit: %v", *session.SeedRatioLimit)
 		}
 	} else {
-		logger.Error("[Butler] Can't check global ratio value: SeedRatioLimit session value is nil")
+		inst.log.Error("Can't check global ratio value: SeedRatioLimit session value is nil")
 	}
 	// Global ratio enabled
 	if session.SeedRatioLimited != nil {
 		if !*session.SeedRatioLimited {
-			logger.Infof("[Butler] Global ratio is disabled: scheduling activation")
+			inst.log.Infof("Global ratio is disabled: scheduling activation")
 			updateRatioEnabled = true
 		} else {
-			logger.Debugf("[Butler] Session SeedRatioLimited: %v", *session.SeedRatioLimited)
+			inst.log.Debugf("Session SeedRatioLimited: %v", *session.SeedRatioLimited)
 		}
 	} else {
-		logger.Error("[Butler] Can't check global ratio value: SeedRatioLimited session value is nil")
+		inst.log.Error("Can't check global ratio value: SeedRatioLimited session value is nil")
 	}
 	// Update
 	if updateRatio || updateRatioEnabled {
+		if dryRun {
+			inst.log.Infof("[DryRun] Would set global ratio to %f and activate it", inst.butler.TargetRatio)
+			inst.notify(notification{
+				Priority: priorityNormal,
+				Title:    "[Dry run] Global ratio correction",
+				Message:  fmt.Sprintf("Would set global ratio to %.02f and activate it", inst.butler.TargetRatio),
+				Event:    "global ratio",
+			})
+			return
+		}
 		updateRatioEnabled = true
-		err := transmission.SessionArgumentsSet(&transmissionrpc.SessionArguments{
-			SeedRatioLimit:   &conf.Butler.TargetRatio,
+		err := inst.client.SessionArgumentsSet(&transmissionrpc.SessionArguments{
+			SeedRatioLimit:   &inst.butler.TargetRatio,
 			SeedRatioLimited: &updateRatioEnabled,
 		})
 		if err == nil {
-			logger.Infof("[Butler] Global ratio set and activated")
+			inst.log.Infof("Global ratio set and activated")
 		} else {
-			logger.Errorf("[Butler] Can't update global ratio: %v", err)
+			metrics.rpcError(inst.name, "session-set")
+			inst.log.Errorf("Can't update global ratio: %v", err)
+		}
+	}
+}
+
+// evictTorrents purges the expired quarantined torrents (and older ones if space is needed) then evicts torrents if still below the floor
+func (inst *instance) evictTorrents(ctx context.Context, torrents, todeleteCandidates []*transmissionrpc.Torrent, protected map[int64]string, dwnldDir *string,
+	result *batchResult, dryRun bool) (purged, evicted int) {
+	if dwnldDir == nil {
+		inst.log.Warning("Can't check free space for eviction: session dwld dir is nil")
+		return
+	}
+	freeSpace, err := inst.getFreeSpace(*dwnldDir)
+	if err != nil {
+		inst.log.Errorf("Can't check free space for eviction in '%s' dir: %v", *dwnldDir, err)
+		return
+	}
+	// In dry run nothing was deleted: take the planned deletions into account (quarantined data still uses space)
+	if dryRun && inst.butler.Quarantine == nil {
+		for _, torrent := range todeleteCandidates {
+			if torrent.TotalSize != nil {
+				freeSpace += *torrent.TotalSize
+			}
+		}
+	}
+	// Quarantined data goes first
+	if inst.butler.Quarantine != nil {
+		var toFree, freed cunits.Bits
+		if freeSpace < inst.butler.Eviction.MinFreeSpace {
+			toFree = inst.butler.Eviction.MinFreeSpace - freeSpace
 		}
+		purged, freed = inst.purgeQuarantine(ctx, toFree, result, dryRun)
+		freeSpace += freed
+	}
+	if freeSpace >= inst.butler.Eviction.MinFreeSpace {
+		inst.log.Debugf("Free space in download dir (%s) is above the eviction floor (%s)", freeSpace, inst.butler.Eviction.MinFreeSpace)
+		return
+	}
+	toFree := inst.butler.Eviction.MinFreeSpace - freeSpace
+	inst.log.Infof("Free space in download dir (%s) is below the eviction floor (%s): looking for %s of torrents to evict (order: %s)",
+		freeSpace, inst.butler.Eviction.MinFreeSpace, toFree, inst.butler.Eviction.Order)
+	evictionCandidates, evictedSize := inst.inspectEvictionCandidates(torrents, todeleteCandidates, protected, toFree, inst.clock())
+	if !inst.proceed(ctx, actionEvict, len(evictionCandidates), result) {
+		return
+	}
+	evicted = inst.handleEvictionCandidates(ctx, evictionCandidates, freeSpace+evictedSize, evictedSize < toFree, dryRun)
+	return
+}
+
+func (inst *instance) getFreeSpace(dwnldDir string) (freeSpace cunits.Bits, err error) {
+	if freeSpace, err = inst.client.FreeSpace(dwnldDir); err != nil {
+		metrics.rpcError(inst.name, "free-space")
+		return
 	}
+	metrics.freeSpace(inst.name, freeSpace)
+	return
 }
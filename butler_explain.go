@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hekmon/transmissionrpc"
+)
+
+// torrentExplanation details the inputs and the outcome of a torrent inspection
+type torrentExplanation struct {
+	Instance          string          `json:"instance,omitempty"`
+	ID                int64           `json:"id"`
+	Name              string          `json:"name"`
+	Status            string          `json:"status"`
+	SeedRatioMode     string          `json:"seed_ratio_mode"`
+	UploadRatio       float64         `json:"upload_ratio"`
+	DoneDate          time.Time       `json:"done_date"`
+	SeedTime          string          `json:"seed_time"`
+	LastUpload        *time.Time      `json:"last_upload,omitempty"`
+	Policy            string          `json:"policy"`
+	FreeSeedEnd       time.Time       `json:"free_seed_end"`
+	TargetRatio       float64         `json:"target_ratio"`
+	TargetRatioSource string          `json:"target_ratio_source"`
+	Decision          torrentDecision `json:"decision"`
+}
+
+func (inst *instance) fetchTorrent(id int64) (torrent *transmissionrpc.Torrent, err error) {
+	torrents, err := inst.client.TorrentGet(fields, []int64{id})
+	if err != nil {
+		metrics.rpcError(inst.name, "torrent-get")
+		return
+	}
+	if len(torrents) == 0 {
+		err = fmt.Errorf("torrent id %d not found", id)
+		return
+	}
+	torrent = torrents[0]
+	return
+}
+
+func (inst *instance) explainTorrent(torrent *transmissionrpc.Torrent, now time.Time) (explanation *torrentExplanation, err error) {
+	if !inst.torrentOK(torrent, 0) {
+		err = errors.New("torrent metadata is incomplete")
+		return
+	}
+	labels, err := inst.fetchLabels([]int64{*torrent.ID})
+	if err != nil {
+		err = fmt.Errorf("can't retrieve torrent labels: %v", err)
+		return
+	}
+	inst = inst.withLabels(labels)
+	policy := inst.getTorrentPolicy(torrent)
+	targetRatio, source := getTorrentTargetRatioSource(torrent, policy)
+	explanation = &torrentExplanation{
+		Instance:          inst.name,
+		ID:                *torrent.ID,
+		Name:              *torrent.Name,
+		Status:            torrent.Status.String(),
+		SeedRatioMode:     torrent.SeedRatioMode.String(),
+		UploadRatio:       *torrent.UploadRatio,
+		DoneDate:          *torrent.DoneDate,
+		Policy:            policy.String(),
+		FreeSeedEnd:       torrent.DoneDate.Add(policy.FreeSeed),
+		TargetRatio:       targetRatio,
+		TargetRatioSource: source,
+		Decision:          inst.inspectTorrent(torrent, policy, now),
+	}
+	if reason, protected := inst.getTorrentProtection(torrent); protected {
+		explanation.Decision = protectDecision(explanation.Decision, reason)
+	}
+	if policy.IdleTime > 0 {
+		lastUpload, _ := inst.getTorrentLastUpload(torrent)
+		explanation.LastUpload = &lastUpload
+	}
+	if torrent.SecondsSeeding != nil {
+		explanation.SeedTime = torrent.SecondsSeeding.String()
+	}
+	return
+}
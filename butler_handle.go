@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
@@ -8,7 +9,7 @@ import (
 	"github.com/hekmon/transmissionrpc"
 )
 
-func handleFreeseedCandidates(freeseedCandidates []*transmissionrpc.Torrent) {
+func (inst *instance) handleFreeseedCandidates(freeseedCandidates []*transmissionrpc.Torrent, dryRun bool) (handled int) {
 	if len(freeseedCandidates) == 0 {
 		return
 	}
@@ -22,34 +23,49 @@ func handleFreeseedCandidates(freeseedCandidates []*transmissionrpc.Torrent) {
 		nameList[index] = fmt.Sprintf("%s (ratio: %.02f/+∞)", *torrent.Name, *torrent.UploadRatio)
 		index++
 	}
-	// Run
-	err := transmission.TorrentSet(&transmissionrpc.TorrentSetPayload{
-		IDs:           IDList,
-		SeedRatioMode: &seedRatioMode,
-	})
 	var suffix string
 	if len(freeseedCandidates) > 1 {
 		suffix = "s"
 	}
+	// Dry run ?
+	if dryRun {
+		inst.butlerReportPlan(fmt.Sprintf("Would switch %d torrent%s to free seed mode", len(nameList), suffix),
+			nameList, "free seed candidates")
+		handled = len(nameList)
+		return
+	}
+	// Run
+	err := inst.client.TorrentSet(&transmissionrpc.TorrentSetPayload{
+		IDs:           IDList,
+		SeedRatioMode: &seedRatioMode,
+	})
 	if err != nil {
-		logger.Errorf("[Butler] Free seed switch for %d torrent%s failed: %v", len(freeseedCandidates), suffix, err)
-		pushoverClient.SendHighPriorityMsg(
-			fmt.Sprintf("Can't switch %d torrent%s to free seed mode: %v", len(freeseedCandidates), suffix, err),
-			"",
-			"free seed candidates",
-		)
+		metrics.rpcError(inst.name, "torrent-set")
+		inst.log.Errorf("Free seed switch for %d torrent%s failed: %v", len(freeseedCandidates), suffix, err)
+		inst.notify(notification{
+			Priority: priorityHigh,
+			Message:  fmt.Sprintf("Can't switch %d torrent%s to free seed mode: %v", len(freeseedCandidates), suffix, err),
+			Event:    "free seed candidates",
+		})
 		return
 	}
 	// Success
-	logger.Infof("[Butler] Successfully switched %d torrent%s to free seed mode", len(freeseedCandidates), suffix)
-	pushoverClient.SendNormalPriorityMsg(
-		butlerMakeStrList(nameList),
-		fmt.Sprintf("Switched %d torrent%s to free seed mode", len(nameList), suffix),
-		"free seed candidates",
-	)
+	handled = len(freeseedCandidates)
+	for _, torrent := range freeseedCandidates {
+		state.recordSwitch(inst.name, torrent, actionFreeSeed, 0)
+	}
+	inst.log.Infof("Successfully switched %d torrent%s to free seed mode", len(freeseedCandidates), suffix)
+	inst.notify(notification{
+		Priority: priorityNormal,
+		Title:    fmt.Sprintf("Switched %d torrent%s to free seed mode", len(nameList), suffix),
+		Message:  butlerMakeStrList(nameList),
+		Event:    "free seed candidates",
+		Torrents: nameList,
+	})
+	return
 }
 
-func handleGlobalratioCandidates(globalratioCandidates []*transmissionrpc.Torrent) {
+func (inst *instance) handleGlobalratioCandidates(globalratioCandidates []*transmissionrpc.Torrent, dryRun bool) (handled int) {
 	if len(globalratioCandidates) == 0 {
 		return
 	}
@@ -60,153 +76,692 @@ func handleGlobalratioCandidates(globalratioCandidates []*transmissionrpc.Torren
 	index := 0
 	for _, torrent := range globalratioCandidates {
 		IDList[index] = *torrent.ID
-		nameList[index] = fmt.Sprintf("%s (ratio: %.02f/%.02f)", *torrent.Name, *torrent.UploadRatio, conf.Butler.TargetRatio)
+		nameList[index] = fmt.Sprintf("%s (ratio: %.02f/%.02f)", *torrent.Name, *torrent.UploadRatio, inst.butler.TargetRatio)
 		index++
 	}
-	// Run
-	err := transmission.TorrentSet(&transmissionrpc.TorrentSetPayload{
-		IDs:           IDList,
-		SeedRatioMode: &seedRatioMode,
-	})
 	var suffix string
 	if len(globalratioCandidates) > 1 {
 		suffix = "s"
 	}
+	// Dry run ?
+	if dryRun {
+		inst.butlerReportPlan(fmt.Sprintf("Would switch %d torrent%s to global ratio mode", len(nameList), suffix),
+			nameList, "global ratio candidates")
+		handled = len(nameList)
+		return
+	}
+	// Run
+	err := inst.client.TorrentSet(&transmissionrpc.TorrentSetPayload{
+		IDs:           IDList,
+		SeedRatioMode: &seedRatioMode,
+	})
 	if err != nil {
-		logger.Errorf("[Butler] global ratio switch for %d torrent%s failed: %v", len(globalratioCandidates), suffix, err)
-		pushoverClient.SendHighPriorityMsg(
-			fmt.Sprintf("Can't switch %d torrent%s to global ratio mode: %v", len(globalratioCandidates), suffix, err),
-			"",
-			"global ratio candidates",
-		)
+		metrics.rpcError(inst.name, "torrent-set")
+		inst.log.Errorf("global ratio switch for %d torrent%s failed: %v", len(globalratioCandidates), suffix, err)
+		inst.notify(notification{
+			Priority: priorityHigh,
+			Message:  fmt.Sprintf("Can't switch %d torrent%s to global ratio mode: %v", len(globalratioCandidates), suffix, err),
+			Event:    "global ratio candidates",
+		})
 		return
 	}
 	// Success
-	logger.Infof("[Butler] Successfully switched %d torrent%s to global ratio mode", len(globalratioCandidates), suffix)
-	pushoverClient.SendNormalPriorityMsg(
-		butlerMakeStrList(nameList),
-		fmt.Sprintf("Switched %d torrent%s to global ratio mode", len(globalratioCandidates), suffix),
-		"global ratio candidates",
-	)
+	handled = len(globalratioCandidates)
+	for _, torrent := range globalratioCandidates {
+		state.recordSwitch(inst.name, torrent, actionGlobalRatio, inst.butler.TargetRatio)
+	}
+	inst.log.Infof("Successfully switched %d torrent%s to global ratio mode", len(globalratioCandidates), suffix)
+	inst.notify(notification{
+		Priority: priorityNormal,
+		Title:    fmt.Sprintf("Switched %d torrent%s to global ratio mode", len(globalratioCandidates), suffix),
+		Message:  butlerMakeStrList(nameList),
+		Event:    "global ratio candidates",
+		Torrents: nameList,
+	})
+	return
 }
 
-func handleCustomratioCandidates(customratioCandidates []*transmissionrpc.Torrent) {
+func (inst *instance) handleCustomratioCandidates(ctx context.Context, customratioCandidates []*transmissionrpc.Torrent, dryRun bool) (handled int) {
 	if len(customratioCandidates) == 0 {
 		return
 	}
-	// Build
+	// Build (one batch per saved ratio as it is shared within a torrent-set call)
 	seedRatioMode := transmissionrpc.SeedRatioModeCustom
-	IDList := make([]int64, len(customratioCandidates))
-	nameList := make([]string, len(customratioCandidates))
-	index := 0
+	ratios := make([]float64, 0, len(customratioCandidates))
+	torrentLists := make(map[float64][]*transmissionrpc.Torrent, len(customratioCandidates))
 	for _, torrent := range customratioCandidates {
-		IDList[index] = *torrent.ID
-		nameList[index] = fmt.Sprintf("%s (ratio: %.02f/%.02f)", *torrent.Name, *torrent.UploadRatio, *torrent.SeedRatioLimit)
-		index++
+		ratio, _ := inst.getSavedCustomRatio(torrent, inst.getTorrentPolicy(torrent))
+		if _, found := torrentLists[ratio]; !found {
+			ratios = append(ratios, ratio)
+		}
+		torrentLists[ratio] = append(torrentLists[ratio], torrent)
 	}
-	// Run
-	err := transmission.TorrentSet(&transmissionrpc.TorrentSetPayload{
-		IDs:           IDList,
-		SeedRatioMode: &seedRatioMode,
-	})
-	var suffix string
-	if len(customratioCandidates) > 1 {
-		suffix = "s"
+	// Run each batch
+	for _, savedRatio := range ratios {
+		if ctx.Err() != nil {
+			break
+		}
+		ratio := savedRatio
+		torrents := torrentLists[ratio]
+		IDList := make([]int64, len(torrents))
+		nameList := make([]string, len(torrents))
+		for index, torrent := range torrents {
+			IDList[index] = *torrent.ID
+			nameList[index] = fmt.Sprintf("%s (ratio: %.02f/%.02f)", *torrent.Name, *torrent.UploadRatio, ratio)
+		}
+		var suffix string
+		if len(IDList) > 1 {
+			suffix = "s"
+		}
+		// Dry run ?
+		if dryRun {
+			inst.butlerReportPlan(fmt.Sprintf("Would switch %d torrent%s to custom ratio mode", len(nameList), suffix),
+				nameList, "custom ratio candidates")
+			handled += len(nameList)
+			continue
+		}
+		// Run
+		err := inst.client.TorrentSet(&transmissionrpc.TorrentSetPayload{
+			IDs:            IDList,
+			SeedRatioMode:  &seedRatioMode,
+			SeedRatioLimit: &ratio,
+		})
+		if err != nil {
+			metrics.rpcError(inst.name, "torrent-set")
+			inst.log.Errorf("custom ratio switch for %d torrent%s failed: %v", len(IDList), suffix, err)
+			inst.notify(notification{
+				Priority: priorityHigh,
+				Message:  fmt.Sprintf("Can't switch %d torrent%s to custom ratio mode: %v", len(IDList), suffix, err),
+				Event:    "custom ratio candidates",
+			})
+			continue
+		}
+		// Success
+		handled += len(IDList)
+		for _, torrent := range torrents {
+			state.recordSwitch(inst.name, torrent, actionCustomRatio, ratio)
+		}
+		inst.log.Infof("Successfully switched %d torrent%s to custom ratio mode", len(IDList), suffix)
+		inst.notify(notification{
+			Priority: priorityNormal,
+			Title:    fmt.Sprintf("Switched %d torrent%s to custom ratio mode", len(IDList), suffix),
+			Message:  butlerMakeStrList(nameList),
+			Event:    "custom ratio candidates",
+			Torrents: nameList,
+		})
 	}
-	if err != nil {
-		logger.Errorf("[Butler] custom ratio switch for %d torrent%s failed: %v", len(customratioCandidates), suffix, err)
-		pushoverClient.SendHighPriorityMsg(
-			fmt.Sprintf("Can't switch %d torrent%s to custom ratio mode: %v", len(customratioCandidates), suffix, err),
-			"",
-			"custom ratio candidates",
-		)
+	return
+}
+
+func (inst *instance) handlePolicyratioCandidates(ctx context.Context, policyratioCandidates []*transmissionrpc.Torrent, dryRun bool) (handled int) {
+	if len(policyratioCandidates) == 0 {
 		return
 	}
-	// Success
-	logger.Infof("[Butler] Successfully switched %d torrent%s to custom ratio mode", len(customratioCandidates), suffix)
-	pushoverClient.SendNormalPriorityMsg(
-		butlerMakeStrList(nameList),
-		fmt.Sprintf("Switched %d torrent%s to custom ratio mode", len(customratioCandidates), suffix),
-		"custom ratio candidates",
-	)
+	// Build (one batch per target ratio as it is shared within a torrent-set call)
+	seedRatioMode := transmissionrpc.SeedRatioModeCustom
+	ratios := make([]float64, 0, len(policyratioCandidates))
+	IDLists := make(map[float64][]int64, len(policyratioCandidates))
+	nameLists := make(map[float64][]string, len(policyratioCandidates))
+	torrentLists := make(map[float64][]*transmissionrpc.Torrent, len(policyratioCandidates))
+	for _, torrent := range policyratioCandidates {
+		policy := inst.getTorrentPolicy(torrent)
+		if _, found := IDLists[policy.TargetRatio]; !found {
+			ratios = append(ratios, policy.TargetRatio)
+		}
+		IDLists[policy.TargetRatio] = append(IDLists[policy.TargetRatio], *torrent.ID)
+		torrentLists[policy.TargetRatio] = append(torrentLists[policy.TargetRatio], torrent)
+		nameLists[policy.TargetRatio] = append(nameLists[policy.TargetRatio],
+			fmt.Sprintf("%s (ratio: %.02f/%.02f, policy: %s)", *torrent.Name, *torrent.UploadRatio, policy.TargetRatio, policy.Name))
+	}
+	// Run each batch
+	for _, targetRatio := range ratios {
+		if ctx.Err() != nil {
+			break
+		}
+		ratio := targetRatio
+		IDList := IDLists[ratio]
+		nameList := nameLists[ratio]
+		var suffix string
+		if len(IDList) > 1 {
+			suffix = "s"
+		}
+		// Dry run ?
+		if dryRun {
+			inst.butlerReportPlan(fmt.Sprintf("Would switch %d torrent%s to their policy ratio (%.02f)", len(nameList), suffix, ratio),
+				nameList, "policy ratio candidates")
+			handled += len(nameList)
+			continue
+		}
+		// Run
+		err := inst.client.TorrentSet(&transmissionrpc.TorrentSetPayload{
+			IDs:            IDList,
+			SeedRatioMode:  &seedRatioMode,
+			SeedRatioLimit: &ratio,
+		})
+		if err != nil {
+			metrics.rpcError(inst.name, "torrent-set")
+			inst.log.Errorf("policy ratio (%.02f) switch for %d torrent%s failed: %v", ratio, len(IDList), suffix, err)
+			inst.notify(notification{
+				Priority: priorityHigh,
+				Message:  fmt.Sprintf("Can't switch %d torrent%s to their policy ratio (%.02f): %v", len(IDList), suffix, ratio, err),
+				Event:    "policy ratio candidates",
+			})
+			continue
+		}
+		// Success
+		handled += len(IDList)
+		for _, torrent := range torrentLists[ratio] {
+			state.recordSwitch(inst.name, torrent, actionPolicyRatio, ratio)
+		}
+		inst.log.Infof("Successfully switched %d torrent%s to their policy ratio (%.02f)", len(IDList), suffix, ratio)
+		inst.notify(notification{
+			Priority: priorityNormal,
+			Title:    fmt.Sprintf("Switched %d torrent%s to their policy ratio (%.02f)", len(nameList), suffix, ratio),
+			Message:  butlerMakeStrList(nameList),
+			Event:    "policy ratio candidates",
+			Torrents: nameList,
+		})
+	}
+	return
 }
 
-func handleTodeleteCandidates(todeleteCandidates []*transmissionrpc.Torrent, dwnldDir *string) {
+func (inst *instance) handleTodeleteCandidates(ctx context.Context, todeleteCandidates []*transmissionrpc.Torrent, dwnldDir *string, dryRun bool) (handled int) {
 	if len(todeleteCandidates) == 0 {
 		return
 	}
 	// Build
 	IDList := make([]int64, len(todeleteCandidates))
 	nameList := make([]string, len(todeleteCandidates))
+	var totalSize cunits.Bits
 	index := 0
 	for _, torrent := range todeleteCandidates {
 		IDList[index] = *torrent.ID
-		nameList[index] = fmt.Sprintf("%s (ratio: %.02f/%.02f)", *torrent.Name, *torrent.UploadRatio, getTorrentTargetRatio(torrent))
+		nameList[index] = fmt.Sprintf("%s (ratio: %.02f/%.02f)", *torrent.Name, *torrent.UploadRatio, inst.getTorrentTargetRatio(torrent))
+		if torrent.TotalSize != nil {
+			totalSize += *torrent.TotalSize
+		}
 		index++
 	}
-	// Run
-	err := transmission.TorrentRemove(&transmissionrpc.TorrentRemovePayload{
-		IDs:             IDList,
-		DeleteLocalData: true,
-	})
 	var suffix string
 	if len(nameList) > 1 {
 		suffix = "s"
 	}
+	// Dry run ?
+	if dryRun {
+		if inst.butler.Quarantine != nil {
+			inst.butlerReportPlan(fmt.Sprintf("Would quarantine %d finished torrent%s (%s) in '%s'", len(nameList), suffix, totalSize, inst.butler.Quarantine.Dir),
+				nameList, "delete candidates")
+		} else {
+			inst.butlerReportPlan(fmt.Sprintf("Would delete %d finished torrent%s (%s)", len(nameList), suffix, totalSize),
+				nameList, "delete candidates")
+		}
+		handled = len(nameList)
+		return
+	}
+	// Run
+	if inst.butler.Quarantine != nil {
+		return inst.handleQuarantine(ctx, todeleteCandidates)
+	}
+	err := inst.client.TorrentRemove(&transmissionrpc.TorrentRemovePayload{
+		IDs:             IDList,
+		DeleteLocalData: true,
+	})
 	if err != nil {
-		logger.Errorf("[Butler] Failted to deleted the %d finished torrent%s: %s", len(todeleteCandidates), suffix, err)
-		pushoverClient.SendHighPriorityMsg(
-			fmt.Sprintf("Can't delete %d finished torrent%s: %v", len(todeleteCandidates), suffix, err),
-			"",
-			"delete candidates",
-		)
+		metrics.rpcError(inst.name, "torrent-remove")
+		inst.log.Errorf("Failed to delete the %d finished torrent%s: %s", len(todeleteCandidates), suffix, err)
+		inst.notify(notification{
+			Priority: priorityHigh,
+			Message:  fmt.Sprintf("Can't delete %d finished torrent%s: %v", len(todeleteCandidates), suffix, err),
+			Event:    "delete candidates",
+		})
 		return
 	}
-	logger.Infof("[Butler] Successfully deleted the %d finished torrent%s", len(todeleteCandidates), suffix)
+	handled = len(todeleteCandidates)
+	for _, torrent := range todeleteCandidates {
+		state.recordDeletion(inst.name, torrent, actionDelete)
+	}
+	inst.log.Infof("Successfully deleted the %d finished torrent%s", len(todeleteCandidates), suffix)
 	// Fetch free space
 	if dwnldDir == nil {
-		logger.Warning("[Butler] Can't fetch free space: session dwld dir is nil")
+		inst.log.Warning("Can't fetch free space: session dwld dir is nil")
 		return
 	}
 	var freeSpace cunits.Bits
-	if freeSpace, err = transmission.FreeSpace(*dwnldDir); err != nil {
-		pushoverClient.SendNormalPriorityMsg(
-			fmt.Sprintf("Deleted:\n%s", butlerMakeStrList(nameList)),
-			fmt.Sprintf("%d finished torrent%s deleted", len(nameList), suffix),
-			"delete candidates",
-		)
-		pushoverClient.SendHighPriorityMsg(
-			fmt.Sprintf("Can't check free space in '%s' dir: %v", *dwnldDir, err),
-			"",
-			"delete candidates",
-		)
+	if freeSpace, err = inst.getFreeSpace(*dwnldDir); err != nil {
+		inst.notify(notification{
+			Priority: priorityNormal,
+			Title:    fmt.Sprintf("%d finished torrent%s deleted", len(nameList), suffix),
+			Message:  fmt.Sprintf("Deleted:\n%s", butlerMakeStrList(nameList)),
+			Event:    "delete candidates",
+			Torrents: nameList,
+		})
+		inst.notify(notification{
+			Priority: priorityHigh,
+			Message:  fmt.Sprintf("Can't check free space in '%s' dir: %v", *dwnldDir, err),
+			Event:    "delete candidates",
+		})
 		return
 	}
 	// success
-	logger.Infof("[Butler] Remaining free space in download dir: %s", freeSpace)
-	pushoverClient.SendNormalPriorityMsg(
-		fmt.Sprintf("%s free after deleting:\n%s", freeSpace, butlerMakeStrList(nameList)),
-		fmt.Sprintf("%d finished torrent%s deleted", len(nameList), suffix),
-		"delete candidates",
-	)
+	inst.log.Infof("Remaining free space in download dir: %s", freeSpace)
+	inst.notify(notification{
+		Priority: priorityNormal,
+		Title:    fmt.Sprintf("%d finished torrent%s deleted", len(nameList), suffix),
+		Message:  fmt.Sprintf("%s free after deleting:\n%s", freeSpace, butlerMakeStrList(nameList)),
+		Event:    "delete candidates",
+		Torrents: nameList,
+	})
+	return
+}
+
+func (inst *instance) handleQuarantine(ctx context.Context, todeleteCandidates []*transmissionrpc.Torrent) (handled int) {
+	quarantined, err := inst.quarantineTorrents(ctx, todeleteCandidates)
+	handled = len(quarantined)
+	for _, torrent := range quarantined {
+		state.recordDeletion(inst.name, torrent, actionQuarantine)
+	}
+	if err != nil {
+		inst.log.Errorf("Failed to quarantine the finished torrents (%d/%d quarantined): %v", handled, len(todeleteCandidates), err)
+		inst.notify(notification{
+			Priority: priorityHigh,
+			Message:  fmt.Sprintf("Can't quarantine the finished torrents (%d/%d quarantined): %v", handled, len(todeleteCandidates), err),
+			Event:    "delete candidates",
+		})
+	}
+	if handled == 0 {
+		return
+	}
+	nameList := make([]string, len(quarantined))
+	for index, torrent := range quarantined {
+		nameList[index] = fmt.Sprintf("%s (ratio: %.02f/%.02f)", *torrent.Name, *torrent.UploadRatio, inst.getTorrentTargetRatio(torrent))
+	}
+	var suffix, retention string
+	if handled > 1 {
+		suffix = "s"
+	}
+	if inst.butler.Quarantine.Retention > 0 {
+		retention = fmt.Sprintf(" (purged after %.0f days)", inst.butler.Quarantine.Retention.Hours()/24)
+	}
+	inst.log.Infof("Successfully quarantined the %d finished torrent%s", handled, suffix)
+	inst.notify(notification{
+		Priority: priorityNormal,
+		Title:    fmt.Sprintf("%d finished torrent%s quarantined", handled, suffix),
+		Message:  fmt.Sprintf("Moved to '%s'%s:\n%s", inst.butler.Quarantine.Dir, retention, butlerMakeStrList(nameList)),
+		Event:    "delete candidates",
+		Torrents: nameList,
+	})
+	return
+}
+
+func (inst *instance) handleIdleCandidates(ctx context.Context, idleCandidates []*transmissionrpc.Torrent, dryRun bool) (handled int) {
+	if len(idleCandidates) == 0 {
+		return
+	}
+	// Build
+	IDList := make([]int64, len(idleCandidates))
+	nameList := make([]string, len(idleCandidates))
+	var totalSize cunits.Bits
+	for index, torrent := range idleCandidates {
+		IDList[index] = *torrent.ID
+		lastUpload, _ := inst.getTorrentLastUpload(torrent)
+		nameList[index] = fmt.Sprintf("%s (ratio: %.02f/%.02f, last upload: %s)", *torrent.Name, *torrent.UploadRatio,
+			inst.getTorrentTargetRatio(torrent), lastUpload.Format("2006-01-02"))
+		if torrent.TotalSize != nil {
+			totalSize += *torrent.TotalSize
+		}
+	}
+	var suffix string
+	if len(nameList) > 1 {
+		suffix = "s"
+	}
+	// Dry run ?
+	if dryRun {
+		switch {
+		case inst.butler.IdleAction == idleActionStop:
+			inst.butlerReportPlan(fmt.Sprintf("Would stop %d idle torrent%s", len(nameList), suffix), nameList, "idle candidates")
+		case inst.butler.Quarantine != nil:
+			inst.butlerReportPlan(fmt.Sprintf("Would quarantine %d idle torrent%s (%s) in '%s'", len(nameList), suffix, totalSize, inst.butler.Quarantine.Dir),
+				nameList, "idle candidates")
+		default:
+			inst.butlerReportPlan(fmt.Sprintf("Would delete %d idle torrent%s (%s)", len(nameList), suffix, totalSize), nameList, "idle candidates")
+		}
+		handled = len(nameList)
+		return
+	}
+	// Run
+	if inst.butler.IdleAction == idleActionStop {
+		if err := inst.client.TorrentStopIDs(IDList); err != nil {
+			metrics.rpcError(inst.name, "torrent-stop")
+			inst.log.Errorf("Stopping %d idle torrent%s failed: %v", len(idleCandidates), suffix, err)
+			inst.notify(notification{
+				Priority: priorityHigh,
+				Message:  fmt.Sprintf("Can't stop %d idle torrent%s: %v", len(idleCandidates), suffix, err),
+				Event:    "idle candidates",
+			})
+			return
+		}
+		handled = len(idleCandidates)
+		inst.log.Infof("Successfully stopped %d idle torrent%s", handled, suffix)
+		inst.notify(notification{
+			Priority: priorityNormal,
+			Title:    fmt.Sprintf("Stopped %d idle torrent%s", handled, suffix),
+			Message:  fmt.Sprintf("%s could be reclaimed by deleting:\n%s", totalSize, butlerMakeStrList(nameList)),
+			Event:    "idle candidates",
+			Torrents: nameList,
+		})
+		return
+	}
+	removed := idleCandidates
+	var err error
+	if inst.butler.Quarantine != nil {
+		removed, err = inst.quarantineTorrents(ctx, idleCandidates)
+	} else if err = inst.client.TorrentRemove(&transmissionrpc.TorrentRemovePayload{
+		IDs:             IDList,
+		DeleteLocalData: true,
+	}); err != nil {
+		metrics.rpcError(inst.name, "torrent-remove")
+		removed = nil
+	}
+	if err != nil {
+		inst.log.Errorf("Failed to delete the idle torrents (%d/%d deleted): %v", len(removed), len(idleCandidates), err)
+		inst.notify(notification{
+			Priority: priorityHigh,
+			Message:  fmt.Sprintf("Can't delete the idle torrents (%d/%d deleted): %v", len(removed), len(idleCandidates), err),
+			Event:    "idle candidates",
+		})
+	}
+	if len(removed) == 0 {
+		return
+	}
+	// Success
+	handled = len(removed)
+	removedList := make([]string, 0, len(removed))
+	var reclaimed cunits.Bits
+	for _, torrent := range removed {
+		state.recordDeletion(inst.name, torrent, actionIdle)
+		if torrent.TotalSize != nil {
+			reclaimed += *torrent.TotalSize
+		}
+		for index, candidate := range idleCandidates {
+			if candidate == torrent {
+				removedList = append(removedList, nameList[index])
+				break
+			}
+		}
+	}
+	if handled > 1 {
+		suffix = "s"
+	} else {
+		suffix = ""
+	}
+	message := fmt.Sprintf("%s reclaimed by deleting:\n%s", reclaimed, butlerMakeStrList(removedList))
+	if inst.butler.Quarantine != nil {
+		message = fmt.Sprintf("%s moved to '%s', reclaimed once purged:\n%s", reclaimed, inst.butler.Quarantine.Dir, butlerMakeStrList(removedList))
+	}
+	inst.log.Infof("Successfully deleted %d idle torrent%s (%s)", handled, suffix, reclaimed)
+	inst.notify(notification{
+		Priority: priorityNormal,
+		Title:    fmt.Sprintf("%d idle torrent%s deleted", handled, suffix),
+		Message:  message,
+		Event:    "idle candidates",
+		Torrents: removedList,
+	})
+	return
+}
+
+func (inst *instance) handleStopCandidates(stopCandidates []*transmissionrpc.Torrent, dryRun bool) (handled int) {
+	if len(stopCandidates) == 0 {
+		return
+	}
+	// Build
+	IDList := make([]int64, len(stopCandidates))
+	nameList := make([]string, len(stopCandidates))
+	for index, torrent := range stopCandidates {
+		IDList[index] = *torrent.ID
+		nameList[index] = fmt.Sprintf("%s (ratio: %.02f, policy: %s)", *torrent.Name, *torrent.UploadRatio, inst.getTorrentPolicy(torrent).Name)
+	}
+	var suffix string
+	if len(stopCandidates) > 1 {
+		suffix = "s"
+	}
+	// Dry run ?
+	if dryRun {
+		inst.butlerReportPlan(fmt.Sprintf("Would stop %d torrent%s", len(nameList), suffix), nameList, "stop candidates")
+		handled = len(nameList)
+		return
+	}
+	// Run
+	if err := inst.client.TorrentStopIDs(IDList); err != nil {
+		metrics.rpcError(inst.name, "torrent-stop")
+		inst.log.Errorf("Stopping %d torrent%s failed: %v", len(stopCandidates), suffix, err)
+		inst.notify(notification{
+			Priority: priorityHigh,
+			Message:  fmt.Sprintf("Can't stop %d torrent%s: %v", len(stopCandidates), suffix, err),
+			Event:    "stop candidates",
+		})
+		return
+	}
+	// Success
+	handled = len(stopCandidates)
+	for _, torrent := range stopCandidates {
+		if action := inst.getTorrentPolicy(torrent).Action; action != nil && action.name == ruleActionStop {
+			state.recordStop(inst.name, torrent)
+		}
+	}
+	inst.log.Infof("Successfully stopped %d torrent%s", len(stopCandidates), suffix)
+	inst.notify(notification{
+		Priority: priorityNormal,
+		Title:    fmt.Sprintf("Stopped %d torrent%s", len(nameList), suffix),
+		Message:  butlerMakeStrList(nameList),
+		Event:    "stop candidates",
+		Torrents: nameList,
+	})
+	return
+}
+
+func (inst *instance) handleMoveCandidates(ctx context.Context, moveCandidates []*transmissionrpc.Torrent, dryRun bool) (handled int) {
+	if len(moveCandidates) == 0 {
+		return
+	}
+	// Build (one batch per destination dir)
+	dirs := make([]string, 0, len(moveCandidates))
+	torrentLists := make(map[string][]*transmissionrpc.Torrent, len(moveCandidates))
+	nameLists := make(map[string][]string, len(moveCandidates))
+	for _, torrent := range moveCandidates {
+		policy := inst.getTorrentPolicy(torrent)
+		if policy.Action == nil || policy.Action.name != ruleActionMove {
+			// the rules changed since the inspection
+			continue
+		}
+		dir := policy.Action.dir
+		if _, found := torrentLists[dir]; !found {
+			dirs = append(dirs, dir)
+		}
+		torrentLists[dir] = append(torrentLists[dir], torrent)
+		nameLists[dir] = append(nameLists[dir], fmt.Sprintf("%s (from '%s', policy: %s)", *torrent.Name, *torrent.DownloadDir, policy.Name))
+	}
+	// Run each batch
+	for _, dir := range dirs {
+		nameList := nameLists[dir]
+		var suffix string
+		if len(nameList) > 1 {
+			suffix = "s"
+		}
+		// Dry run ?
+		if dryRun {
+			inst.butlerReportPlan(fmt.Sprintf("Would move %d torrent%s to '%s'", len(nameList), suffix, dir), nameList, "move candidates")
+			handled += len(nameList)
+			continue
+		}
+		// Run (set-location is done torrent by torrent to know which ones failed)
+		var movedList []string
+		for index, torrent := range torrentLists[dir] {
+			if ctx.Err() != nil {
+				break
+			}
+			if err := inst.client.TorrentSetLocation(*torrent.ID, dir, true); err != nil {
+				metrics.rpcError(inst.name, "torrent-set-location")
+				inst.log.Errorf("Can't move torrent id %d (%s) to '%s': %v", *torrent.ID, *torrent.Name, dir, err)
+				inst.notify(notification{
+					Priority: priorityHigh,
+					Message:  fmt.Sprintf("Can't move %s to '%s': %v", *torrent.Name, dir, err),
+					Event:    "move candidates",
+				})
+				continue
+			}
+			movedList = append(movedList, nameList[index])
+		}
+		if len(movedList) == 0 {
+			continue
+		}
+		// Success
+		handled += len(movedList)
+		if len(movedList) > 1 {
+			suffix = "s"
+		} else {
+			suffix = ""
+		}
+		inst.log.Infof("Successfully moved %d torrent%s to '%s'", len(movedList), suffix, dir)
+		inst.notify(notification{
+			Priority: priorityNormal,
+			Title:    fmt.Sprintf("Moved %d torrent%s to '%s'", len(movedList), suffix, dir),
+			Message:  butlerMakeStrList(movedList),
+			Event:    "move candidates",
+			Torrents: movedList,
+		})
+	}
+	return
+}
+
+func (inst *instance) handleEvictionCandidates(ctx context.Context, evictionCandidates []*transmissionrpc.Torrent, expectedFreeSpace cunits.Bits, insufficient bool, dryRun bool) (handled int) {
+	if insufficient {
+		inst.notify(notification{
+			Priority: priorityHigh,
+			Message: fmt.Sprintf("Not enough evictable torrents to get back above the %s free space floor: only %s will be available",
+				inst.butler.Eviction.MinFreeSpace, expectedFreeSpace),
+			Event: "eviction candidates",
+		})
+	}
+	if len(evictionCandidates) == 0 {
+		return
+	}
+	// Build
+	IDList := make([]int64, len(evictionCandidates))
+	nameList := make([]string, len(evictionCandidates))
+	var totalSize cunits.Bits
+	for index, torrent := range evictionCandidates {
+		IDList[index] = *torrent.ID
+		nameList[index] = fmt.Sprintf("%s (%s, ratio: %.02f)", *torrent.Name, *torrent.TotalSize, *torrent.UploadRatio)
+		totalSize += *torrent.TotalSize
+	}
+	var suffix string
+	if len(nameList) > 1 {
+		suffix = "s"
+	}
+	// Dry run ?
+	if dryRun {
+		if inst.butler.Quarantine != nil {
+			inst.butlerReportPlan(fmt.Sprintf("Would evict %d torrent%s (%s) to the quarantine dir '%s' to respect the free space floor", len(nameList),
+				suffix, totalSize, inst.butler.Quarantine.Dir), nameList, "eviction candidates")
+		} else {
+			inst.butlerReportPlan(fmt.Sprintf("Would evict %d torrent%s (%s) to respect the free space floor", len(nameList), suffix, totalSize),
+				nameList, "eviction candidates")
+		}
+		handled = len(nameList)
+		return
+	}
+	// Run
+	evicted := evictionCandidates
+	var err error
+	if inst.butler.Quarantine != nil {
+		evicted, err = inst.quarantineTorrents(ctx, evictionCandidates)
+	} else if err = inst.client.TorrentRemove(&transmissionrpc.TorrentRemovePayload{
+		IDs:             IDList,
+		DeleteLocalData: true,
+	}); err != nil {
+		metrics.rpcError(inst.name, "torrent-remove")
+		evicted = nil
+	}
+	if err != nil {
+		inst.log.Errorf("Failed to evict the %d selected torrent%s (%d evicted): %s", len(IDList), suffix, len(evicted), err)
+		inst.notify(notification{
+			Priority: priorityHigh,
+			Message:  fmt.Sprintf("Can't evict %d torrent%s (%d evicted): %v", len(IDList), suffix, len(evicted), err),
+			Event:    "eviction candidates",
+		})
+	}
+	if len(evicted) == 0 {
+		return
+	}
+	// Success
+	handled = len(evicted)
+	evictedList := make([]string, 0, len(evicted))
+	var evictedSize cunits.Bits
+	for _, torrent := range evicted {
+		state.recordDeletion(inst.name, torrent, actionEvict)
+		evictedSize += *torrent.TotalSize
+		for index, candidate := range evictionCandidates {
+			if candidate == torrent {
+				evictedList = append(evictedList, nameList[index])
+				break
+			}
+		}
+	}
+	for _, name := range evictedList {
+		if inst.butler.Quarantine != nil {
+			inst.log.Infof("Evicted '%s' to the quarantine dir", name)
+		} else {
+			inst.log.Infof("Evicted '%s' along with its data", name)
+		}
+	}
+	if handled > 1 {
+		suffix = "s"
+	} else {
+		suffix = ""
+	}
+	// quarantined data is only freed once purged: the purge of the next batch takes care of it if space is still needed
+	message := fmt.Sprintf("%s should be free after evicting:\n%s", expectedFreeSpace-(totalSize-evictedSize), butlerMakeStrList(evictedList))
+	if inst.butler.Quarantine != nil {
+		message = fmt.Sprintf("Moved to '%s', purged as soon as space is needed:\n%s", inst.butler.Quarantine.Dir, butlerMakeStrList(evictedList))
+	}
+	inst.log.Infof("Successfully evicted %d torrent%s (%s)", handled, suffix, evictedSize)
+	inst.notify(notification{
+		Priority: priorityNormal,
+		Title:    fmt.Sprintf("%d torrent%s evicted to free %s", handled, suffix, evictedSize),
+		Message:  message,
+		Event:    "eviction candidates",
+		Torrents: evictedList,
+	})
+	return
+}
+
+func (inst *instance) butlerReportPlan(title string, nameList []string, event string) {
+	list := butlerMakeStrList(nameList)
+	inst.log.Infof("[DryRun] %s:\n%s", title, list)
+	inst.notify(notification{
+		Priority: priorityNormal,
+		Title:    fmt.Sprintf("[Dry run] %s", title),
+		Message:  list,
+		Event:    event,
+		Torrents: nameList,
+	})
 }
 
 func butlerMakeStrList(items []string) string {
+	list := make([]string, len(items))
 	for index, item := range items {
-		items[index] = fmt.Sprintf("• %s", item)
+		list[index] = fmt.Sprintf("• %s", item)
 	}
-	return strings.Join(items, "\n")
+	return strings.Join(list, "\n")
 }
 
-func getTorrentTargetRatio(torrent *transmissionrpc.Torrent) float64 {
+func (inst *instance) getTorrentTargetRatio(torrent *transmissionrpc.Torrent) float64 {
 	if torrent == nil || torrent.SeedRatioMode == nil {
 		return -1
 	}
-	if *torrent.SeedRatioMode == transmissionrpc.SeedRatioModeCustom {
-		if torrent.SeedRatioLimit == nil {
-			return -2
-		}
-		return *torrent.SeedRatioLimit
+	if *torrent.SeedRatioMode == transmissionrpc.SeedRatioModeCustom && torrent.SeedRatioLimit == nil {
+		return -2
 	}
-	return conf.Butler.TargetRatio
+	targetRatio, _ := getTorrentTargetRatioSource(torrent, inst.getTorrentPolicy(torrent))
+	return targetRatio
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/hekmon/cunits/v2"
+	"github.com/hekmon/transmissionrpc"
+)
+
+// errConnectionRefused is the error of a server which is down
+var errConnectionRefused = &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+// TestBatch runs whole batches on the fake transmission, where the decisions are applied
+func TestBatch(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		butler     string // added to the base butler values: 2 days of free seed and a target ratio of 2
+		dryRun     bool
+		failures   map[string]error
+		errorClass string // empty for a successful batch
+		actions    map[string]int
+		postponed  map[string]int
+		removed    []int64
+		modes      map[int64]transmissionrpc.SeedRatioMode
+		freeSpace  cunits.Bits
+	}{
+		{name: "ratio switches",
+			actions: map[string]int{actionFreeSeed: 1, actionGlobalRatio: 1, actionDelete: 0},
+			modes:   map[int64]transmissionrpc.SeedRatioMode{1: noRatio, 2: global}},
+		{name: "finished torrent deleted", butler: `"delete_when_done": true`,
+			actions:   map[string]int{actionFreeSeed: 1, actionGlobalRatio: 1, actionDelete: 1},
+			removed:   []int64{3},
+			freeSpace: 101 * cunits.GiB},
+		{name: "dry run", butler: `"delete_when_done": true`, dryRun: true,
+			actions: map[string]int{actionFreeSeed: 1, actionGlobalRatio: 1, actionDelete: 1},
+			modes:   map[int64]transmissionrpc.SeedRatioMode{1: global, 2: noRatio}},
+		{name: "protected torrent kept", butler: `"delete_when_done": true, "protection": {"labels": ["keep"]}`,
+			actions: map[string]int{actionDelete: 0, actionProtected: 1}},
+		{name: "deletion postponed outside of its window", butler: `"delete_when_done": true, "windows": {"delete": ["22:00-06:00"]}`,
+			actions:   map[string]int{actionFreeSeed: 1, actionDelete: 0},
+			postponed: map[string]int{actionDelete: 1}},
+		{name: "deletion within its window", butler: `"delete_when_done": true, "windows": {"deletions": ["10:00-14:00"]}`,
+			actions: map[string]int{actionDelete: 1},
+			removed: []int64{3}},
+		{name: "ratio switches postponed", butler: `"windows": {"ratio_switches": ["00:00-01:00"]}`,
+			actions:   map[string]int{actionFreeSeed: 0, actionGlobalRatio: 0},
+			postponed: map[string]int{actionFreeSeed: 1, actionGlobalRatio: 1},
+			modes:     map[int64]transmissionrpc.SeedRatioMode{1: global, 2: noRatio}},
+		{name: "eviction after the deletions", butler: `"delete_when_done": true, "eviction": {"min_free_space": "105 GiB", "order": "oldest_done"}`,
+			actions:   map[string]int{actionDelete: 1, actionEvict: 1},
+			removed:   []int64{3, 4},
+			freeSpace: 111 * cunits.GiB},
+		{name: "eviction order", butler: `"eviction": {"min_free_space": "105 GiB", "order": "highest_ratio"}`,
+			actions: map[string]int{actionEvict: 2},
+			removed: []int64{2, 3}},
+		{name: "eviction postponed", butler: `"eviction": {"min_free_space": "105 GiB"}, "windows": {"evict": ["22:00-06:00"]}`,
+			actions:   map[string]int{actionEvict: 0},
+			postponed: map[string]int{actionEvict: 1}},
+		// RPC failures
+		{name: "torrents fetch failure", butler: `"delete_when_done": true`,
+			failures:   map[string]error{"torrent-get": errConnectionRefused},
+			errorClass: rpcErrorConnection,
+			modes:      map[int64]transmissionrpc.SeedRatioMode{1: global, 2: noRatio}},
+		{name: "ratio switch failure",
+			failures: map[string]error{"torrent-set": syscall.ECONNRESET},
+			actions:  map[string]int{actionFreeSeed: 0, actionGlobalRatio: 0},
+			modes:    map[int64]transmissionrpc.SeedRatioMode{1: global, 2: noRatio}},
+		{name: "deletion failure", butler: `"delete_when_done": true`,
+			failures: map[string]error{"torrent-remove": context.DeadlineExceeded},
+			actions:  map[string]int{actionFreeSeed: 1, actionDelete: 0}},
+		{name: "free space failure", butler: `"eviction": {"min_free_space": "105 GiB"}`,
+			failures: map[string]error{"free-space": errConnectionRefused},
+			actions:  map[string]int{actionEvict: 0}},
+		{name: "global ratio failure does not stop the batch", butler: `"delete_when_done": true`,
+			failures: map[string]error{"session-set": errConnectionRefused},
+			actions:  map[string]int{actionDelete: 1},
+			removed:  []int64{3}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer useTestState(t)()
+			butler := `"free_seed_days": 2, "target_ratio": 2`
+			if tc.butler != "" {
+				butler += ", " + tc.butler
+			}
+			inst, ft := newTestInstance(t, butler,
+				// free seed
+				testTorrent{id: 1, status: seeding, done: testDay, mode: global, limit: 2, ratio: 0.5}.build(),
+				// global ratio
+				testTorrent{id: 2, status: seeding, done: testMonth, mode: noRatio, limit: 2, ratio: 1.5, size: 10 * cunits.GiB}.build(),
+				// delete (or evict first by ratio)
+				testTorrent{id: 3, status: stopped, done: testMonth, mode: global, limit: 2, ratio: 3}.build(),
+				// evict first by age
+				testTorrent{id: 4, status: seeding, done: 3 * testMonth, mode: global, limit: 2, ratio: 1, size: 10 * cunits.GiB}.build(),
+			)
+			ft.setLabels(3, []string{"keep"})
+			for method, err := range tc.failures {
+				ft.setFailure(method, err)
+			}
+			result := inst.batch(context.Background(), tc.dryRun)
+			if result.Success != (tc.errorClass == "") || result.ErrorClass != tc.errorClass {
+				t.Fatalf("batch success: %v (class '%s', error: %s), expected success: %v (class '%s')",
+					result.Success, result.ErrorClass, result.Error, tc.errorClass == "", tc.errorClass)
+			}
+			for action, expected := range tc.actions {
+				if result.Actions[action] != expected {
+					t.Errorf("%d '%s' action(s), expected %d", result.Actions[action], action, expected)
+				}
+			}
+			for action, expected := range tc.postponed {
+				if result.Postponed[action] != expected {
+					t.Errorf("%d '%s' action(s) postponed, expected %d", result.Postponed[action], action, expected)
+				}
+			}
+			// Torrents
+			removed := make(map[int64]bool, len(tc.removed))
+			for _, id := range tc.removed {
+				removed[id] = true
+			}
+			remaining := make(map[int64]*transmissionrpc.Torrent)
+			for _, torrent := range ft.getTorrents() {
+				remaining[*torrent.ID] = torrent
+			}
+			for id := int64(1); id <= 4; id++ {
+				if _, found := remaining[id]; found == removed[id] {
+					t.Errorf("torrent %d is still there: %v, expected %v", id, found, !removed[id])
+				}
+			}
+			for id, mode := range tc.modes {
+				if torrent, found := remaining[id]; found && *torrent.SeedRatioMode != mode {
+					t.Errorf("torrent %d seed ratio mode is %s, expected %s", id, torrent.SeedRatioMode, mode)
+				}
+			}
+			if tc.freeSpace != 0 && ft.getFreeSpace() != tc.freeSpace {
+				t.Errorf("free space is %s, expected %s", ft.getFreeSpace(), tc.freeSpace)
+			}
+			// a dry run only reads
+			if tc.dryRun {
+				if history := state.history(inst.name); len(history.Torrents) > 0 || len(history.Activity) > 0 || len(history.Deletions) > 0 {
+					t.Errorf("the state was changed by a dry run")
+				}
+				for _, method := range ft.getCalls() {
+					if method != "session-get" && method != "torrent-get" && method != "free-space" {
+						t.Errorf("'%s' was called by a dry run", method)
+					}
+				}
+			}
+		})
+	}
+}
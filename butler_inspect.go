@@ -1,154 +1,472 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
 	"time"
 
+	"github.com/hekmon/cunits/v2"
 	"github.com/hekmon/transmissionrpc"
 )
 
-func inspectTorrents(torrents []*transmissionrpc.Torrent) (
-	freeseedCandidates, globalratioCandidates, customratioCandidates, todeleteCandidates []*transmissionrpc.Torrent) {
-	// Only 1 run at a time !
-	defer butlerRun.Unlock()
-	logger.Debugf("[Butler] Waiting for butlerRun lock")
-	butlerRun.Lock()
-	// Prepare
-	freeseedCandidates = make([]*transmissionrpc.Torrent, 0, len(torrents))
-	globalratioCandidates = make([]*transmissionrpc.Torrent, 0, len(torrents))
-	customratioCandidates = make([]*transmissionrpc.Torrent, 0, len(torrents))
-	todeleteCandidates = make([]*transmissionrpc.Torrent, 0, len(torrents))
-	now := time.Now()
+// torrentDecision is the outcome of a torrent inspection
+type torrentDecision struct {
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+}
+
+// inspectTorrents returns the torrents to handle by action, it stops early once ctx is done
+func (inst *instance) inspectTorrents(ctx context.Context, torrents []*transmissionrpc.Torrent, protected map[int64]string) (
+	candidates map[string][]*transmissionrpc.Torrent, protectedCandidates []protectedTorrent) {
+	candidates = make(map[string][]*transmissionrpc.Torrent)
+	now := inst.clock()
 	// Start inspection
 	for index, torrent := range torrents {
+		if ctx.Err() != nil {
+			return
+		}
 		// Checks
-		if !torrentOK(torrent, index) {
+		if !inst.torrentOK(torrent, index) {
 			continue
 		}
 		// We can now safely access metadata
-		if logger.IsDebugShown() {
-			logger.Debugf("[Butler] Inspecting torrent %d:\n\tid:\t\t%d\n\tname:\t\t%s\n\tsize:\t\t%s\n\tstatus:\t\t%s\n\tdoneDate:\t%v\n\tseedRatioLimit:\t%f\n\tseedRatioMode:\t%s\n\tuploadRatio:\t%f",
-				index, *torrent.ID, *torrent.Name, *torrent.Status, *torrent.TotalSize, *torrent.DoneDate, *torrent.SeedRatioLimit, *torrent.SeedRatioMode, *torrent.UploadRatio)
-		}
-		// For seeding torrents
-		if *torrent.Status == transmissionrpc.TorrentStatusSeed || *torrent.Status == transmissionrpc.TorrentStatusSeedWait {
-			// Is this a custom torrent, should we leave it alone ?
-			if *torrent.SeedRatioMode == transmissionrpc.SeedRatioModeCustom {
-				if logger.IsDebugShown() {
-					logger.Debugf("[Butler] Seeding torrent id %d (%s) has a custom ratio enabled: skipping", *torrent.ID, *torrent.Name)
-				}
-				continue
+		policy := inst.getTorrentPolicy(torrent)
+		if inst.log.IsDebugShown() {
+			inst.log.Debugf("Inspecting torrent %d:\n\tid:\t\t%d\n\tname:\t\t%s\n\tsize:\t\t%s\n\tstatus:\t\t%s\n\tdoneDate:\t%v\n\tseedRatioLimit:\t%f\n\tseedRatioMode:\t%s\n\tuploadRatio:\t%f\n\tpolicy:\t\t%s",
+				index, *torrent.ID, *torrent.Name, *torrent.Status, *torrent.TotalSize, *torrent.DoneDate, *torrent.SeedRatioLimit, *torrent.SeedRatioMode, *torrent.UploadRatio, policy)
+		}
+		decision := inst.inspectTorrent(torrent, policy, now)
+		if reason, isProtected := protected[*torrent.ID]; isProtected {
+			if decision.Action != actionNone {
+				protectedCandidates = append(protectedCandidates, protectedTorrent{
+					torrent: torrent,
+					action:  decision.Action,
+					reason:  reason,
+				})
+				inst.log.Infof("Torrent id %d (%s) %s", *torrent.ID, *torrent.Name, protectDecision(decision, reason).Reason)
+			} else if inst.log.IsDebugShown() {
+				inst.log.Debugf("Torrent id %d (%s) %s", *torrent.ID, *torrent.Name, protectDecision(decision, reason).Reason)
 			}
-			// Else process it
-			inspectSeedingTorrent(torrent, now, &freeseedCandidates, &globalratioCandidates, &customratioCandidates)
+			continue
 		}
-		// For stopped/finished torrents
-		if conf.Butler.DeleteDone && *torrent.Status == transmissionrpc.TorrentStatusStopped {
-			inspectStoppedTorrent(torrent, &todeleteCandidates)
+		if decision.Action == actionNone {
+			if inst.log.IsDebugShown() {
+				inst.log.Debugf("Torrent id %d (%s) %s", *torrent.ID, *torrent.Name, decision.Reason)
+			}
+			continue
 		}
+		candidates[decision.Action] = append(candidates[decision.Action], torrent)
+		inst.log.Infof("Torrent id %d (%s) %s: adding it to the %s list", *torrent.ID, *torrent.Name, decision.Reason, decision.Action)
 	}
 	return
 }
 
-func torrentOK(torrent *transmissionrpc.Torrent, index int) (ok bool) {
+// inspectTorrent decides what should be done with a single (checked) torrent
+func (inst *instance) inspectTorrent(torrent *transmissionrpc.Torrent, policy *torrentPolicy, now time.Time) torrentDecision {
+	if policy.Action != nil {
+		if decision, decided := inst.inspectRuleAction(torrent, policy, now); decided {
+			return decision
+		}
+	}
+	switch *torrent.Status {
+	case transmissionrpc.TorrentStatusSeed, transmissionrpc.TorrentStatusSeedWait:
+		// Is this a custom torrent, should we leave it alone ?
+		if *torrent.SeedRatioMode == transmissionrpc.SeedRatioModeCustom {
+			if last, found := state.getLastSwitch(inst.name, torrent); found && last.Action == actionPolicyRatio {
+				// its custom ratio is the one of its policy: keep it in sync with the configuration
+				return inst.inspectPolicyRatioTorrent(torrent, policy, now)
+			}
+			return torrentDecision{
+				Action: actionNone,
+				Reason: "is seeding with a custom ratio enabled: skipping",
+			}
+		}
+		// Else process it
+		return inst.inspectSeedingTorrent(torrent, policy, now)
+	case transmissionrpc.TorrentStatusStopped:
+		if !inst.butler.DeleteDone {
+			return torrentDecision{
+				Action: actionNone,
+				Reason: "is stopped but deletion of finished torrents is disabled: skipping",
+			}
+		}
+		return inst.inspectStoppedTorrent(torrent, policy)
+	default:
+		return torrentDecision{
+			Action: actionNone,
+			Reason: fmt.Sprintf("is neither seeding nor stopped (%s): skipping", *torrent.Status),
+		}
+	}
+}
+
+// inspectRuleAction returns the decision of the policy rule action, decided is false when
+// the torrent must go through the default decision tree
+func (inst *instance) inspectRuleAction(torrent *transmissionrpc.Torrent, policy *torrentPolicy, now time.Time) (decision torrentDecision, decided bool) {
+	seeding := *torrent.Status == transmissionrpc.TorrentStatusSeed || *torrent.Status == transmissionrpc.TorrentStatusSeedWait
+	stopped := *torrent.Status == transmissionrpc.TorrentStatusStopped
+	// only the finished torrents over their free seed period are deleted, stopped or moved, unless forced
+	finished := (seeding || stopped) && torrent.DoneDate.Unix() > 0 && !torrent.DoneDate.Add(policy.FreeSeed).After(now)
+	switch policy.Action.name {
+	case ruleActionFreeSeed, ruleActionGlobalRatio, ruleActionCustomRatio:
+		if !seeding {
+			return
+		}
+		decided = true
+		switch {
+		case policy.Action.name == ruleActionFreeSeed && *torrent.SeedRatioMode != transmissionrpc.SeedRatioModeNoRatio:
+			decision.Action = actionFreeSeed
+		case policy.Action.name == ruleActionGlobalRatio && *torrent.SeedRatioMode != transmissionrpc.SeedRatioModeGlobal:
+			decision.Action = actionGlobalRatio
+		case policy.Action.name == ruleActionCustomRatio && (*torrent.SeedRatioMode != transmissionrpc.SeedRatioModeCustom ||
+			*torrent.SeedRatioLimit != policy.Action.ratio):
+			decision.Action = actionPolicyRatio
+		default:
+			decision.Action = actionNone
+			decision.Reason = fmt.Sprintf("is correctly set by its policy %s action", policy)
+			return
+		}
+		decision.Reason = fmt.Sprintf("matches its policy %s", policy)
+	case ruleActionDelete:
+		if !inst.butler.DeleteDone || !finished && !policy.Action.force {
+			return
+		}
+		decided = true
+		decision.Action = actionDelete
+		decision.Reason = fmt.Sprintf("matches its policy %s", policy)
+	case ruleActionStop, ruleActionPause:
+		switch {
+		case stopped && policy.Action.name == ruleActionPause:
+			decided = true
+			decision.Action = actionNone
+			decision.Reason = fmt.Sprintf("is paused by its policy %s: skipping", policy)
+		case stopped, !finished && !policy.Action.force:
+			// already stopped or not finished yet: default decision tree
+		case policy.Action.name == ruleActionStop && state.wasStopped(inst.name, torrent):
+			// restarted by the user: handled as any other torrent
+		default:
+			decided = true
+			decision.Action = actionStop
+			decision.Reason = fmt.Sprintf("matches its policy %s", policy)
+		}
+	case ruleActionMove:
+		if (finished || policy.Action.force) && torrent.DownloadDir != nil && filepath.Clean(*torrent.DownloadDir) != policy.Action.dir {
+			decided = true
+			decision.Action = actionMove
+			decision.Reason = fmt.Sprintf("matches its policy %s", policy)
+		}
+	}
+	return
+}
+
+func (inst *instance) torrentOK(torrent *transmissionrpc.Torrent, index int) (ok bool) {
 	if torrent == nil {
-		logger.Warningf("[Butler] Encountered a nil torrent at index %d", index)
+		inst.log.Warningf("Encountered a nil torrent at index %d", index)
 		return
 	}
 	if torrent.ID == nil {
-		logger.Warningf("[Butler] Encountered a nil torrent id at index %d", index)
+		inst.log.Warningf("Encountered a nil torrent id at index %d", index)
 		return
 	}
 	if torrent.Name == nil {
-		logger.Warningf("[Butler] Encountered a nil torrent name at index %d", index)
+		inst.log.Warningf("Encountered a nil torrent name at index %d", index)
 		return
 	}
 	if torrent.Status == nil {
-		logger.Warningf("[Butler] Encountered a nil torrent status at index %d", index)
+		inst.log.Warningf("Encountered a nil torrent status at index %d", index)
 		return
 	}
 	if torrent.DoneDate == nil {
-		logger.Warningf("[Butler] Encountered a nil torrent doneDate at index %d", index)
+		inst.log.Warningf("Encountered a nil torrent doneDate at index %d", index)
 		return
 	}
 	if torrent.SeedRatioLimit == nil {
-		logger.Warningf("[Butler] Encountered a nil torrent seedRatioLimit at index %d", index)
+		inst.log.Warningf("Encountered a nil torrent seedRatioLimit at index %d", index)
 		return
 	}
 	if torrent.SeedRatioMode == nil {
-		logger.Warningf("[Butler] Encountered a nil torrent seedRatioMode at index %d", index)
+		inst.log.Warningf("Encountered a nil torrent seedRatioMode at index %d", index)
 		return
 	}
 	if torrent.UploadRatio == nil {
-		logger.Warningf("[Butler] Encountered a nil torrent ID at index %d", index)
+		inst.log.Warningf("Encountered a nil torrent ID at index %d", index)
 		return
 	}
 	return true
 }
 
-func inspectSeedingTorrent(torrent *transmissionrpc.Torrent, now time.Time, freeseedCandidates, globalratioCandidates, customratioCandidates *[]*transmissionrpc.Torrent) {
+func (inst *instance) inspectSeedingTorrent(torrent *transmissionrpc.Torrent, policy *torrentPolicy, now time.Time) torrentDecision {
+	freeSeedEnd := torrent.DoneDate.Add(policy.FreeSeed)
 	// Does this torrent is under/over the free seed time range ?
-	if torrent.DoneDate.Add(conf.Butler.FreeSeed).Before(now) {
+	if freeSeedEnd.Before(now) {
 		// Torrent is over the unlimited seed time range
-		if conf.Butler.RestoreCustom && *torrent.SeedRatioLimit != conf.Butler.TargetRatio {
+		if decision, idle := inst.inspectIdleTorrent(torrent, policy, freeSeedEnd, now); idle {
+			return decision
+		}
+		if originalRatio, saved := inst.getOriginalCustomRatio(torrent, policy); saved {
+			// the custom ratio set by the user before the butler first switched it wins over its policy one
+			return torrentDecision{
+				Action: actionCustomRatio,
+				Reason: fmt.Sprintf("is now over its unlimited seed period (ended %v) and has a saved custom ratio (%.02f) to restore",
+					freeSeedEnd, originalRatio),
+			}
+		}
+		if !policy.isGlobal(inst.butler.TargetRatio) {
+			// Its policy target ratio differs from the global one: it must be set as a custom ratio
+			return torrentDecision{
+				Action: actionPolicyRatio,
+				Reason: fmt.Sprintf("is now over its unlimited seed period (ended %v) and its policy %s target ratio differs from the global one",
+					freeSeedEnd, policy),
+			}
+		}
+		if customRatio, saved := inst.getSavedCustomRatio(torrent, policy); inst.butler.RestoreCustom && saved {
 			// This torrent had a custom ratio saved, let's check if this torrent does not need to be restored as custom ratio
 			if *torrent.SeedRatioMode != transmissionrpc.SeedRatioModeCustom {
-				logger.Infof("[Butler] Seeding torrent id %d (%s) is now over its unlimited seed period: adding it to the restore custom ratio list",
-					*torrent.ID, *torrent.Name)
-				*customratioCandidates = append(*customratioCandidates, torrent)
-			} else if logger.IsDebugShown() {
-				logger.Debugf("[Butler] Seeding torrent id %d (%s) is correctly set to use the custom ratio mode (free seed ending date: %v, RestoreCustom: %v, TorrentRatio: %v, GlobalRatio: %v)",
-					*torrent.ID, *torrent.Name, torrent.DoneDate.Add(conf.Butler.FreeSeed), conf.Butler.RestoreCustom, *torrent.SeedRatioLimit, conf.Butler.TargetRatio)
+				return torrentDecision{
+					Action: actionCustomRatio,
+					Reason: fmt.Sprintf("is now over its unlimited seed period (ended %v) and has a saved custom ratio (%.02f) to restore",
+						freeSeedEnd, customRatio),
+				}
+			}
+			return torrentDecision{
+				Action: actionNone,
+				Reason: fmt.Sprintf("is correctly set to use the custom ratio mode (free seed ending date: %v, RestoreCustom: %v, TorrentRatio: %v, GlobalRatio: %v)",
+					freeSeedEnd, inst.butler.RestoreCustom, customRatio, policy.TargetRatio),
 			}
-		} else {
-			// Let's check if this torrent is in global ratio mode as it should be
-			if *torrent.SeedRatioMode != transmissionrpc.SeedRatioModeGlobal {
-				logger.Infof("[Butler] Seeding torrent id %d (%s) is now over its unlimited seed period: adding it to the global ratio list",
-					*torrent.ID, *torrent.Name)
-				*globalratioCandidates = append(*globalratioCandidates, torrent)
-			} else if logger.IsDebugShown() {
-				logger.Debugf("[Butler] Seeding torrent id %d (%s) is correctly set to use the global ratio mode (free seed ending date: %v, RestoreCustom: %v, TorrentRatio: %v, GlobalRatio: %v)",
-					*torrent.ID, *torrent.Name, torrent.DoneDate.Add(conf.Butler.FreeSeed), conf.Butler.RestoreCustom, *torrent.SeedRatioLimit, conf.Butler.TargetRatio)
+		}
+		// Let's check if this torrent is in global ratio mode as it should be
+		if *torrent.SeedRatioMode != transmissionrpc.SeedRatioModeGlobal {
+			return torrentDecision{
+				Action: actionGlobalRatio,
+				Reason: fmt.Sprintf("is now over its unlimited seed period (ended %v)", freeSeedEnd),
 			}
 		}
-	} else {
-		// Torrent is still within the unlimited seed time range
-		if *torrent.SeedRatioMode != transmissionrpc.SeedRatioModeNoRatio {
-			logger.Infof("[Butler] Seeding torrent id %d (%s) is still young: adding it to the free seed ratio list",
-				*torrent.ID, *torrent.Name)
-			*freeseedCandidates = append(*freeseedCandidates, torrent)
-		} else if logger.IsDebugShown() {
-			logger.Debugf("[Butler] Seeding torrent id %d (%s) is correctly set to use the free seed mode (free seed ending date: %v)",
-				*torrent.ID, *torrent.Name, torrent.DoneDate.Add(conf.Butler.FreeSeed))
+		return torrentDecision{
+			Action: actionNone,
+			Reason: fmt.Sprintf("is correctly set to use the global ratio mode (free seed ending date: %v, RestoreCustom: %v, TorrentRatio: %v, GlobalRatio: %v)",
+				freeSeedEnd, inst.butler.RestoreCustom, *torrent.SeedRatioLimit, policy.TargetRatio),
 		}
 	}
+	// Torrent is still within the unlimited seed time range
+	if *torrent.SeedRatioMode != transmissionrpc.SeedRatioModeNoRatio {
+		return torrentDecision{
+			Action: actionFreeSeed,
+			Reason: fmt.Sprintf("is still young (free seed ending date: %v)", freeSeedEnd),
+		}
+	}
+	return torrentDecision{
+		Action: actionNone,
+		Reason: fmt.Sprintf("is correctly set to use the free seed mode (free seed ending date: %v)", freeSeedEnd),
+	}
 }
 
-func inspectStoppedTorrent(torrent *transmissionrpc.Torrent, todeleteCandidates *[]*transmissionrpc.Torrent) {
-	var targetRatio float64
-	// Should we handle this stopped torrent ?
-	if *torrent.SeedRatioMode == transmissionrpc.SeedRatioModeCustom {
-		targetRatio = *torrent.SeedRatioLimit
-	} else if *torrent.SeedRatioMode == transmissionrpc.SeedRatioModeGlobal {
-		targetRatio = conf.Butler.TargetRatio
-	} else {
-		if *torrent.SeedRatioMode == transmissionrpc.SeedRatioModeNoRatio {
-			if logger.IsDebugShown() {
-				logger.Debugf("[Butler] Torrent id %d (%s) is finished (ratio %f) but it does not have a ratio target (custom or global): skipping",
-					*torrent.ID, *torrent.Name, *torrent.UploadRatio)
+// inspectPolicyRatioTorrent checks a torrent the butler switched to its policy ratio against the current policy target ratio
+func (inst *instance) inspectPolicyRatioTorrent(torrent *transmissionrpc.Torrent, policy *torrentPolicy, now time.Time) torrentDecision {
+	if policy.isGlobal(inst.butler.TargetRatio) {
+		if customRatio, saved := inst.getSavedCustomRatio(torrent, policy); inst.butler.RestoreCustom && saved &&
+			*torrent.SeedRatioLimit != customRatio {
+			return torrentDecision{
+				Action: actionCustomRatio,
+				Reason: fmt.Sprintf("has a policy ratio (%.02f) but its policy %s target ratio is the global one again and it has a saved custom ratio (%.02f) to restore",
+					*torrent.SeedRatioLimit, policy, customRatio),
 			}
-		} else {
-			logger.Warningf("[Butler] Torrent id %d (%s) is finished but has an unknown seed ratio mode (%d): skipping",
-				*torrent.ID, *torrent.Name, *torrent.SeedRatioMode)
 		}
+		// its policy target ratio is now the global one: handle it as any other seeding torrent
+		return inst.inspectSeedingTorrent(torrent, policy, now)
+	}
+	if originalRatio, saved := inst.getOriginalCustomRatio(torrent, policy); saved {
+		return torrentDecision{
+			Action: actionCustomRatio,
+			Reason: fmt.Sprintf("has a policy ratio (%.02f) but it has a saved custom ratio (%.02f) to restore", *torrent.SeedRatioLimit, originalRatio),
+		}
+	}
+	if *torrent.SeedRatioLimit != policy.TargetRatio {
+		return torrentDecision{
+			Action: actionPolicyRatio,
+			Reason: fmt.Sprintf("has a policy ratio (%.02f) which differs from its policy %s current target ratio (%.02f)",
+				*torrent.SeedRatioLimit, policy, policy.TargetRatio),
+		}
+	}
+	return torrentDecision{
+		Action: actionNone,
+		Reason: fmt.Sprintf("is correctly set to its policy %s ratio (%.02f)", policy, policy.TargetRatio),
+	}
+}
+
+// inspectIdleTorrent checks if a torrent over its free seed period has not uploaded anything for too long
+func (inst *instance) inspectIdleTorrent(torrent *transmissionrpc.Torrent, policy *torrentPolicy, freeSeedEnd, now time.Time) (decision torrentDecision, idle bool) {
+	if policy.IdleTime <= 0 || (policy.Keep && inst.butler.IdleAction == idleActionDelete) {
+		return
+	}
+	lastUpload, source := inst.getTorrentLastUpload(torrent)
+	// the idle period starts at the end of the free seed period at the earliest
+	idleSince := lastUpload
+	if idleSince.Before(freeSeedEnd) {
+		idleSince = freeSeedEnd
+	}
+	if now.Sub(idleSince) < policy.IdleTime {
 		return
 	}
+	return torrentDecision{
+		Action: actionIdle,
+		Reason: fmt.Sprintf("has not uploaded anything since %v (from %s) and is idle for more than %v after its free seed period (policy %s)",
+			lastUpload, source, policy.IdleTime, policy.Name),
+	}, true
+}
+
+// getTorrentLastUpload returns when a torrent uploaded for the last time: from the state store when it tracks the torrent,
+// else its last activity
+func (inst *instance) getTorrentLastUpload(torrent *transmissionrpc.Torrent) (lastUpload time.Time, source string) {
+	if lastUpload, found := state.getLastUpload(inst.name, torrent); found {
+		return lastUpload, "state"
+	}
+	if torrent.ActivityDate != nil && torrent.ActivityDate.Unix() > 0 {
+		return *torrent.ActivityDate, "activity date"
+	}
+	return *torrent.DoneDate, "done date"
+}
+
+// getSavedCustomRatio returns the custom ratio of a torrent before the butler changed its seed ratio mode: from the state
+// store when it knows the torrent, else guessed from its current seed ratio limit
+func (inst *instance) getSavedCustomRatio(torrent *transmissionrpc.Torrent, policy *torrentPolicy) (ratio float64, saved bool) {
+	if mode, original, found := state.getOriginalRatio(inst.name, torrent); found {
+		return original, mode == transmissionrpc.SeedRatioModeCustom.String() && original != policy.TargetRatio
+	}
+	return *torrent.SeedRatioLimit, *torrent.SeedRatioLimit != policy.TargetRatio
+}
+
+// getOriginalCustomRatio returns the custom ratio a torrent had before the butler first changed it, if it must be
+// restored: only the state store knows it
+func (inst *instance) getOriginalCustomRatio(torrent *transmissionrpc.Torrent, policy *torrentPolicy) (ratio float64, saved bool) {
+	if !inst.butler.RestoreCustom {
+		return
+	}
+	mode, ratio, found := state.getOriginalRatio(inst.name, torrent)
+	saved = found && mode == transmissionrpc.SeedRatioModeCustom.String() && ratio != policy.TargetRatio
+	return
+}
+
+func (inst *instance) inspectStoppedTorrent(torrent *transmissionrpc.Torrent, policy *torrentPolicy) torrentDecision {
+	if policy.Keep {
+		return torrentDecision{
+			Action: actionNone,
+			Reason: fmt.Sprintf("is finished but its policy %s keeps it forever: skipping", policy.Name),
+		}
+	}
+	// Should we handle this stopped torrent ?
+	targetRatio, source := getTorrentTargetRatioSource(torrent, policy)
+	switch *torrent.SeedRatioMode {
+	case transmissionrpc.SeedRatioModeCustom, transmissionrpc.SeedRatioModeGlobal:
+	case transmissionrpc.SeedRatioModeNoRatio:
+		return torrentDecision{
+			Action: actionNone,
+			Reason: fmt.Sprintf("is finished (ratio %f) but it does not have a ratio target (custom or global): skipping", *torrent.UploadRatio),
+		}
+	default:
+		inst.log.Warningf("Torrent id %d (%s) is finished but has an unknown seed ratio mode (%d): skipping",
+			*torrent.ID, *torrent.Name, *torrent.SeedRatioMode)
+		return torrentDecision{
+			Action: actionNone,
+			Reason: fmt.Sprintf("is finished but has an unknown seed ratio mode (%d): skipping", *torrent.SeedRatioMode),
+		}
+	}
 	// We should handle it but does it have seeded enought ?
-	if *torrent.UploadRatio >= targetRatio {
-		logger.Infof("[Butler] Torrent id %d (%s) is finished (ratio %f/%f): adding it to deletion list",
-			*torrent.ID, *torrent.Name, *torrent.UploadRatio, targetRatio)
-		*todeleteCandidates = append(*todeleteCandidates, torrent)
-	} else if logger.IsDebugShown() {
-		logger.Debugf("[Butler] Torrent id %d (%s) is finished but it does not have reached its target ratio yet: %f/%f",
-			*torrent.ID, *torrent.Name, *torrent.UploadRatio, targetRatio)
+	var secondsSeeding time.Duration
+	if torrent.SecondsSeeding != nil {
+		secondsSeeding = *torrent.SecondsSeeding
+	}
+	if policy.isSeedDone(*torrent.UploadRatio, targetRatio, torrent.SecondsSeeding) {
+		return torrentDecision{
+			Action: actionDelete,
+			Reason: fmt.Sprintf("is finished (ratio %f/%f from %s, seed time %v/%v, requirement: %s)",
+				*torrent.UploadRatio, targetRatio, source, secondsSeeding, policy.MinSeedTime, policy.SeedRequirement),
+		}
+	}
+	return torrentDecision{
+		Action: actionNone,
+		Reason: fmt.Sprintf("is finished but it does not have reached its seed requirements yet: ratio %f/%f from %s, seed time %v/%v (requirement: %s)",
+			*torrent.UploadRatio, targetRatio, source, secondsSeeding, policy.MinSeedTime, policy.SeedRequirement),
+	}
+}
+
+func (inst *instance) inspectEvictionCandidates(torrents, todeleteCandidates []*transmissionrpc.Torrent, protected map[int64]string,
+	toFree cunits.Bits, now time.Time) (evictionCandidates []*transmissionrpc.Torrent, evictedSize cunits.Bits) {
+	// Exclude torrents already scheduled for deletion
+	excluded := make(map[int64]bool, len(todeleteCandidates))
+	for _, torrent := range todeleteCandidates {
+		excluded[*torrent.ID] = true
+	}
+	// Select finished torrents out of their free seed period
+	pool := make([]*transmissionrpc.Torrent, 0, len(torrents))
+	for _, torrent := range torrents {
+		if torrent == nil || torrent.ID == nil || torrent.Name == nil || torrent.Status == nil || torrent.DoneDate == nil ||
+			torrent.TotalSize == nil || torrent.UploadRatio == nil || excluded[*torrent.ID] {
+			continue
+		}
+		if *torrent.Status != transmissionrpc.TorrentStatusSeed && *torrent.Status != transmissionrpc.TorrentStatusSeedWait &&
+			*torrent.Status != transmissionrpc.TorrentStatusStopped {
+			continue
+		}
+		if torrent.DoneDate.Unix() <= 0 {
+			// not finished (paused download)
+			continue
+		}
+		if reason, isProtected := protected[*torrent.ID]; isProtected {
+			if inst.log.IsDebugShown() {
+				inst.log.Debugf("Torrent id %d (%s) can't be evicted: it is protected (%s)", *torrent.ID, *torrent.Name, reason)
+			}
+			continue
+		}
+		policy := inst.getTorrentPolicy(torrent)
+		if policy.Keep {
+			if inst.log.IsDebugShown() {
+				inst.log.Debugf("Torrent id %d (%s) can't be evicted: its policy %s keeps it forever", *torrent.ID, *torrent.Name, policy.Name)
+			}
+			continue
+		}
+		if freeSeedEnd := torrent.DoneDate.Add(policy.FreeSeed); freeSeedEnd.After(now) {
+			if inst.log.IsDebugShown() {
+				inst.log.Debugf("Torrent id %d (%s) can't be evicted: it is still within its free seed period (until %v)",
+					*torrent.ID, *torrent.Name, freeSeedEnd)
+			}
+			continue
+		}
+		pool = append(pool, torrent)
+	}
+	// Order them
+	sort.SliceStable(pool, func(i, j int) bool {
+		switch inst.butler.Eviction.Order {
+		case evictionOrderHighestRatio:
+			return *pool[i].UploadRatio > *pool[j].UploadRatio
+		case evictionOrderLargest:
+			return *pool[i].TotalSize > *pool[j].TotalSize
+		case evictionOrderSlowest:
+			return getTorrentUploadRate(pool[i]) < getTorrentUploadRate(pool[j])
+		default:
+			return pool[i].DoneDate.Before(*pool[j].DoneDate)
+		}
+	})
+	// Pick until we have enough
+	evictionCandidates = make([]*transmissionrpc.Torrent, 0, len(pool))
+	for _, torrent := range pool {
+		if evictedSize >= toFree {
+			break
+		}
+		inst.log.Infof("Torrent id %d (%s) of %s is selected for eviction (order: %s)",
+			*torrent.ID, *torrent.Name, *torrent.TotalSize, inst.butler.Eviction.Order)
+		evictionCandidates = append(evictionCandidates, torrent)
+		evictedSize += *torrent.TotalSize
+	}
+	if evictedSize < toFree {
+		inst.log.Warningf("Not enough torrents can be evicted: only %s out of the %s needed will be freed", evictedSize, toFree)
+	}
+	return
+}
+
+func getTorrentUploadRate(torrent *transmissionrpc.Torrent) int64 {
+	if torrent.RateUpload == nil {
+		return 0
 	}
+	return *torrent.RateUpload
 }
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hekmon/cunits/v2"
+	"github.com/hekmon/transmissionrpc"
+)
+
+const (
+	testDay   = 24 * time.Hour
+	testMonth = 30 * testDay
+)
+
+var (
+	seeding  = transmissionrpc.TorrentStatusSeed
+	stopped  = transmissionrpc.TorrentStatusStopped
+	download = transmissionrpc.TorrentStatusDownload
+	global   = transmissionrpc.SeedRatioModeGlobal
+	custom   = transmissionrpc.SeedRatioModeCustom
+	noRatio  = transmissionrpc.SeedRatioModeNoRatio
+)
+
+func TestInspectTorrent(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		butler      string // added to the base butler values: 2 days of free seed and a target ratio of 2
+		labels      []string
+		ruleStopped bool // already stopped by a stop rule action (then restarted)
+		torrent     testTorrent
+		action      string
+	}{
+		// Ratio switches
+		{name: "young seeding torrent gets free seed",
+			torrent: testTorrent{status: seeding, done: testDay, mode: global, limit: 2},
+			action:  actionFreeSeed},
+		{name: "young free seeding torrent is left alone",
+			torrent: testTorrent{status: seeding, done: testDay, mode: noRatio, limit: 2},
+			action:  actionNone},
+		{name: "free seed over switches to the global ratio",
+			torrent: testTorrent{status: seeding, done: testMonth, mode: noRatio, limit: 2},
+			action:  actionGlobalRatio},
+		{name: "global ratio torrent is left alone",
+			torrent: testTorrent{status: seeding, done: testMonth, mode: global, limit: 2},
+			action:  actionNone},
+		{name: "custom ratio torrent is skipped",
+			torrent: testTorrent{status: seeding, done: testMonth, mode: custom, limit: 5},
+			action:  actionNone},
+		{name: "saved custom ratio is restored", butler: `"restore_custom": true`,
+			torrent: testTorrent{status: seeding, done: testMonth, mode: noRatio, limit: 5},
+			action:  actionCustomRatio},
+		{name: "saved custom ratio is ignored without restore_custom",
+			torrent: testTorrent{status: seeding, done: testMonth, mode: noRatio, limit: 5},
+			action:  actionGlobalRatio},
+		{name: "tracker policy ratio is set as custom", butler: `"policies": {"example.org": {"target_ratio": 1}}`,
+			torrent: testTorrent{status: seeding, done: testMonth, mode: noRatio, limit: 2},
+			action:  actionPolicyRatio},
+		{name: "tracker policy free seed is longer", butler: `"policies": {"example.org": {"free_seed_days": 60}}`,
+			torrent: testTorrent{status: seeding, done: testMonth, mode: global, limit: 2},
+			action:  actionFreeSeed},
+		{name: "other tracker policy does not apply", butler: `"policies": {"other.org": {"target_ratio": 1}}`,
+			torrent: testTorrent{status: seeding, done: testMonth, mode: noRatio, limit: 2},
+			action:  actionGlobalRatio},
+		// delete_when_done
+		{name: "finished torrent is kept without delete_when_done",
+			torrent: testTorrent{status: stopped, done: testMonth, mode: global, limit: 2, ratio: 3},
+			action:  actionNone},
+		{name: "finished torrent is deleted", butler: `"delete_when_done": true`,
+			torrent: testTorrent{status: stopped, done: testMonth, mode: global, limit: 2, ratio: 3},
+			action:  actionDelete},
+		{name: "stopped torrent under its ratio is kept", butler: `"delete_when_done": true`,
+			torrent: testTorrent{status: stopped, done: testMonth, mode: global, limit: 2, ratio: 1},
+			action:  actionNone},
+		{name: "stopped torrent without ratio is kept", butler: `"delete_when_done": true`,
+			torrent: testTorrent{status: stopped, done: testMonth, mode: noRatio, limit: 2, ratio: 3},
+			action:  actionNone},
+		{name: "stopped torrent under its policy ratio", butler: `"delete_when_done": true, "policies": {"example.org": {"target_ratio": 4}}`,
+			torrent: testTorrent{status: stopped, done: testMonth, mode: global, limit: 2, ratio: 3},
+			action:  actionNone},
+		{name: "downloading torrent is left alone", butler: `"delete_when_done": true`,
+			torrent: testTorrent{status: download, mode: global, limit: 2},
+			action:  actionNone},
+		// min_seed_hours
+		{name: "both: ratio reached but not the seed time", butler: `"delete_when_done": true, "min_seed_hours": 72`,
+			torrent: testTorrent{status: stopped, done: testMonth, mode: global, limit: 2, ratio: 3, seeding: 24 * time.Hour},
+			action:  actionNone},
+		{name: "both: seed time reached but not the ratio", butler: `"delete_when_done": true, "min_seed_hours": 72`,
+			torrent: testTorrent{status: stopped, done: testMonth, mode: global, limit: 2, ratio: 1, seeding: 96 * time.Hour},
+			action:  actionNone},
+		{name: "both: ratio and seed time reached", butler: `"delete_when_done": true, "min_seed_hours": 72, "seed_requirement": "both"`,
+			torrent: testTorrent{status: stopped, done: testMonth, mode: global, limit: 2, ratio: 3, seeding: 96 * time.Hour},
+			action:  actionDelete},
+		{name: "either: seed time reached", butler: `"delete_when_done": true, "min_seed_hours": 72, "seed_requirement": "either"`,
+			torrent: testTorrent{status: stopped, done: testMonth, mode: global, limit: 2, ratio: 1, seeding: 96 * time.Hour},
+			action:  actionDelete},
+		{name: "either: ratio reached", butler: `"delete_when_done": true, "min_seed_hours": 72, "seed_requirement": "either"`,
+			torrent: testTorrent{status: stopped, done: testMonth, mode: global, limit: 2, ratio: 3, seeding: 24 * time.Hour},
+			action:  actionDelete},
+		{name: "either: nothing reached", butler: `"delete_when_done": true, "min_seed_hours": 72, "seed_requirement": "either"`,
+			torrent: testTorrent{status: stopped, done: testMonth, mode: global, limit: 2, ratio: 1, seeding: 24 * time.Hour},
+			action:  actionNone},
+		{name: "either from a tracker policy",
+			butler:  `"delete_when_done": true, "min_seed_hours": 72, "policies": {"example.org": {"seed_requirement": "either"}}`,
+			torrent: testTorrent{status: stopped, done: testMonth, mode: global, limit: 2, ratio: 1, seeding: 96 * time.Hour},
+			action:  actionDelete},
+		// Idle torrents
+		{name: "idle torrent is deleted", butler: `"idle_days": 7`,
+			torrent: testTorrent{status: seeding, done: 2 * testMonth, mode: global, limit: 2, active: testMonth},
+			action:  actionIdle},
+		{name: "active torrent is not idle", butler: `"idle_days": 7`,
+			torrent: testTorrent{status: seeding, done: 2 * testMonth, mode: global, limit: 2, active: testDay},
+			action:  actionNone},
+		{name: "idle period starts after the free seed", butler: `"idle_days": 7, "free_seed_days": 60`,
+			torrent: testTorrent{status: seeding, done: 65 * testDay, mode: noRatio, limit: 2, active: testMonth},
+			action:  actionGlobalRatio},
+		// Label rules
+		{name: "label rule keeps the torrent", butler: `"delete_when_done": true, "rules": [{"name": "isos", "labels": ["ISOs"], "keep": true}]`,
+			labels:  []string{"isos"},
+			torrent: testTorrent{status: stopped, done: testMonth, mode: global, limit: 2, ratio: 3},
+			action:  actionNone},
+		{name: "label rule ratio", butler: `"delete_when_done": true, "rules": [{"name": "tv", "labels": ["tv"], "target_ratio": 4}]`,
+			labels:  []string{"tv"},
+			torrent: testTorrent{status: stopped, done: testMonth, mode: global, limit: 2, ratio: 3},
+			action:  actionNone},
+		{name: "label rule before the tracker policy",
+			butler:  `"rules": [{"name": "tv", "labels": ["tv"], "free_seed_days": 0}], "policies": {"example.org": {"free_seed_days": 60}}`,
+			labels:  []string{"tv"},
+			torrent: testTorrent{status: seeding, done: testDay, mode: noRatio, limit: 2},
+			action:  actionGlobalRatio},
+		{name: "label rule not matching", butler: `"rules": [{"name": "tv", "labels": ["tv"], "free_seed_days": 0}]`,
+			labels:  []string{"movies"},
+			torrent: testTorrent{status: seeding, done: testDay, mode: noRatio, limit: 2},
+			action:  actionNone},
+		// Expression rules and actions
+		{name: "expression rule values", butler: `"rules": [{"name": "big", "when": "totalSize > 10GiB", "target_ratio": 1}]`,
+			torrent: testTorrent{status: seeding, done: testMonth, mode: noRatio, limit: 2, size: 20 * cunits.GiB},
+			action:  actionPolicyRatio},
+		{name: "expression rule not matching", butler: `"rules": [{"name": "big", "when": "totalSize > 10GiB", "target_ratio": 1}]`,
+			torrent: testTorrent{status: seeding, done: testMonth, mode: noRatio, limit: 2, size: cunits.GiB},
+			action:  actionGlobalRatio},
+		{name: "delete action on a finished torrent", butler: `"delete_when_done": true, "rules": [{"name": "zip", "when": "name =~ \"\\\\.zip$\"", "action": "delete"}]`,
+			torrent: testTorrent{name: "leftovers.zip", status: seeding, done: testMonth, mode: global, limit: 2},
+			action:  actionDelete},
+		{name: "delete action waits for the end of the download", butler: `"delete_when_done": true, "rules": [{"name": "zip", "when": "name =~ \"\\\\.zip$\"", "action": "delete"}]`,
+			torrent: testTorrent{name: "leftovers.zip", status: download, mode: global, limit: 2},
+			action:  actionNone},
+		{name: "delete action waits for the end of the free seed", butler: `"delete_when_done": true, "rules": [{"name": "zip", "when": "name =~ \"\\\\.zip$\"", "action": "delete"}]`,
+			torrent: testTorrent{name: "leftovers.zip", status: seeding, done: testDay, mode: global, limit: 2},
+			action:  actionFreeSeed},
+		{name: "delete action needs delete_when_done", butler: `"rules": [{"name": "zip", "when": "name =~ \"\\\\.zip$\"", "action": "delete"}]`,
+			torrent: testTorrent{name: "leftovers.zip", status: seeding, done: testMonth, mode: global, limit: 2},
+			action:  actionNone},
+		{name: "forced delete action on a downloading torrent", butler: `"delete_when_done": true, "rules": [{"name": "zip", "when": "name =~ \"\\\\.zip$\"", "action": "delete(force)"}]`,
+			torrent: testTorrent{name: "leftovers.zip", status: download, mode: global, limit: 2},
+			action:  actionDelete},
+		{name: "forced delete action needs delete_when_done", butler: `"rules": [{"name": "zip", "when": "name =~ \"\\\\.zip$\"", "action": "delete(force)"}]`,
+			torrent: testTorrent{name: "leftovers.zip", status: download, mode: global, limit: 2},
+			action:  actionNone},
+		{name: "custom ratio action", butler: `"rules": [{"name": "bar", "when": "tracker == \"example.org\" && ratio >= -1", "action": "custom_ratio(3)"}]`,
+			torrent: testTorrent{status: seeding, done: testDay, mode: noRatio, limit: 2},
+			action:  actionPolicyRatio},
+		{name: "custom ratio action already applied", butler: `"rules": [{"name": "bar", "when": "tracker == \"example.org\"", "action": "custom_ratio(3)"}]`,
+			torrent: testTorrent{status: seeding, done: testDay, mode: custom, limit: 3},
+			action:  actionNone},
+		{name: "free seed action", butler: `"rules": [{"name": "young", "when": "age < 60d", "action": "free_seed"}]`,
+			torrent: testTorrent{status: seeding, done: testMonth, mode: global, limit: 2},
+			action:  actionFreeSeed},
+		{name: "stop action", butler: `"rules": [{"name": "slow", "when": "uploadRate < 1KiB", "action": "stop"}]`,
+			torrent: testTorrent{status: seeding, done: testMonth, mode: global, limit: 2},
+			action:  actionStop},
+		{name: "stop action waits for the end of the download", butler: `"rules": [{"name": "slow", "when": "uploadRate < 1KiB", "action": "stop"}]`,
+			torrent: testTorrent{status: download, mode: global, limit: 2},
+			action:  actionNone},
+		{name: "stop action waits for the end of the free seed", butler: `"rules": [{"name": "slow", "when": "uploadRate < 1KiB", "action": "stop"}]`,
+			torrent: testTorrent{status: seeding, done: testDay, mode: noRatio, limit: 2},
+			action:  actionNone},
+		{name: "forced stop action on a downloading torrent", butler: `"rules": [{"name": "slow", "when": "uploadRate < 1KiB", "action": "stop(force)"}]`,
+			torrent: testTorrent{status: download, mode: global, limit: 2},
+			action:  actionStop},
+		{name: "stop action on a torrent restarted by the user", butler: `"rules": [{"name": "slow", "when": "uploadRate < 1KiB", "action": "stop"}]`,
+			ruleStopped: true,
+			torrent:     testTorrent{status: seeding, done: testMonth, mode: global, limit: 2},
+			action:      actionNone},
+		{name: "pause action on a downloading torrent", butler: `"rules": [{"name": "slow", "when": "uploadRate < 1KiB", "action": "pause"}]`,
+			torrent: testTorrent{status: download, mode: global, limit: 2},
+			action:  actionNone},
+		{name: "stop action on a stopped torrent", butler: `"delete_when_done": true, "rules": [{"name": "slow", "when": "uploadRate < 1KiB", "action": "stop"}]`,
+			torrent: testTorrent{status: stopped, done: testMonth, mode: global, limit: 2, ratio: 3},
+			action:  actionDelete},
+		{name: "pause action on a stopped torrent", butler: `"delete_when_done": true, "rules": [{"name": "slow", "when": "uploadRate < 1KiB", "action": "pause"}]`,
+			torrent: testTorrent{status: stopped, done: testMonth, mode: global, limit: 2, ratio: 3},
+			action:  actionNone},
+		{name: "move action", butler: `"rules": [{"name": "archive", "when": "age > 7d", "action": "move(/archive)"}]`,
+			torrent: testTorrent{status: seeding, done: testMonth, mode: global, limit: 2},
+			action:  actionMove},
+		{name: "move action waits for the end of the download", butler: `"rules": [{"name": "archive", "when": "ratio >= 0", "action": "move(/archive)"}]`,
+			torrent: testTorrent{status: download, mode: global, limit: 2},
+			action:  actionNone},
+		{name: "forced move action on a downloading torrent", butler: `"rules": [{"name": "archive", "when": "ratio >= 0", "action": "move(/archive, force)"}]`,
+			torrent: testTorrent{status: download, mode: global, limit: 2},
+			action:  actionMove},
+		{name: "move action already applied", butler: `"rules": [{"name": "archive", "when": "age > 7d", "action": "move(/archive)"}]`,
+			torrent: testTorrent{status: seeding, done: testMonth, mode: global, limit: 2, dir: "/archive/"},
+			action:  actionNone},
+		{name: "first matching rule wins",
+			butler:  `"rules": [{"name": "tv", "labels": ["tv"], "action": "global_ratio"}, {"name": "all", "when": "ratio >= 0", "action": "move(/archive)"}]`,
+			labels:  []string{"tv"},
+			torrent: testTorrent{status: seeding, done: testDay, mode: noRatio, limit: 2},
+			action:  actionGlobalRatio},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			butler := `"free_seed_days": 2, "target_ratio": 2`
+			if tc.butler != "" {
+				butler += ", " + tc.butler
+			}
+			tc.torrent.id = 1
+			torrent := tc.torrent.build()
+			inst, _ := newTestInstance(t, butler, torrent)
+			inst = inst.withLabels(map[int64][]string{1: tc.labels})
+			if tc.ruleStopped {
+				defer useTestState(t)()
+				state.recordStop(inst.name, torrent)
+			}
+			decision := inst.inspectTorrent(torrent, inst.getTorrentPolicy(torrent), testNow)
+			if decision.Action != tc.action {
+				t.Errorf("action is '%s' (%s), expected '%s'", decision.Action, decision.Reason, tc.action)
+			}
+		})
+	}
+}
+
+func TestInspectPolicyRatioChange(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		policy   string
+		switched bool    // the butler set the current custom ratio for the policy
+		original float64 // custom ratio set by the user before the butler first switched the torrent
+		restore  bool
+		action   string
+	}{
+		{name: "policy ratio unchanged", policy: `{"target_ratio": 1.5}`, switched: true, action: actionNone},
+		{name: "policy ratio changed", policy: `{"target_ratio": 1}`, switched: true, action: actionPolicyRatio},
+		{name: "policy ratio is the global one again", policy: `{"target_ratio": 2}`, switched: true, action: actionGlobalRatio},
+		{name: "policy removed", policy: `{"free_seed_days": 2}`, switched: true, action: actionGlobalRatio},
+		{name: "custom ratio not set by the butler", policy: `{"target_ratio": 1}`, action: actionNone},
+		{name: "original custom ratio restored", policy: `{"target_ratio": 1.5}`, switched: true, original: 3, restore: true,
+			action: actionCustomRatio},
+		{name: "original custom ratio not restored", policy: `{"target_ratio": 1.5}`, switched: true, original: 3, action: actionNone},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer useTestState(t)()
+			torrent := testTorrent{id: 1, status: seeding, done: testMonth, mode: global, limit: 2}.build()
+			inst, _ := newTestInstance(t, fmt.Sprintf(`"free_seed_days": 2, "target_ratio": 2, "restore_custom": %v, "policies": {"example.org": %s}`,
+				tc.restore, tc.policy), torrent)
+			if tc.original != 0 {
+				*torrent.SeedRatioMode = custom
+				*torrent.SeedRatioLimit = tc.original
+				state.recordSwitch(inst.name, torrent, actionFreeSeed, 0)
+				*torrent.SeedRatioMode = noRatio
+			}
+			if tc.switched {
+				state.recordSwitch(inst.name, torrent, actionPolicyRatio, 1.5)
+			}
+			*torrent.SeedRatioMode = custom
+			*torrent.SeedRatioLimit = 1.5
+			decision := inst.inspectTorrent(torrent, inst.getTorrentPolicy(torrent), testNow)
+			if decision.Action != tc.action {
+				t.Errorf("action is '%s' (%s), expected '%s'", decision.Action, decision.Reason, tc.action)
+			}
+		})
+	}
+}
+
+func TestInspectTorrentsProtection(t *testing.T) {
+	torrents := []*transmissionrpc.Torrent{
+		testTorrent{id: 1, status: stopped, done: testMonth, mode: global, limit: 2, ratio: 3}.build(),
+		testTorrent{id: 2, status: stopped, done: testMonth, mode: global, limit: 2, ratio: 3, name: "keep.me"}.build(),
+		testTorrent{id: 3, status: stopped, done: testMonth, mode: global, limit: 2, ratio: 3, dir: "/data/keep/sub"}.build(),
+		testTorrent{id: 4, status: stopped, done: testMonth, mode: global, limit: 2, ratio: 3}.build(),
+		testTorrent{id: 5, status: stopped, done: testMonth, mode: global, limit: 2, ratio: 3}.build(),
+		testTorrent{id: 6, status: seeding, done: testMonth, mode: global, limit: 2}.build(),
+	}
+	inst, _ := newTestInstance(t, `"free_seed_days": 2, "target_ratio": 2, "delete_when_done": true, "protection": {
+		"labels": ["Keep"],
+		"hashes": ["000000000000000000000000000000000000000A"],
+		"name_patterns": ["^keep\\."],
+		"download_dirs": ["/data/keep"]
+	}`, torrents...)
+	*torrents[4].HashString = "000000000000000000000000000000000000000a"
+	inst = inst.withLabels(map[int64][]string{4: {"keep"}, 6: {"keep"}})
+	protected := inst.getProtectedTorrents(torrents)
+	candidates, protectedCandidates := inst.inspectTorrents(context.Background(), torrents, protected)
+	if ids := getTorrentIDs(candidates[actionDelete]); !equalIDs(ids, []int64{1}) {
+		t.Errorf("delete candidates are %v, expected [1]", ids)
+	}
+	// the protected torrent with no action is not reported
+	var ids []int64
+	for _, candidate := range protectedCandidates {
+		ids = append(ids, *candidate.torrent.ID)
+		if candidate.action != actionDelete {
+			t.Errorf("protected torrent %d action is '%s', expected '%s'", *candidate.torrent.ID, candidate.action, actionDelete)
+		}
+	}
+	if !equalIDs(ids, []int64{2, 3, 4, 5}) {
+		t.Errorf("protected candidates are %v, expected [2 3 4 5]", ids)
+	}
+}
+
+func TestInspectEvictionCandidates(t *testing.T) {
+	torrents := []*transmissionrpc.Torrent{
+		// done 3 months ago, ratio 1, 3 GiB, 30 B/s
+		testTorrent{id: 1, status: seeding, done: 3 * testMonth, mode: global, limit: 2, ratio: 1, size: 3 * cunits.GiB, rate: 30}.build(),
+		// done 2 months ago, ratio 3, 1 GiB, 10 B/s
+		testTorrent{id: 2, status: stopped, done: 2 * testMonth, mode: global, limit: 2, ratio: 3, size: cunits.GiB, rate: 10}.build(),
+		// done 1 month ago, ratio 2, 2 GiB, 20 B/s
+		testTorrent{id: 3, status: seeding, done: testMonth, mode: global, limit: 2, ratio: 2, size: 2 * cunits.GiB, rate: 20}.build(),
+		// never evicted: downloading, within its free seed period, protected, already deleted
+		testTorrent{id: 4, status: download, mode: global, limit: 2, size: 10 * cunits.GiB}.build(),
+		testTorrent{id: 5, status: seeding, done: testDay, mode: noRatio, limit: 2, size: 10 * cunits.GiB}.build(),
+		testTorrent{id: 6, status: seeding, done: 4 * testMonth, mode: global, limit: 2, size: 10 * cunits.GiB}.build(),
+		testTorrent{id: 7, status: stopped, done: 4 * testMonth, mode: global, limit: 2, size: 10 * cunits.GiB}.build(),
+	}
+	protected := map[int64]string{6: "label 'keep'"}
+	todelete := []*transmissionrpc.Torrent{torrents[6]}
+	for _, tc := range []struct {
+		order  string
+		toFree cunits.Bits
+		ids    []int64
+	}{
+		{order: evictionOrderOldest, toFree: 4 * cunits.GiB, ids: []int64{1, 2}},
+		{order: evictionOrderHighestRatio, toFree: 2 * cunits.GiB, ids: []int64{2, 3}},
+		{order: evictionOrderLargest, toFree: 4 * cunits.GiB, ids: []int64{1, 3}},
+		{order: evictionOrderSlowest, toFree: cunits.GiB, ids: []int64{2}},
+		{order: evictionOrderOldest, toFree: 100 * cunits.GiB, ids: []int64{1, 2, 3}},
+	} {
+		t.Run(tc.order, func(t *testing.T) {
+			inst, _ := newTestInstance(t, `"free_seed_days": 2, "target_ratio": 2, "eviction": {"min_free_space": "1 TiB", "order": "`+tc.order+`"}`,
+				torrents...)
+			candidates, size := inst.inspectEvictionCandidates(torrents, todelete, protected, tc.toFree, testNow)
+			if ids := getTorrentIDs(candidates); !equalIDs(ids, tc.ids) {
+				t.Errorf("eviction candidates are %v, expected %v", ids, tc.ids)
+			}
+			var expected cunits.Bits
+			for _, torrent := range candidates {
+				expected += *torrent.TotalSize
+			}
+			if size != expected {
+				t.Errorf("evicted size is %s, expected %s", size, expected)
+			}
+		})
+	}
+}
+
+func getTorrentIDs(torrents []*transmissionrpc.Torrent) (ids []int64) {
+	for _, torrent := range torrents {
+		ids = append(ids, *torrent.ID)
+	}
+	return
+}
+
+func equalIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for index := range a {
+		if a[index] != b[index] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hekmon/transmissionrpc"
+)
+
+const defaultPolicyName = "default"
+
+type torrentPolicy struct {
+	Name            string
+	FreeSeed        time.Duration
+	TargetRatio     float64
+	MinSeedTime     time.Duration
+	SeedRequirement string
+	IdleTime        time.Duration
+	Keep            bool
+	Action          *ruleAction
+}
+
+func (tp *torrentPolicy) String() string {
+	var keep string
+	if tp.Keep {
+		keep = ", kept forever"
+	}
+	var idle, action string
+	if tp.IdleTime > 0 {
+		idle = fmt.Sprintf(", idle time: %v", tp.IdleTime)
+	}
+	if tp.Action != nil {
+		action = fmt.Sprintf(", action: %s", tp.Action)
+	}
+	return fmt.Sprintf("%s (free seed: %v, target ratio: %.02f, min seed time: %v, seed requirement: %s%s%s%s)",
+		tp.Name, tp.FreeSeed, tp.TargetRatio, tp.MinSeedTime, tp.SeedRequirement, idle, keep, action)
+}
+
+// apply overrides the policy values with the ones set
+func (tp *torrentPolicy) apply(bp *butlerPolicy) {
+	if bp.FreeSeed != nil {
+		tp.FreeSeed = *bp.FreeSeed
+	}
+	if bp.TargetRatio != nil {
+		tp.TargetRatio = *bp.TargetRatio
+	}
+	if bp.MinSeedTime != nil {
+		tp.MinSeedTime = *bp.MinSeedTime
+	}
+	if bp.SeedRequirement != nil {
+		tp.SeedRequirement = *bp.SeedRequirement
+	}
+	if bp.IdleTime != nil {
+		tp.IdleTime = *bp.IdleTime
+	}
+}
+
+// isGlobal returns true if the policy target ratio is the one set as the session global ratio
+func (tp *torrentPolicy) isGlobal(globalRatio float64) bool {
+	return tp.TargetRatio == globalRatio
+}
+
+// isSeedDone returns true if the torrent has fulfilled its ratio and/or seeding time requirements
+func (tp *torrentPolicy) isSeedDone(uploadRatio, targetRatio float64, secondsSeeding *time.Duration) bool {
+	ratioReached := uploadRatio >= targetRatio
+	if tp.MinSeedTime <= 0 {
+		return ratioReached
+	}
+	seedTimeReached := secondsSeeding != nil && *secondsSeeding >= tp.MinSeedTime
+	if tp.SeedRequirement == seedRequirementEither {
+		return ratioReached || seedTimeReached
+	}
+	return ratioReached && seedTimeReached
+}
+
+func (inst *instance) getDefaultPolicy() *torrentPolicy {
+	return &torrentPolicy{
+		Name:            defaultPolicyName,
+		FreeSeed:        inst.butler.FreeSeed,
+		TargetRatio:     inst.butler.TargetRatio,
+		MinSeedTime:     inst.butler.MinSeedTime,
+		SeedRequirement: inst.butler.SeedRequirement,
+		IdleTime:        inst.butler.IdleTime,
+	}
+}
+
+// getTorrentPolicy returns the policy of the first rule matching the torrent, else the policy matching
+// one of the torrent trackers (by tier order), else the default one
+func (inst *instance) getTorrentPolicy(torrent *transmissionrpc.Torrent) (policy *torrentPolicy) {
+	policy = inst.getDefaultPolicy()
+	if torrent == nil {
+		return
+	}
+	if rule := inst.getTorrentRule(torrent); rule != nil {
+		policy.Name = fmt.Sprintf("rule %s", rule.Name)
+		policy.Keep = rule.Keep
+		policy.Action = rule.action
+		policy.apply(&rule.Policy)
+		return
+	}
+	if len(inst.butler.Policies) == 0 {
+		return
+	}
+	// Inspect trackers by tier
+	trackers := make([]*transmissionrpc.Tracker, 0, len(torrent.Trackers))
+	for _, tracker := range torrent.Trackers {
+		if tracker != nil {
+			trackers = append(trackers, tracker)
+		}
+	}
+	sort.SliceStable(trackers, func(i, j int) bool { return trackers[i].Tier < trackers[j].Tier })
+	for _, tracker := range trackers {
+		host := getTrackerHost(tracker.Announce)
+		if host == "" {
+			continue
+		}
+		// Most specific domain first (tracker.example.org then example.org)
+		for domain := host; domain != ""; domain = getParentDomain(domain) {
+			trackerPolicy, found := inst.butler.Policies[domain]
+			if !found {
+				continue
+			}
+			policy.Name = domain
+			policy.apply(trackerPolicy)
+			return
+		}
+	}
+	return
+}
+
+// getTorrentRule returns the first rule matching one of the torrent labels (if it has labels) and its expression (if it has one)
+func (inst *instance) getTorrentRule(torrent *transmissionrpc.Torrent) *butlerRule {
+	if len(inst.butler.Rules) == 0 {
+		return nil
+	}
+	labels := inst.getTorrentLabels(torrent)
+	now := inst.clock()
+	for _, rule := range inst.butler.Rules {
+		if len(rule.Labels) > 0 && !matchRuleLabels(rule.Labels, labels) {
+			continue
+		}
+		if rule.when != nil && !rule.when.match(torrent, labels, now) {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+func matchRuleLabels(ruleLabels, labels []string) bool {
+	for _, ruleLabel := range ruleLabels {
+		for _, label := range labels {
+			if strings.EqualFold(label, ruleLabel) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getTorrentLabels returns the labels of a torrent fetched for the current batch
+func (inst *instance) getTorrentLabels(torrent *transmissionrpc.Torrent) []string {
+	if torrent.ID == nil {
+		return nil
+	}
+	return inst.labels[*torrent.ID]
+}
+
+func getParentDomain(domain string) string {
+	if index := strings.Index(domain, "."); index != -1 {
+		return domain[index+1:]
+	}
+	return ""
+}
+
+// getTorrentTargetRatioSource returns the effective target ratio of a (checked) torrent and where it comes from
+func getTorrentTargetRatioSource(torrent *transmissionrpc.Torrent, policy *torrentPolicy) (targetRatio float64, source string) {
+	if *torrent.SeedRatioMode == transmissionrpc.SeedRatioModeCustom {
+		return *torrent.SeedRatioLimit, "custom"
+	}
+	if policy.Name != defaultPolicyName {
+		return policy.TargetRatio, fmt.Sprintf("policy %s", policy.Name)
+	}
+	return policy.TargetRatio, "global"
+}
+
+func getTrackerHost(announce string) string {
+	announceURL, err := url.Parse(announce)
+	if err != nil {
+		logger.Debugf("[Butler] Can't parse tracker announce URL '%s': %v", announce, err)
+		return ""
+	}
+	return strings.ToLower(announceURL.Hostname())
+}
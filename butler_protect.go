@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/hekmon/transmissionrpc"
+)
+
+// protectedTorrent is a torrent the butler would have handled without its protection
+type protectedTorrent struct {
+	torrent *transmissionrpc.Torrent
+	action  string
+	reason  string
+}
+
+// fetchLabels returns the labels of the torrents (all of them if ids is empty) when the configuration needs them
+func (inst *instance) fetchLabels(ids []int64) (labels map[int64][]string, err error) {
+	if len(inst.butler.Rules) == 0 && (inst.butler.Protection == nil || len(inst.butler.Protection.Labels) == 0) {
+		return
+	}
+	if labels, err = inst.client.TorrentLabels(ids); err != nil {
+		metrics.rpcError(inst.name, "torrent-get")
+	}
+	return
+}
+
+// getProtectedTorrents returns the protection reason of each protected torrent, by id
+func (inst *instance) getProtectedTorrents(torrents []*transmissionrpc.Torrent) (protected map[int64]string) {
+	protected = make(map[int64]string)
+	if inst.butler.Protection == nil {
+		return
+	}
+	for _, torrent := range torrents {
+		if torrent == nil || torrent.ID == nil {
+			continue
+		}
+		if reason, isProtected := inst.getTorrentProtection(torrent); isProtected {
+			protected[*torrent.ID] = reason
+		}
+	}
+	return
+}
+
+// getTorrentProtection returns why a torrent must not be touched by the butler
+func (inst *instance) getTorrentProtection(torrent *transmissionrpc.Torrent) (reason string, protected bool) {
+	protection := inst.butler.Protection
+	if protection == nil {
+		return
+	}
+	for _, protectedLabel := range protection.Labels {
+		for _, label := range inst.getTorrentLabels(torrent) {
+			if strings.EqualFold(label, protectedLabel) {
+				return fmt.Sprintf("label '%s'", label), true
+			}
+		}
+	}
+	if torrent.HashString != nil {
+		hash := strings.ToLower(*torrent.HashString)
+		for _, protectedHash := range protection.Hashes {
+			if hash == protectedHash {
+				return fmt.Sprintf("hash '%s'", hash), true
+			}
+		}
+	}
+	if torrent.Name != nil {
+		for _, pattern := range protection.namePatterns {
+			if pattern.MatchString(*torrent.Name) {
+				return fmt.Sprintf("name pattern '%s'", pattern), true
+			}
+		}
+	}
+	if torrent.DownloadDir != nil {
+		dir := filepath.Clean(*torrent.DownloadDir)
+		for _, protectedDir := range protection.DownloadDirs {
+			if dir == protectedDir || strings.HasPrefix(dir, protectedDir+string(filepath.Separator)) {
+				return fmt.Sprintf("download dir '%s'", protectedDir), true
+			}
+		}
+	}
+	return
+}
+
+// protectDecision replaces the decision taken for a protected torrent
+func protectDecision(decision torrentDecision, reason string) torrentDecision {
+	if decision.Action == actionNone {
+		return torrentDecision{
+			Action: actionProtected,
+			Reason: fmt.Sprintf("is protected (%s): skipping", reason),
+		}
+	}
+	return torrentDecision{
+		Action: actionProtected,
+		Reason: fmt.Sprintf("is protected (%s): skipping instead of %s (it %s)", reason, decision.Action, decision.Reason),
+	}
+}
+
+func (inst *instance) handleProtectedCandidates(protectedCandidates []protectedTorrent) (handled int) {
+	// Build
+	nameList := make([]string, len(protectedCandidates))
+	keys := make([]string, len(protectedCandidates))
+	for index, candidate := range protectedCandidates {
+		nameList[index] = fmt.Sprintf("%s (%s skipped, protected by %s)", *candidate.torrent.Name,
+			strings.Replace(candidate.action, "_", " ", -1), candidate.reason)
+		keys[index] = fmt.Sprintf("%d:%s", *candidate.torrent.ID, candidate.action)
+	}
+	// Only notify when the list changes: protected torrents would be reported at each batch
+	if !inst.status.setProtected(keys) || len(nameList) == 0 {
+		return len(protectedCandidates)
+	}
+	var suffix string
+	if len(nameList) > 1 {
+		suffix = "s"
+	}
+	inst.log.Infof("%d protected torrent%s left alone", len(nameList), suffix)
+	inst.notify(notification{
+		Priority: priorityLow,
+		Title:    fmt.Sprintf("%d protected torrent%s left alone", len(nameList), suffix),
+		Message:  butlerMakeStrList(nameList),
+		Event:    "protected torrents",
+		Torrents: nameList,
+	})
+	return len(protectedCandidates)
+}
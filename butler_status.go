@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type batchResult struct {
+	Instance   string         `json:"instance,omitempty"`
+	Start      time.Time      `json:"start"`
+	Duration   time.Duration  `json:"-"`
+	DryRun     bool           `json:"dry_run"`
+	Success    bool           `json:"success"`
+	Error      string         `json:"error,omitempty"`
+	ErrorClass string         `json:"error_class,omitempty"`
+	Torrents   int            `json:"torrents"`
+	Actions    map[string]int `json:"actions"`
+	Postponed  map[string]int `json:"postponed,omitempty"` // outside of their maintenance windows
+	// earliest opening of the windows of the postponed actions
+	nextWindow       time.Time
+	nextWindowAction string
+}
+
+func newBatchResult(instance string, dryRun bool) *batchResult {
+	return &batchResult{
+		Instance:  instance,
+		Start:     time.Now(),
+		DryRun:    dryRun,
+		Actions:   make(map[string]int, 6),
+		Postponed: make(map[string]int),
+	}
+}
+
+func (br *batchResult) MarshalJSON() ([]byte, error) {
+	type rawBatchResult batchResult
+	return json.Marshal(&struct {
+		*rawBatchResult
+		Duration string `json:"duration"`
+	}{
+		rawBatchResult: (*rawBatchResult)(br),
+		Duration:       br.Duration.String(),
+	})
+}
+
+// String returns a short summary of the batch
+func (br *batchResult) String() string {
+	if !br.Success {
+		return fmt.Sprintf("failed after %v: %s", br.Duration, br.Error)
+	}
+	actions := make([]string, 0, len(br.Actions))
+	for action, count := range br.Actions {
+		if count > 0 {
+			actions = append(actions, fmt.Sprintf("%s: %d", action, count))
+		}
+	}
+	sort.Strings(actions)
+	if len(actions) == 0 {
+		actions = append(actions, "nothing to do")
+	}
+	postponed := make([]string, 0, len(br.Postponed))
+	for action, count := range br.Postponed {
+		postponed = append(postponed, fmt.Sprintf("%s: %d", action, count))
+	}
+	if len(postponed) > 0 {
+		sort.Strings(postponed)
+		actions = append(actions, fmt.Sprintf("postponed %s", strings.Join(postponed, ", ")))
+	}
+	var prefix string
+	if br.DryRun {
+		prefix = "[dry run] "
+	}
+	return fmt.Sprintf("%s%d torrent(s) in %v (%s)", prefix, br.Torrents, br.Duration.Round(time.Millisecond), strings.Join(actions, ", "))
+}
+
+// butlerStatus keeps track of an instance activity for the control API
+type butlerStatus struct {
+	access    sync.RWMutex
+	lastBatch *batchResult
+	protected []string
+	failures  int  // consecutive failed batches
+	version   bool // remote RPC version checked since the last connection loss
+}
+
+func (bs *butlerStatus) setLastBatch(result *batchResult) {
+	defer bs.access.Unlock()
+	bs.access.Lock()
+	bs.lastBatch = result
+}
+
+// recordBatch counts the consecutive failed batches: it returns the new count after a failure, the previous one after a success
+func (bs *butlerStatus) recordBatch(success bool) (failures int) {
+	defer bs.access.Unlock()
+	bs.access.Lock()
+	if success {
+		failures, bs.failures = bs.failures, 0
+		return
+	}
+	bs.failures++
+	return bs.failures
+}
+
+func (bs *butlerStatus) setVersionChecked(checked bool) {
+	defer bs.access.Unlock()
+	bs.access.Lock()
+	bs.version = checked
+}
+
+func (bs *butlerStatus) isVersionChecked() bool {
+	defer bs.access.RUnlock()
+	bs.access.RLock()
+	return bs.version
+}
+
+func (bs *butlerStatus) get() (lastBatch *batchResult) {
+	defer bs.access.RUnlock()
+	bs.access.RLock()
+	return bs.lastBatch
+}
+
+// setProtected records the protected torrents of the last batch and returns true if they changed
+func (bs *butlerStatus) setProtected(keys []string) (changed bool) {
+	sort.Strings(keys)
+	defer bs.access.Unlock()
+	bs.access.Lock()
+	if len(keys) != len(bs.protected) {
+		changed = true
+	} else {
+		for index, key := range keys {
+			if bs.protected[index] != key {
+				changed = true
+				break
+			}
+		}
+	}
+	bs.protected = keys
+	return
+}
+
+// butlerSchedule keeps track of the next scheduled run (shared by all the instances)
+type butlerSchedule struct {
+	access  sync.RWMutex
+	nextRun time.Time
+}
+
+var schedule butlerSchedule
+
+func (bs *butlerSchedule) setNextRun(next time.Time) {
+	defer bs.access.Unlock()
+	bs.access.Lock()
+	bs.nextRun = next
+}
+
+func (bs *butlerSchedule) get() (nextRun time.Time) {
+	defer bs.access.RUnlock()
+	bs.access.RLock()
+	return bs.nextRun
+}
@@ -3,54 +3,365 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"os"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
+
+	"github.com/hekmon/cunits/v2"
 )
 
 func getConfig(filename string) (conf *config, err error) {
-	// Open file
-	var configFile *os.File
-	if configFile, err = os.Open(filename); err != nil {
+	// Read file
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
 		err = fmt.Errorf("can't open '%s' for reading: %v", filename, err)
 		return
 	}
-	defer configFile.Close()
 	// Parse it
-	if err = json.NewDecoder(configFile).Decode(&conf); err != nil {
+	conf = &config{Retry: defaultRetryConfig, Watchdog: defaultWatchdogConfig, ShutdownTimeout: defaultShutdownTimeout}
+	if err = json.Unmarshal(data, conf); err != nil {
 		err = fmt.Errorf("can't decode '%s' as JSON: %v", filename, err)
 		return
 	}
 	// Check values
-	if conf.Server.Host == "" {
-		err = fmt.Errorf("server host can't be empty")
+	if err = conf.Butler.check(); err != nil {
+		return
+	}
+	if err = conf.Notifications.check(); err != nil {
+		return
+	}
+	if err = conf.Retry.check(); err != nil {
+		return
+	}
+	if conf.Watchdog.BatchTimeout <= 0 {
+		err = fmt.Errorf("watchdog: batch_timeout_minutes must be greater than 0")
 		return
 	}
-	if conf.Server.Port == 0 {
-		err = fmt.Errorf("server port can't be 0")
+	if conf.ShutdownTimeout <= 0 {
+		err = fmt.Errorf("shutdown_timeout_seconds must be greater than 0")
 		return
 	}
-	if conf.Butler.CheckFrequency == 0 {
-		err = fmt.Errorf("butler check frequency can't be 0")
+	// Instances
+	if len(conf.Servers) == 0 {
+		// single (unnamed) instance
+		conf.Servers = []*instanceConfig{{serverConfig: conf.Server}}
+	} else if conf.Server.Host != "" {
+		err = fmt.Errorf("'server' and 'servers' can't be both set")
 		return
 	}
-	if conf.Butler.TargetRatio <= 0 {
-		err = fmt.Errorf("target ratio lesser than or equals to 0 make no sense")
+	var raw struct {
+		Butler map[string]json.RawMessage `json:"butler"`
+	}
+	if err = json.Unmarshal(data, &raw); err != nil {
+		err = fmt.Errorf("can't decode '%s' as JSON: %v", filename, err)
 		return
 	}
+	names := make(map[string]bool, len(conf.Servers))
+	for index, instance := range conf.Servers {
+		if instance == nil {
+			err = fmt.Errorf("server #%d can't be null", index)
+			return
+		}
+		if len(conf.Servers) > 1 || instance.Name != "" {
+			if instance.Name == "" {
+				err = fmt.Errorf("server #%d name can't be empty", index)
+				return
+			}
+			if names[instance.Name] {
+				err = fmt.Errorf("server name '%s' is used more than once", instance.Name)
+				return
+			}
+			names[instance.Name] = true
+		}
+		if err = instance.check(raw.Butler); err == nil && conf.StateFile == "" {
+			err = instance.Butler.checkStateless()
+		}
+		if err != nil {
+			if instance.Name != "" {
+				err = fmt.Errorf("server '%s': %v", instance.Name, err)
+			}
+			return
+		}
+	}
 	// All good
 	return
 }
 
+func (bc *butlerConfig) check() (err error) {
+	if bc.Schedule != "" {
+		if bc.schedule, err = parseCronSchedule(bc.Schedule); err != nil {
+			return
+		}
+	} else if bc.CheckFrequency <= 0 {
+		return fmt.Errorf("butler check frequency can't be 0 without a schedule")
+	}
+	if bc.windows, err = compileWindows(bc.Windows); err != nil {
+		return
+	}
+	if bc.TargetRatio <= 0 {
+		return fmt.Errorf("target ratio lesser than or equals to 0 make no sense")
+	}
+	if err = checkSeedRequirement(&bc.SeedRequirement); err != nil {
+		return
+	}
+	if bc.IdleTime < 0 {
+		return fmt.Errorf("idle days can't be negative")
+	}
+	switch bc.IdleAction {
+	case "":
+		bc.IdleAction = idleActionDelete
+	case idleActionDelete, idleActionStop:
+	default:
+		return fmt.Errorf("idle action '%s' is invalid: valid values are '%s' and '%s'", bc.IdleAction, idleActionDelete, idleActionStop)
+	}
+	if bc.Eviction != nil {
+		switch bc.Eviction.Order {
+		case "":
+			bc.Eviction.Order = evictionOrderOldest
+		case evictionOrderOldest, evictionOrderHighestRatio, evictionOrderLargest, evictionOrderSlowest:
+		default:
+			return fmt.Errorf("eviction order '%s' is invalid: valid values are '%s', '%s', '%s' and '%s'", bc.Eviction.Order,
+				evictionOrderOldest, evictionOrderHighestRatio, evictionOrderLargest, evictionOrderSlowest)
+		}
+		if bc.Eviction.MinFreeSpace == 0 {
+			// no floor set: eviction is disabled
+			bc.Eviction = nil
+		}
+	}
+	if bc.Quarantine != nil {
+		if bc.Quarantine.Dir == "" {
+			// no trash dir set: torrents data is deleted
+			bc.Quarantine = nil
+		} else if !filepath.IsAbs(bc.Quarantine.Dir) {
+			return fmt.Errorf("quarantine dir '%s' must be an absolute path", bc.Quarantine.Dir)
+		} else if bc.Quarantine.Retention < 0 {
+			return fmt.Errorf("quarantine retention can't be negative")
+		}
+	}
+	if bc.Protection != nil {
+		if err = bc.Protection.check(); err != nil {
+			return
+		}
+		if bc.Protection.isEmpty() {
+			bc.Protection = nil
+		}
+	}
+	policies := make(map[string]*butlerPolicy, len(bc.Policies))
+	for tracker, policy := range bc.Policies {
+		if policy == nil {
+			return fmt.Errorf("policy for tracker '%s' can't be null", tracker)
+		}
+		if err = policy.check(); err != nil {
+			return fmt.Errorf("%v (policy for tracker '%s')", err, tracker)
+		}
+		policies[strings.ToLower(tracker)] = policy
+	}
+	bc.Policies = policies
+	for index, rule := range bc.Rules {
+		if rule == nil {
+			return fmt.Errorf("rule #%d can't be null", index)
+		}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", index)
+		}
+		if err = rule.check(); err != nil {
+			return fmt.Errorf("rule '%s': %v", rule.Name, err)
+		}
+	}
+	return
+}
+
+// nextRun returns the time of the next scheduled batch after t
+func (bc *butlerConfig) nextRun(t time.Time) time.Time {
+	if bc.schedule != nil {
+		return bc.schedule.next(t)
+	}
+	return t.Add(bc.CheckFrequency)
+}
+
+// describeSchedule returns when the batches run, for humans
+func (bc *butlerConfig) describeSchedule() string {
+	if bc.schedule != nil {
+		return fmt.Sprintf("on schedule '%s'", bc.schedule)
+	}
+	return fmt.Sprintf("every %v", bc.CheckFrequency)
+}
+
+// checkStateless returns an error if the butler values need the state file
+func (bc *butlerConfig) checkStateless() error {
+	if bc.hasPolicyRatio() {
+		return fmt.Errorf("policy target ratios need a 'state_file' to keep track of the torrents switched to them")
+	}
+	if bc.hasRuleAction(ruleActionStop) {
+		return fmt.Errorf("the '%s' rule action needs a 'state_file' to keep track of the torrents it stopped", ruleActionStop)
+	}
+	return nil
+}
+
+// hasPolicyRatio returns true if a policy (or a rule without action) sets a target ratio other than the global one: the
+// torrents switched to it can only be told apart from the ones with a custom ratio set by the user through the state file
+func (bc *butlerConfig) hasPolicyRatio() bool {
+	for _, policy := range bc.Policies {
+		if policy.TargetRatio != nil && *policy.TargetRatio != bc.TargetRatio {
+			return true
+		}
+	}
+	for _, rule := range bc.Rules {
+		if rule.action == nil && rule.Policy.TargetRatio != nil && *rule.Policy.TargetRatio != bc.TargetRatio {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRuleAction returns true if one of the rules uses one of the actions
+func (bc *butlerConfig) hasRuleAction(names ...string) bool {
+	for _, rule := range bc.Rules {
+		if rule.action == nil {
+			continue
+		}
+		for _, name := range names {
+			if rule.action.name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func checkSeedRequirement(requirement *string) error {
+	switch *requirement {
+	case "":
+		*requirement = seedRequirementBoth
+	case seedRequirementBoth, seedRequirementEither:
+	default:
+		return fmt.Errorf("seed requirement '%s' is invalid: valid values are '%s' and '%s'",
+			*requirement, seedRequirementBoth, seedRequirementEither)
+	}
+	return nil
+}
+
 type config struct {
-	Server   serverConfig   `json:"server"`
-	Butler   butlerConfig   `json:"butler"`
-	Pushover pushoverConfig `json:"pushover"`
+	Server          serverConfig        `json:"server"`
+	Servers         []*instanceConfig   `json:"servers"`
+	Butler          butlerConfig        `json:"butler"`
+	Pushover        pushoverConfig      `json:"pushover"`
+	Notifications   notificationsConfig `json:"notifications"`
+	HTTP            httpConfig          `json:"http"`
+	Retry           retryConfig         `json:"retry"`
+	Watchdog        watchdogConfig      `json:"watchdog"`
+	WatchConfig     bool                `json:"watch_config"`
+	StateFile       string              `json:"state_file"`
+	ShutdownTimeout time.Duration       `json:"shutdown_timeout_seconds"`
+}
+
+const (
+	defaultShutdownTimeout = 30 * time.Second
+	shutdownMargin         = 5 * time.Second // asked to systemd on top of the shutdown timeout
+)
+
+// UnmarshalJSON keeps the current values (the defaults) of the keys not set
+func (c *config) UnmarshalJSON(data []byte) (err error) {
+	type rawConfig config
+	c.ShutdownTimeout /= time.Second
+	if err = json.Unmarshal(data, (*rawConfig)(c)); err == nil {
+		c.ShutdownTimeout *= time.Second
+	}
+	return
 }
 
 func (c *config) isPushoverEnabled() bool {
 	return c.Pushover.AppKey != nil && c.Pushover.UserKey != nil
 }
 
+// getServer returns the server config matching name, an empty name is only valid when there is a single server
+func (c *config) getServer(name string) (ic *instanceConfig, err error) {
+	for _, server := range c.Servers {
+		if server.Name == name || (name == "" && len(c.Servers) == 1) {
+			return server, nil
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("a server name is needed when several are configured")
+	}
+	return nil, fmt.Errorf("unknown server '%s'", name)
+}
+
+// retryConfig sets how the failed transmission RPC calls are retried and when a failing server is notified
+type retryConfig struct {
+	Retries       int           `json:"retries"`
+	Delay         time.Duration `json:"delay_seconds"`
+	MaxDelay      time.Duration `json:"max_delay_seconds"`
+	DegradedAfter int           `json:"degraded_after_batches"`
+	StartupWait   time.Duration `json:"startup_wait_minutes"`
+}
+
+var defaultRetryConfig = retryConfig{
+	Retries:       3,
+	Delay:         2 * time.Second,
+	MaxDelay:      30 * time.Second,
+	DegradedAfter: 3,
+}
+
+// UnmarshalJSON keeps the current values (the defaults) of the keys not set
+func (rc *retryConfig) UnmarshalJSON(data []byte) (err error) {
+	type rawRetryConfig retryConfig
+	rc.Delay /= time.Second
+	rc.MaxDelay /= time.Second
+	rc.StartupWait /= time.Minute
+	if err = json.Unmarshal(data, (*rawRetryConfig)(rc)); err == nil {
+		rc.Delay *= time.Second
+		rc.MaxDelay *= time.Second
+		rc.StartupWait *= time.Minute
+	}
+	return
+}
+
+func (rc *retryConfig) check() error {
+	if rc.Retries < 0 {
+		return fmt.Errorf("retry: retries can't be negative")
+	}
+	if rc.Retries > 0 && rc.Delay <= 0 {
+		return fmt.Errorf("retry: delay_seconds must be greater than 0")
+	}
+	if rc.MaxDelay < rc.Delay {
+		return fmt.Errorf("retry: max_delay_seconds can't be lower than delay_seconds")
+	}
+	if rc.DegradedAfter < 0 {
+		return fmt.Errorf("retry: degraded_after_batches can't be negative")
+	}
+	if rc.StartupWait < 0 {
+		return fmt.Errorf("retry: startup_wait_minutes can't be negative")
+	}
+	return nil
+}
+
+// callDuration returns the longest time a call can take with all its retries
+func (rc retryConfig) callDuration() time.Duration {
+	return time.Duration(rc.Retries+1)*transmissionRPCTimeout + time.Duration(rc.Retries)*rc.MaxDelay
+}
+
+// watchdogConfig sets when the butler is considered stuck by the systemd watchdog
+type watchdogConfig struct {
+	BatchTimeout time.Duration `json:"batch_timeout_minutes"`
+}
+
+var defaultWatchdogConfig = watchdogConfig{
+	BatchTimeout: 30 * time.Minute,
+}
+
+// UnmarshalJSON keeps the current values (the defaults) of the keys not set
+func (wc *watchdogConfig) UnmarshalJSON(data []byte) (err error) {
+	type rawWatchdogConfig watchdogConfig
+	wc.BatchTimeout /= time.Minute
+	if err = json.Unmarshal(data, (*rawWatchdogConfig)(wc)); err == nil {
+		wc.BatchTimeout *= time.Minute
+	}
+	return
+}
+
 type serverConfig struct {
 	Host     string `json:"host"`
 	Port     uint16 `json:"port"`
@@ -59,12 +370,65 @@ type serverConfig struct {
 	Password string `json:"password"`
 }
 
+// instanceConfig is a transmission server managed by the butler, with its own butler values overrides
+type instanceConfig struct {
+	Name string `json:"name"`
+	serverConfig
+	Overrides map[string]json.RawMessage `json:"butler"`
+	Butler    butlerConfig               `json:"-"`
+}
+
+// check validates the server values and computes its butler config by applying its overrides on the global one
+func (ic *instanceConfig) check(global map[string]json.RawMessage) (err error) {
+	if ic.Host == "" {
+		return fmt.Errorf("server host can't be empty")
+	}
+	if ic.Port == 0 {
+		return fmt.Errorf("server port can't be 0")
+	}
+	for _, key := range []string{"check_frequency_minutes", "schedule"} {
+		if _, found := ic.Overrides[key]; found {
+			return fmt.Errorf("butler %s can't be overridden per server", key)
+		}
+	}
+	merged := make(map[string]json.RawMessage, len(global)+len(ic.Overrides))
+	for key, value := range global {
+		merged[key] = value
+	}
+	for key, value := range ic.Overrides {
+		merged[key] = value
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return fmt.Errorf("can't merge butler overrides: %v", err)
+	}
+	if err = json.Unmarshal(data, &ic.Butler); err != nil {
+		return fmt.Errorf("can't decode butler overrides: %v", err)
+	}
+	return ic.Butler.check()
+}
+
 type butlerConfig struct {
-	CheckFrequency time.Duration `json:"check_frequency_minutes"`
-	FreeSeed       time.Duration `json:"free_seed_days"`
-	TargetRatio    float64       `json:"target_ratio"`
-	RestoreCustom  bool          `json:"restore_custom"`
-	DeleteDone     bool          `json:"delete_when_done"`
+	CheckFrequency  time.Duration            `json:"check_frequency_minutes"`
+	Schedule        string                   `json:"schedule"`
+	Windows         map[string][]string      `json:"windows"`
+	FreeSeed        time.Duration            `json:"free_seed_days"`
+	TargetRatio     float64                  `json:"target_ratio"`
+	RestoreCustom   bool                     `json:"restore_custom"`
+	DeleteDone      bool                     `json:"delete_when_done"`
+	MinSeedTime     time.Duration            `json:"min_seed_hours"`
+	SeedRequirement string                   `json:"seed_requirement"`
+	IdleTime        time.Duration            `json:"idle_days"`
+	IdleAction      string                   `json:"idle_action"`
+	DryRun          bool                     `json:"dry_run"`
+	Policies        map[string]*butlerPolicy `json:"policies"`
+	Eviction        *evictionConfig          `json:"eviction"`
+	Quarantine      *quarantineConfig        `json:"quarantine"`
+	Protection      *protectionConfig        `json:"protection"`
+	Rules           []*butlerRule            `json:"rules"`
+	// compiled by check()
+	schedule *cronSchedule
+	windows  map[string][]timeWindow
 }
 
 func (bc *butlerConfig) UnmarshalJSON(data []byte) (err error) {
@@ -77,11 +441,266 @@ func (bc *butlerConfig) UnmarshalJSON(data []byte) (err error) {
 	if err = json.Unmarshal(data, tmp); err == nil {
 		bc.CheckFrequency *= time.Minute
 		bc.FreeSeed *= 24 * time.Hour
+		bc.MinSeedTime *= time.Hour
+		bc.IdleTime *= 24 * time.Hour
+	}
+	return
+}
+
+const (
+	seedRequirementBoth   = "both"
+	seedRequirementEither = "either"
+)
+
+const (
+	idleActionDelete = "delete"
+	idleActionStop   = "stop"
+)
+
+type butlerPolicy struct {
+	FreeSeed        *time.Duration `json:"free_seed_days"`
+	TargetRatio     *float64       `json:"target_ratio"`
+	MinSeedTime     *time.Duration `json:"min_seed_hours"`
+	SeedRequirement *string        `json:"seed_requirement"`
+	IdleTime        *time.Duration `json:"idle_days"`
+}
+
+func (bp *butlerPolicy) UnmarshalJSON(data []byte) (err error) {
+	type rawButlerPolicy butlerPolicy
+	tmp := &struct {
+		*rawButlerPolicy
+	}{
+		rawButlerPolicy: (*rawButlerPolicy)(bp),
+	}
+	if err = json.Unmarshal(data, tmp); err != nil {
+		return
+	}
+	if bp.FreeSeed != nil {
+		*bp.FreeSeed *= 24 * time.Hour
+	}
+	if bp.MinSeedTime != nil {
+		*bp.MinSeedTime *= time.Hour
+	}
+	if bp.IdleTime != nil {
+		*bp.IdleTime *= 24 * time.Hour
+	}
+	return
+}
+
+func (bp *butlerPolicy) check() (err error) {
+	if bp.TargetRatio != nil && *bp.TargetRatio <= 0 {
+		return fmt.Errorf("target ratio lesser than or equals to 0 make no sense")
+	}
+	if bp.SeedRequirement != nil {
+		if err = checkSeedRequirement(bp.SeedRequirement); err != nil {
+			return
+		}
+	}
+	if bp.IdleTime != nil && *bp.IdleTime < 0 {
+		return fmt.Errorf("idle days can't be negative")
+	}
+	return
+}
+
+// butlerRule applies its policy values and action to the torrents having one of its labels and matching
+// its expression, rules are evaluated in order
+type butlerRule struct {
+	Name   string       `json:"name"`
+	Labels []string     `json:"labels"`
+	When   string       `json:"when"`
+	Action string       `json:"action"`
+	Keep   bool         `json:"keep"`
+	Policy butlerPolicy `json:"-"` // policy values are set at the rule level
+	// compiled by check()
+	when   *ruleExpression
+	action *ruleAction
+}
+
+func (br *butlerRule) UnmarshalJSON(data []byte) (err error) {
+	type rawButlerRule butlerRule
+	if err = json.Unmarshal(data, (*rawButlerRule)(br)); err != nil {
+		return
+	}
+	return json.Unmarshal(data, &br.Policy)
+}
+
+func (br *butlerRule) check() (err error) {
+	if len(br.Labels) == 0 && br.When == "" {
+		return fmt.Errorf("labels or a 'when' expression must be set")
+	}
+	if br.When != "" {
+		if br.when, err = compileRuleExpression(br.When); err != nil {
+			return fmt.Errorf("invalid 'when' expression: %v", err)
+		}
+	}
+	if br.Action != "" {
+		if br.action, err = parseRuleAction(br.Action); err != nil {
+			return
+		}
+		if br.Keep && br.action.name == ruleActionDelete {
+			return fmt.Errorf("action '%s' can't be used with keep", br.action.name)
+		}
+		if br.action.name == ruleActionCustomRatio {
+			if br.Policy.TargetRatio != nil {
+				return fmt.Errorf("action '%s' already sets the target ratio", br.action.name)
+			}
+			br.Policy.TargetRatio = &br.action.ratio
+		}
+	}
+	return br.Policy.check()
+}
+
+const (
+	evictionOrderOldest       = "oldest_done"
+	evictionOrderHighestRatio = "highest_ratio"
+	evictionOrderLargest      = "largest"
+	evictionOrderSlowest      = "lowest_upload_rate"
+)
+
+type evictionConfig struct {
+	MinFreeSpace cunits.Bits `json:"min_free_space"`
+	Order        string      `json:"order"`
+}
+
+func (ec *evictionConfig) UnmarshalJSON(data []byte) (err error) {
+	type rawEvictionConfig evictionConfig
+	tmp := &struct {
+		MinFreeSpace string `json:"min_free_space"`
+		*rawEvictionConfig
+	}{
+		rawEvictionConfig: (*rawEvictionConfig)(ec),
+	}
+	if err = json.Unmarshal(data, tmp); err != nil {
+		return
+	}
+	if tmp.MinFreeSpace != "" {
+		if ec.MinFreeSpace, err = cunits.Parse(tmp.MinFreeSpace); err != nil {
+			err = fmt.Errorf("can't parse eviction min free space '%s': %v", tmp.MinFreeSpace, err)
+		}
+	}
+	return
+}
+
+type quarantineConfig struct {
+	Dir       string        `json:"dir"`
+	Retention time.Duration `json:"retention_days"`
+}
+
+func (qc *quarantineConfig) UnmarshalJSON(data []byte) (err error) {
+	type rawQuarantineConfig quarantineConfig
+	tmp := &struct {
+		*rawQuarantineConfig
+	}{
+		rawQuarantineConfig: (*rawQuarantineConfig)(qc),
+	}
+	if err = json.Unmarshal(data, tmp); err == nil {
+		qc.Retention *= 24 * time.Hour
+	}
+	return
+}
+
+// protectionConfig lists the torrents the butler must never touch
+type protectionConfig struct {
+	Labels       []string `json:"labels"`
+	Hashes       []string `json:"hashes"`
+	NamePatterns []string `json:"name_patterns"`
+	DownloadDirs []string `json:"download_dirs"`
+	namePatterns []*regexp.Regexp
+}
+
+func (pc *protectionConfig) check() (err error) {
+	pc.namePatterns = make([]*regexp.Regexp, len(pc.NamePatterns))
+	for index, pattern := range pc.NamePatterns {
+		if pc.namePatterns[index], err = regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("protection name pattern '%s' is invalid: %v", pattern, err)
+		}
+	}
+	for index, hash := range pc.Hashes {
+		pc.Hashes[index] = strings.ToLower(hash)
+	}
+	for index, dir := range pc.DownloadDirs {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("protection download dir '%s' must be an absolute path", dir)
+		}
+		pc.DownloadDirs[index] = filepath.Clean(dir)
 	}
 	return
 }
 
+func (pc *protectionConfig) isEmpty() bool {
+	return len(pc.Labels) == 0 && len(pc.Hashes) == 0 && len(pc.NamePatterns) == 0 && len(pc.DownloadDirs) == 0
+}
+
+type httpConfig struct {
+	Listen   string `json:"listen"`
+	APIToken string `json:"api_token"`
+}
+
 type pushoverConfig struct {
 	AppKey  *string `json:"app_key"`
 	UserKey *string `json:"user_key"`
 }
+
+type notificationsConfig struct {
+	Webhook *webhookConfig `json:"webhook"`
+	SMTP    *smtpConfig    `json:"smtp"`
+	Ntfy    *ntfyConfig    `json:"ntfy"`
+	Gotify  *gotifyConfig  `json:"gotify"`
+}
+
+func (nc *notificationsConfig) check() error {
+	if nc.Webhook != nil && nc.Webhook.URL == "" {
+		return fmt.Errorf("webhook notifications URL can't be empty")
+	}
+	if nc.SMTP != nil {
+		if nc.SMTP.Host == "" {
+			return fmt.Errorf("smtp notifications host can't be empty")
+		}
+		if nc.SMTP.Port == 0 {
+			return fmt.Errorf("smtp notifications port can't be 0")
+		}
+		if nc.SMTP.From == "" {
+			return fmt.Errorf("smtp notifications sender can't be empty")
+		}
+		if len(nc.SMTP.To) == 0 {
+			return fmt.Errorf("smtp notifications need at least one recipient")
+		}
+	}
+	if nc.Ntfy != nil && nc.Ntfy.URL == "" {
+		return fmt.Errorf("ntfy notifications topic URL can't be empty")
+	}
+	if nc.Gotify != nil {
+		if nc.Gotify.URL == "" {
+			return fmt.Errorf("gotify notifications server URL can't be empty")
+		}
+		if nc.Gotify.Token == "" {
+			return fmt.Errorf("gotify notifications application token can't be empty")
+		}
+	}
+	return nil
+}
+
+type webhookConfig struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
+type smtpConfig struct {
+	Host     string   `json:"host"`
+	Port     uint16   `json:"port"`
+	TLS      bool     `json:"tls"`
+	User     string   `json:"user"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+type ntfyConfig struct {
+	URL   string `json:"topic_url"`
+	Token string `json:"token"`
+}
+
+type gotifyConfig struct {
+	URL   string `json:"url"`
+	Token string `json:"app_token"`
+}
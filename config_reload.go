@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	systemd "github.com/iguanesolutions/go-systemd"
+)
+
+var (
+	confFilename    string
+	confForceDryRun bool
+	confAccess      sync.RWMutex
+	confReload      sync.Mutex
+	// rescheduleButler is signaled when the check frequency or the schedule changed after a reload
+	rescheduleButler = make(chan struct{}, 1)
+)
+
+// currentConf must be used to access the configuration outside of a butler batch
+func currentConf() *config {
+	defer confAccess.RUnlock()
+	confAccess.RLock()
+	return conf
+}
+
+func loadConfig() (c *config, err error) {
+	if c, err = getConfig(confFilename); err != nil {
+		return
+	}
+	if confForceDryRun {
+		c.Butler.DryRun = true
+		for _, instance := range c.Servers {
+			instance.Butler.DryRun = true
+		}
+	}
+	return
+}
+
+// reloadConfig validates the configuration file and swaps it with the current one if it is valid
+func reloadConfig(trigger string) (err error) {
+	// Only 1 reload at a time
+	defer confReload.Unlock()
+	confReload.Lock()
+	logger.Infof("[Main] Reloading configuration (%s)", trigger)
+	if err = systemd.NotifyReloading(); err != nil {
+		logger.Errorf("[Main] Sending reloading notification to systemd failed: %v", err)
+	}
+	defer func() {
+		if err := systemd.NotifyReady(); err != nil {
+			logger.Errorf("[Main] Sending ready notification to systemd failed: %v", err)
+		}
+	}()
+	// Load and validate the new configuration
+	newConf, err := loadConfig()
+	if err != nil {
+		logger.Errorf("[Main] Configuration reload failed, keeping the current one: %v", err)
+		notifications.Notify(notification{
+			Priority: priorityHigh,
+			Message:  fmt.Sprintf("Configuration reload failed, keeping the current one: %v", err),
+			Event:    "config reload",
+		})
+		return
+	}
+	// Prepare what depends on it
+	oldConf := currentConf()
+	newNotifications := newNotificationDispatcher(newConf)
+	nextInstances, err := newInstances(newConf, newNotifications, currentInstances())
+	if err != nil {
+		logger.Errorf("[Main] Configuration reload failed, keeping the current one: %v", err)
+		notifications.Notify(notification{
+			Priority: priorityHigh,
+			Message:  fmt.Sprintf("Configuration reload failed, keeping the current one: %v", err),
+			Event:    "config reload",
+		})
+		return
+	}
+	if newConf.HTTP.Listen != oldConf.HTTP.Listen {
+		logger.Warningf("[Main] HTTP listen address change ('%s' to '%s') will only be applied after a restart",
+			oldConf.HTTP.Listen, newConf.HTTP.Listen)
+	}
+	if newConf.HTTP.APIToken != oldConf.HTTP.APIToken {
+		if newConf.HTTP.APIToken == "" {
+			logger.Warning("[Main] HTTP API token removed: the control API rejects every request until a restart disables it")
+		} else {
+			logger.Warning("[Main] HTTP API token change will only be fully applied after a restart")
+		}
+	}
+	if newConf.StateFile != oldConf.StateFile {
+		logger.Warningf("[Main] State file change ('%s' to '%s') will only be applied after a restart",
+			oldConf.StateFile, newConf.StateFile)
+	}
+	if newConf.WatchConfig != oldConf.WatchConfig {
+		logger.Warning("[Main] Configuration file watching change will only be applied after a restart")
+	}
+	// Swap everything atomically once the current batch (if any) is done
+	logger.Debugf("[Main] Waiting for butlerRun lock")
+	butlerRun.Lock()
+	confAccess.Lock()
+	conf = newConf
+	notifications = newNotifications
+	instances = nextInstances
+	confAccess.Unlock()
+	butlerRun.Unlock()
+	logger.Debugf("[Main] Reloaded configuration:\n%+v", newConf)
+	// Reschedule the butler if needed
+	if newConf.Butler.CheckFrequency != oldConf.Butler.CheckFrequency || newConf.Butler.Schedule != oldConf.Butler.Schedule {
+		select {
+		case rescheduleButler <- struct{}{}:
+		default:
+			// a reschedule is already pending
+		}
+	}
+	logger.Info("[Main] Configuration reloaded")
+	notifications.Notify(notification{
+		Priority: priorityLow,
+		Message:  "Configuration reloaded",
+		Event:    "config reload",
+	})
+	return
+}
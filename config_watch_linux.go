@@ -0,0 +1,74 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const configWatchDebounce = time.Second
+
+// watchConfig reloads the configuration when its file is modified, using inotify on its parent dir
+// to also catch editors replacing the file
+func watchConfig() (err error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("can't initialize inotify: %v", err)
+	}
+	dir, file := filepath.Split(confFilename)
+	if dir == "" {
+		dir = "."
+	}
+	if _, err = syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO|syscall.IN_CREATE); err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("can't watch '%s' dir: %v", dir, err)
+	}
+	logger.Infof("[Main] Watching '%s' for changes", confFilename)
+	go func() {
+		defer syscall.Close(fd)
+		var debounce *time.Timer
+		buffer := make([]byte, syscall.SizeofInotifyEvent*64+syscall.NAME_MAX+1)
+		for {
+			n, err := syscall.Read(fd, buffer)
+			if err != nil {
+				if err == syscall.EINTR {
+					continue
+				}
+				logger.Errorf("[Main] Configuration file watching stopped: can't read inotify events: %v", err)
+				return
+			}
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+				nameStart := offset + syscall.SizeofInotifyEvent
+				name := string(trimNullBytes(buffer[nameStart : nameStart+int(event.Len)]))
+				offset = nameStart + int(event.Len)
+				if name != file {
+					continue
+				}
+				// Editors can generate several events for a single save
+				if debounce == nil {
+					debounce = time.AfterFunc(configWatchDebounce, func() {
+						reloadConfig("configuration file change")
+					})
+				} else {
+					debounce.Reset(configWatchDebounce)
+				}
+			}
+		}
+	}()
+	return
+}
+
+func trimNullBytes(data []byte) []byte {
+	for index, value := range data {
+		if value == 0 {
+			return data[:index]
+		}
+	}
+	return data
+}
@@ -0,0 +1,37 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const configWatchInterval = 10 * time.Second
+
+// watchConfig reloads the configuration when its file modification time changes (polling)
+func watchConfig() (err error) {
+	info, err := os.Stat(confFilename)
+	if err != nil {
+		return fmt.Errorf("can't stat '%s': %v", confFilename, err)
+	}
+	logger.Infof("[Main] Watching '%s' for changes (polling every %v)", confFilename, configWatchInterval)
+	go func() {
+		lastModTime := info.ModTime()
+		for range time.Tick(configWatchInterval) {
+			info, err := os.Stat(confFilename)
+			if err != nil {
+				logger.Debugf("[Main] Can't stat '%s': %v", confFilename, err)
+				continue
+			}
+			if info.ModTime().Equal(lastModTime) {
+				continue
+			}
+			lastModTime = info.ModTime()
+			reloadConfig("configuration file change")
+		}
+	}()
+	return
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Standard 5 fields cron expressions: minute hour day-of-month month day-of-week
+//
+//	*/15 * * * *		every 15 minutes
+//	0 2-6 * * mon-fri	every hour from 2am to 6am on week days
+//	@daily			once a day at midnight
+
+const cronMaxYears = 5 // no match within this period means the expression can never match
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var cronDayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    []string // names of the values, starting at min
+}
+
+var cronFields = [5]cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: cronMonthNames},
+	{name: "day of week", min: 0, max: 7, names: cronDayNames}, // 0 and 7 are sunday
+}
+
+// cronSchedule is a parsed cron expression
+type cronSchedule struct {
+	source   string
+	minutes  [60]bool
+	hours    [24]bool
+	days     [32]bool
+	months   [13]bool
+	weekdays [7]bool
+	// day of month and day of week are or-ed when both are restricted
+	anyDay, anyWeekday bool
+}
+
+func (cs *cronSchedule) String() string {
+	return cs.source
+}
+
+// parseCronSchedule parses a 5 fields cron expression or one of the @hourly like descriptors
+func parseCronSchedule(source string) (cs *cronSchedule, err error) {
+	expression := strings.TrimSpace(source)
+	if descriptor, found := cronDescriptors[strings.ToLower(expression)]; found {
+		expression = descriptor
+	}
+	parts := strings.Fields(expression)
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("cron expression '%s' must have %d fields (minute hour day-of-month month day-of-week), got %d",
+			source, len(cronFields), len(parts))
+	}
+	cs = &cronSchedule{
+		source:     source,
+		anyDay:     strings.HasPrefix(parts[2], "*"),
+		anyWeekday: strings.HasPrefix(parts[4], "*"),
+	}
+	for index, part := range parts {
+		var values []int
+		if values, err = cronFields[index].parse(part); err != nil {
+			return nil, fmt.Errorf("cron expression '%s': %v", source, err)
+		}
+		for _, value := range values {
+			switch index {
+			case 0:
+				cs.minutes[value] = true
+			case 1:
+				cs.hours[value] = true
+			case 2:
+				cs.days[value] = true
+			case 3:
+				cs.months[value] = true
+			case 4:
+				cs.weekdays[value%7] = true
+			}
+		}
+	}
+	if cs.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("cron expression '%s' never matches", source)
+	}
+	return
+}
+
+// parse returns the values of a comma separated list of '*', 'value', 'start-end' with an optional '/step'
+func (cf cronField) parse(part string) (values []int, err error) {
+	for _, item := range strings.Split(part, ",") {
+		rangePart, step := item, 1
+		if index := strings.Index(item, "/"); index != -1 {
+			rangePart = item[:index]
+			if step, err = strconv.Atoi(item[index+1:]); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid %s step in '%s'", cf.name, item)
+			}
+		}
+		start, end := cf.min, cf.max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			if start, err = cf.value(bounds[0]); err != nil {
+				return
+			}
+			if end, err = cf.value(bounds[1]); err != nil {
+				return
+			}
+			if start > end {
+				return nil, fmt.Errorf("invalid %s range '%s': start is after end", cf.name, rangePart)
+			}
+		default:
+			if start, err = cf.value(rangePart); err != nil {
+				return
+			}
+			if step == 1 {
+				end = start
+			}
+		}
+		for value := start; value <= end; value += step {
+			values = append(values, value)
+		}
+	}
+	return
+}
+
+func (cf cronField) value(raw string) (value int, err error) {
+	for index, name := range cf.names {
+		if strings.EqualFold(raw, name) {
+			return cf.min + index, nil
+		}
+	}
+	if value, err = strconv.Atoi(raw); err != nil {
+		return 0, fmt.Errorf("invalid %s '%s'", cf.name, raw)
+	}
+	if value < cf.min || value > cf.max {
+		return 0, fmt.Errorf("%s '%d' is out of range (%d-%d)", cf.name, value, cf.min, cf.max)
+	}
+	return
+}
+
+func (cs *cronSchedule) matchDay(t time.Time) bool {
+	day, weekday := cs.days[t.Day()], cs.weekdays[t.Weekday()]
+	switch {
+	case cs.anyDay && cs.anyWeekday:
+		return true
+	case cs.anyDay:
+		return weekday
+	case cs.anyWeekday:
+		return day
+	default:
+		return day || weekday
+	}
+}
+
+// next returns the first matching time strictly after t, zero if there is none
+func (cs *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronMaxYears, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !cs.months[t.Month()]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !cs.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !cs.hours[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !cs.minutes[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hekmon/transmissionrpc"
+)
+
+// explainCommand prints how the butler would handle a single torrent
+func explainCommand(args []string) int {
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	confFile := flags.String("conf", "config.json", "Relative or absolute path to the json configuration file")
+	instanceName := flags.String("instance", "", "Server of the torrent when several are configured")
+	snapshotFile := flags.String("snapshot", "", "Explain the torrent as it was in a snapshot file instead of asking the transmission server")
+	jsonOutput := flags.Bool("json", false, "Print the explanation as JSON")
+	logLevel := flags.Int("loglevel", 2, "Set loglevel: Debug(0) Info(1) Warning(2) Error(3) Fatal(4). Default Warning.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s explain [options] <id|hash|name>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 1
+	}
+	logger = newLogger(*logLevel)
+	var err error
+	if conf, err = getConfig(*confFile); err != nil {
+		fmt.Fprintf(os.Stderr, "can't load config: %v\n", err)
+		return 1
+	}
+	// Get the instance and its state, from the server or from the snapshot
+	var inst *instance
+	now := time.Now()
+	if *snapshotFile != "" {
+		snapshot, err := loadTransmissionFixture(*snapshotFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "can't load snapshot: %v\n", err)
+			return 1
+		}
+		if *instanceName == "" {
+			*instanceName = snapshot.Instance
+		}
+		ic, err := conf.getServer(*instanceName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "can't select the server: %v\n", err)
+			return 1
+		}
+		ft, err := newFakeTransmissionFromFixture(snapshot)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "can't load snapshot: %v\n", err)
+			return 1
+		}
+		if snapshot.State != nil {
+			state = &stateStore{
+				data: stateData{
+					Instances: map[string]*instanceState{ic.Name: snapshot.State},
+				},
+			}
+		}
+		if snapshot.Time != nil {
+			now = *snapshot.Time
+		}
+		inst = newInstance(ic.Name, &ic.Butler, ft, nil)
+	} else {
+		ic, err := conf.getServer(*instanceName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "can't select the server: %v\n", err)
+			return 1
+		}
+		client, err := newTransmissionClient(ic.serverConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "can't initialize the transmission client: %v\n", err)
+			return 1
+		}
+		// the state is only read: the original seed settings it knows are part of the decisions
+		if state, err = loadStateStore(conf.StateFile); err != nil {
+			fmt.Fprintf(os.Stderr, "can't load state: %v\n", err)
+			return 1
+		}
+		inst = newInstance(ic.Name, &ic.Butler, client, nil)
+	}
+	inst.clock = func() time.Time { return now }
+	// Explain
+	torrent, err := inst.findTorrent(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't find torrent: %v\n", err)
+		return 2
+	}
+	explanation, err := inst.explainTorrent(torrent, now)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't explain torrent: %v\n", err)
+		return 2
+	}
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "    ")
+		if err = encoder.Encode(explanation); err != nil {
+			fmt.Fprintf(os.Stderr, "can't encode explanation: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	explanation.print(os.Stdout, now)
+	return 0
+}
+
+// findTorrent returns the torrent matching an id, a hash or a name (exactly, else partially, case insensitive)
+func (inst *instance) findTorrent(query string) (torrent *transmissionrpc.Torrent, err error) {
+	if id, parseErr := strconv.ParseInt(query, 10, 64); parseErr == nil {
+		return inst.fetchTorrent(id)
+	}
+	torrents, err := inst.client.TorrentGet(fields, nil)
+	if err != nil {
+		metrics.rpcError(inst.name, "torrent-get")
+		return nil, fmt.Errorf("can't retrieve torrent(s) metadata: %v", err)
+	}
+	var exact, partial []*transmissionrpc.Torrent
+	for _, candidate := range torrents {
+		if candidate == nil || candidate.ID == nil {
+			continue
+		}
+		if candidate.HashString != nil && strings.EqualFold(*candidate.HashString, query) {
+			return candidate, nil
+		}
+		if candidate.Name == nil {
+			continue
+		}
+		if strings.EqualFold(*candidate.Name, query) {
+			exact = append(exact, candidate)
+		} else if strings.Contains(strings.ToLower(*candidate.Name), strings.ToLower(query)) {
+			partial = append(partial, candidate)
+		}
+	}
+	matching := exact
+	if len(matching) == 0 {
+		matching = partial
+	}
+	switch len(matching) {
+	case 0:
+		err = fmt.Errorf("no torrent id, hash or name matches '%s'", query)
+	case 1:
+		torrent = matching[0]
+	default:
+		names := make([]string, len(matching))
+		for index, candidate := range matching {
+			names[index] = fmt.Sprintf("%d (%s)", *candidate.ID, *candidate.Name)
+		}
+		err = fmt.Errorf("%d torrents match '%s', use one of their id: %s", len(matching), query, strings.Join(names, ", "))
+	}
+	return
+}
+
+// print writes the explanation for humans
+func (te *torrentExplanation) print(w io.Writer, now time.Time) {
+	freeSeed := "over"
+	if te.FreeSeedEnd.After(now) {
+		freeSeed = fmt.Sprintf("%v left", te.FreeSeedEnd.Sub(now).Round(time.Minute))
+	}
+	seedTime := te.SeedTime
+	if seedTime == "" {
+		seedTime = "unknown"
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Torrent:\t%d (%s)\n", te.ID, te.Name)
+	if te.Instance != "" {
+		fmt.Fprintf(tw, "Instance:\t%s\n", te.Instance)
+	}
+	fmt.Fprintf(tw, "Status:\t%s\n", te.Status)
+	fmt.Fprintf(tw, "Seed ratio mode:\t%s\n", te.SeedRatioMode)
+	fmt.Fprintf(tw, "Upload ratio:\t%.02f\n", te.UploadRatio)
+	fmt.Fprintf(tw, "Done date:\t%s\n", te.DoneDate.Format(time.RFC3339))
+	fmt.Fprintf(tw, "Seed time:\t%s\n", seedTime)
+	if te.LastUpload != nil {
+		fmt.Fprintf(tw, "Last upload:\t%s\n", te.LastUpload.Format(time.RFC3339))
+	}
+	fmt.Fprintf(tw, "Policy:\t%s\n", te.Policy)
+	fmt.Fprintf(tw, "Free seed end:\t%s (%s)\n", te.FreeSeedEnd.Format(time.RFC3339), freeSeed)
+	fmt.Fprintf(tw, "Target ratio:\t%.02f (%s)\n", te.TargetRatio, te.TargetRatioSource)
+	fmt.Fprintf(tw, "Action:\t%s\n", te.Decision.Action)
+	fmt.Fprintf(tw, "Reason:\t%s\n", te.Decision.Reason)
+	tw.Flush()
+}
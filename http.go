@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+const httpShutdownTimeout = 5 * time.Second
+
+func startHTTPServer() (server *http.Server) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", httpMetrics)
+	if currentConf().HTTP.APIToken != "" {
+		registerAPIHandlers(mux)
+	} else {
+		logger.Info("[HTTP] No API token set: the control API is disabled")
+	}
+	listen := currentConf().HTTP.Listen
+	server = &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		logger.Infof("[HTTP] Listening on %s", listen)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("[HTTP] Server failed: %v", err)
+		}
+	}()
+	return
+}
+
+func stopHTTPServer(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Errorf("[HTTP] Can't cleanly stop the server: %v", err)
+	}
+}
+
+func httpMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := metrics.WriteTo(w); err != nil {
+		logger.Debugf("[HTTP] Can't write metrics answer: %v", err)
+	}
+}
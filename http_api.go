@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func registerAPIHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/run", httpAuthenticated(httpRun))
+	mux.HandleFunc("/status", httpAuthenticated(httpStatus))
+	mux.HandleFunc("/torrents/", httpAuthenticated(httpTorrentExplain))
+	mux.HandleFunc("/history", httpAuthenticated(httpHistory))
+}
+
+func httpAuthenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// an empty token (cleared by a reload) disables the API until the restart unregisters it
+		expected := currentConf().HTTP.APIToken
+		header := r.Header.Get("Authorization")
+		if expected == "" || !strings.HasPrefix(header, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(expected)) != 1 {
+			logger.Warningf("[HTTP] Unauthorized API request from %s on %s", r.RemoteAddr, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			httpError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// POST /run[?dry_run=1]
+func httpRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, http.StatusMethodNotAllowed, "only POST is allowed")
+		return
+	}
+	dryRun := currentConf().Butler.DryRun
+	if value := r.URL.Query().Get("dry_run"); value != "" {
+		requested, err := strconv.ParseBool(value)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "dry_run value must be a boolean")
+			return
+		}
+		// the API can't disable a dry run enforced by configuration
+		dryRun = dryRun || requested
+	}
+	logger.Infof("[HTTP] Batch run requested by %s (dry run: %v)", r.RemoteAddr, dryRun)
+	// aborted on shutdown or once the client is gone
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-batchesContext.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	results := butlerBatches(ctx, dryRun)
+	updateSystemdStatus()
+	if results == nil {
+		httpError(w, http.StatusServiceUnavailable, "batches canceled before starting")
+		return
+	}
+	code := http.StatusOK
+	for _, result := range results {
+		if result.ErrorClass == rpcErrorCanceled {
+			code = http.StatusServiceUnavailable
+			break
+		}
+		if !result.Success {
+			code = http.StatusBadGateway
+		}
+	}
+	httpJSON(w, code, results)
+}
+
+type apiStatus struct {
+	NextRun   time.Time           `json:"next_run"`
+	DryRun    bool                `json:"dry_run"`
+	Instances []apiInstanceStatus `json:"instances"`
+}
+
+type apiInstanceStatus struct {
+	Name      string       `json:"name"`
+	DryRun    bool         `json:"dry_run"`
+	LastBatch *batchResult `json:"last_batch"`
+}
+
+// GET /status
+func httpStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "only GET is allowed")
+		return
+	}
+	current := currentInstances()
+	payload := apiStatus{
+		NextRun:   schedule.get(),
+		DryRun:    currentConf().Butler.DryRun,
+		Instances: make([]apiInstanceStatus, len(current)),
+	}
+	for index, inst := range current {
+		payload.Instances[index] = apiInstanceStatus{
+			Name:      inst.name,
+			DryRun:    inst.butler.DryRun,
+			LastBatch: inst.status.get(),
+		}
+	}
+	httpJSON(w, http.StatusOK, payload)
+}
+
+// GET /torrents/{id}/explain[?instance=name]
+func httpTorrentExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "only GET is allowed")
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/torrents/"), "/"), "/")
+	if len(parts) != 2 || parts[1] != "explain" {
+		httpError(w, http.StatusNotFound, "unknown endpoint")
+		return
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "torrent id must be an integer")
+		return
+	}
+	inst, err := findInstance(r.URL.Query().Get("instance"))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	torrent, err := inst.fetchTorrent(id)
+	if err != nil {
+		httpError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	explanation, err := inst.explainTorrent(torrent, time.Now())
+	if err != nil {
+		httpError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	httpJSON(w, http.StatusOK, explanation)
+}
+
+// GET /history[?instance=name]
+func httpHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "only GET is allowed")
+		return
+	}
+	if state == nil {
+		httpError(w, http.StatusNotFound, "no state file set: history is not available")
+		return
+	}
+	inst, err := findInstance(r.URL.Query().Get("instance"))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpJSON(w, http.StatusOK, state.history(inst.name))
+}
+
+func httpJSON(w http.ResponseWriter, code int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(payload); err != nil {
+		logger.Debugf("[HTTP] Can't write JSON answer: %v", err)
+	}
+}
+
+func httpError(w http.ResponseWriter, code int, message string) {
+	httpJSON(w, code, map[string]string{"error": message})
+}
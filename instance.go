@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hekmon/transmissionrpc"
+	systemd "github.com/iguanesolutions/go-systemd"
+)
+
+const (
+	startupWaitDelay    = 5 * time.Second
+	startupWaitMaxDelay = time.Minute
+)
+
+// instance is a transmission server managed by the butler
+type instance struct {
+	name          string
+	server        serverConfig
+	butler        *butlerConfig
+	client        transmissionClient
+	notifications *notificationDispatcher
+	status        *butlerStatus
+	log           instanceLogger
+	clock         func() time.Time
+	labels        map[int64][]string // torrents labels of the current batch, see withLabels()
+	retry         retryConfig        // RPC retries, startup wait and degraded server settings
+}
+
+// newInstance creates an instance using the given transmission client
+func newInstance(name string, butler *butlerConfig, client transmissionClient, nd *notificationDispatcher) *instance {
+	return &instance{
+		name:          name,
+		butler:        butler,
+		client:        client,
+		notifications: nd,
+		status:        new(butlerStatus),
+		log:           newInstanceLogger(name),
+		clock:         time.Now,
+	}
+}
+
+// withLabels returns a copy of the instance knowing the torrents labels: batches and explanations have their own
+func (inst *instance) withLabels(labels map[int64][]string) *instance {
+	copied := *inst
+	copied.labels = labels
+	return &copied
+}
+
+// withContext returns a copy of the instance for a batch: the retries of its RPC calls stop once ctx is done
+func (inst *instance) withContext(ctx context.Context) *instance {
+	copied := *inst
+	if rc, ok := inst.client.(*retryClient); ok {
+		copied.client = rc.withContext(ctx)
+	}
+	return &copied
+}
+
+// newInstances creates the instances of a configuration, reusing the clients and status of the previous ones when possible
+func newInstances(c *config, nd *notificationDispatcher, previous []*instance) (instances []*instance, err error) {
+	instances = make([]*instance, len(c.Servers))
+	for index, ic := range c.Servers {
+		inst := newInstance(ic.Name, &ic.Butler, nil, nd)
+		inst.server = ic.serverConfig
+		inst.retry = c.Retry
+		var client transmissionClient
+		for _, old := range previous {
+			if old.name != inst.name {
+				continue
+			}
+			inst.status = old.status
+			if rc, ok := old.client.(*retryClient); ok && old.server == inst.server {
+				client = rc.unwrap()
+			}
+			break
+		}
+		if client == nil {
+			if client, err = newTransmissionClient(inst.server); err != nil {
+				err = fmt.Errorf("can't initialize the transmission client of '%s': %v", inst.name, err)
+				return
+			}
+		}
+		inst.client = newRetryClient(client, inst.name, inst.log, c.Retry)
+		instances[index] = inst
+	}
+	return
+}
+
+// checkVersion returns false along with the RPC error if the server can't be reached, and an error if the remote
+// RPC version is incompatible
+func (inst *instance) checkVersion() (reachable bool, err error) {
+	ok, serverVersion, serverMinimumVersion, err := inst.client.RPCVersion()
+	if err != nil {
+		inst.log.Errorf("Can't check remote transmission RPC version: %v", err)
+		return
+	}
+	reachable = true
+	inst.status.setVersionChecked(ok)
+	if !ok {
+		err = fmt.Errorf("remote transmission RPC version (v%d) is incompatible with the transmission library (v%d): remote needs at least v%d",
+			serverVersion, transmissionrpc.RPCVersion, serverMinimumVersion)
+		return
+	}
+	inst.log.Infof("Remote transmission RPC version (v%d) is compatible with our transmissionrpc library (v%d)",
+		serverVersion, transmissionrpc.RPCVersion)
+	return
+}
+
+// waitServer checks the remote RPC version, waiting up to maxWait for the server to be reachable (or until ctx is done).
+// It returns an error if the server can't be used (yet).
+func (inst *instance) waitServer(ctx context.Context, maxWait time.Duration) (err error) {
+	inst = inst.withContext(ctx)
+	deadline := time.Now().Add(maxWait)
+	delay := startupWaitDelay
+	for attempt := 1; ; attempt++ {
+		if maxWait > 0 {
+			// a version check can take as long as all the retries of a call
+			if err = notifyExtendTimeout(inst.retry.callDuration() + delay); err != nil {
+				inst.log.Errorf("Can't extend the systemd startup timeout: %v", err)
+			}
+			if err = systemd.NotifyStatus(fmt.Sprintf("Waiting for the transmission server%s (attempt %d)", inst.logName(), attempt)); err != nil {
+				inst.log.Errorf("Can't send systemd status: %v", err)
+			}
+		}
+		// waiting won't fix a wrong password
+		var reachable bool
+		if reachable, err = inst.checkVersion(); reachable || maxWait <= 0 || !isRetryable(classifyRPCError(err)) {
+			return
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("waiting for the transmission server canceled: %v", err)
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("transmission server still unreachable after waiting %v: %v", maxWait, err)
+		}
+		inst.log.Warningf("Transmission server unreachable: next check in %v (attempt %d)", delay, attempt+1)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for the transmission server canceled: %v", err)
+		}
+		if delay *= 2; delay > startupWaitMaxDelay {
+			delay = startupWaitMaxDelay
+		}
+	}
+}
+
+// waitServers waits for every server concurrently, until ctx is done at the latest: the ones still unusable are left to
+// the version check of their batches
+func waitServers(ctx context.Context, insts []*instance, maxWait time.Duration) {
+	var wg sync.WaitGroup
+	wg.Add(len(insts))
+	for _, inst := range insts {
+		go func(inst *instance) {
+			defer wg.Done()
+			if err := inst.waitServer(ctx, maxWait); err != nil {
+				inst.log.Errorf("Can't use this transmission server for now, its batches will fail until it is fixed: %v", err)
+			}
+		}(inst)
+	}
+	wg.Wait()
+}
+
+// logName returns the instance name for the messages which are not tagged with it
+func (inst *instance) logName() string {
+	if inst.name == "" {
+		return ""
+	}
+	return fmt.Sprintf(" '%s'", inst.name)
+}
+
+// checkDegraded notifies once when the batches keep failing, then when they succeed again
+func (inst *instance) checkDegraded(result *batchResult) {
+	if result.ErrorClass == rpcErrorCanceled {
+		// not the server fault
+		return
+	}
+	failures := inst.status.recordBatch(result.Success)
+	if inst.retry.DegradedAfter <= 0 {
+		return
+	}
+	switch {
+	case !result.Success && failures == inst.retry.DegradedAfter:
+		inst.log.Errorf("Transmission server degraded: %d consecutive batches failed", failures)
+		inst.notify(notification{
+			Priority: priorityHigh,
+			Title:    "Transmission server degraded",
+			Message:  fmt.Sprintf("The last %d batches failed, last error (%s): %s", failures, result.ErrorClass, result.Error),
+			Event:    "degraded",
+		})
+	case result.Success && failures >= inst.retry.DegradedAfter:
+		inst.log.Infof("Transmission server recovered after %d failed batches", failures)
+		inst.notify(notification{
+			Priority: priorityNormal,
+			Title:    "Transmission server recovered",
+			Message:  fmt.Sprintf("Batches are successful again after %d failures", failures),
+			Event:    "degraded",
+		})
+	}
+}
+
+// notify tags the notification with the instance name before sending it
+func (inst *instance) notify(n notification) {
+	if inst.name != "" {
+		n.Instance = inst.name
+		n.Title = fmt.Sprintf("[%s] %s", inst.name, n.getTitle())
+	}
+	inst.notifications.Notify(n)
+}
+
+// currentInstances must be used to access the instances outside of a butler batch
+func currentInstances() []*instance {
+	defer confAccess.RUnlock()
+	confAccess.RLock()
+	return instances
+}
+
+func findInstance(name string) (inst *instance, err error) {
+	current := currentInstances()
+	if name == "" {
+		if len(current) != 1 {
+			err = fmt.Errorf("an instance name is needed as %d instances are configured", len(current))
+			return
+		}
+		return current[0], nil
+	}
+	for _, candidate := range current {
+		if candidate.name == name {
+			return candidate, nil
+		}
+	}
+	err = fmt.Errorf("unknown instance '%s'", name)
+	return
+}
+
+// butlerBatches runs a batch on every instance concurrently and waits for all of them, they are aborted once ctx is done
+func butlerBatches(ctx context.Context, dryRun bool) (results []*batchResult) {
+	// Only 1 run at a time !
+	logger.Debugf("[Butler] Waiting for butlerRun lock")
+	if !lockButlerRun(ctx) || ctx.Err() != nil {
+		logger.Infof("[Butler] Batches canceled before starting: %v", ctx.Err())
+		return
+	}
+	defer butlerRun.Unlock()
+	liveness.batchStarted()
+	defer func() { liveness.batchEnded(results) }()
+	// Run
+	current := currentInstances()
+	results = make([]*batchResult, len(current))
+	var wg sync.WaitGroup
+	wg.Add(len(current))
+	for index, inst := range current {
+		go func(index int, inst *instance) {
+			defer wg.Done()
+			results[index] = inst.batch(ctx, dryRun || inst.butler.DryRun)
+		}(index, inst)
+	}
+	wg.Wait()
+	// Persist the decisions
+	if err := state.save(); err != nil {
+		logger.Errorf("[Butler] Can't save the state: %v", err)
+	}
+	return
+}
+
+// lockButlerRun waits for butlerRun, it returns false (without the lock) if ctx is done first
+func lockButlerRun(ctx context.Context) bool {
+	locked := make(chan struct{})
+	go func() {
+		butlerRun.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return true
+	case <-ctx.Done():
+		// released as soon as it is acquired
+		go func() {
+			<-locked
+			butlerRun.Unlock()
+		}()
+		return false
+	}
+}
+
+// instanceLogger prefixes each line with the butler and instance tags
+type instanceLogger struct {
+	prefix string
+}
+
+func newInstanceLogger(name string) instanceLogger {
+	if name == "" {
+		return instanceLogger{prefix: "[Butler] "}
+	}
+	return instanceLogger{prefix: fmt.Sprintf("[Butler] [%s] ", name)}
+}
+
+func (il instanceLogger) IsDebugShown() bool {
+	return logger.IsDebugShown()
+}
+
+func (il instanceLogger) Debug(msg string) {
+	logger.Debug(il.prefix + msg)
+}
+
+func (il instanceLogger) Debugf(format string, args ...interface{}) {
+	logger.Debugf(il.prefix+format, args...)
+}
+
+func (il instanceLogger) Info(msg string) {
+	logger.Info(il.prefix + msg)
+}
+
+func (il instanceLogger) Infof(format string, args ...interface{}) {
+	logger.Infof(il.prefix+format, args...)
+}
+
+func (il instanceLogger) Warning(msg string) {
+	logger.Warning(il.prefix + msg)
+}
+
+func (il instanceLogger) Warningf(format string, args ...interface{}) {
+	logger.Warningf(il.prefix+format, args...)
+}
+
+func (il instanceLogger) Error(msg string) {
+	logger.Error(il.prefix + msg)
+}
+
+func (il instanceLogger) Errorf(format string, args ...interface{}) {
+	logger.Errorf(il.prefix+format, args...)
+}
+
+func (il instanceLogger) Fatalf(exitCode int, format string, args ...interface{}) {
+	logger.Fatalf(exitCode, il.prefix+format, args...)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/hekmon/transmissionrpc"
+)
+
+// TestFakeRPCServerBatch runs the real transmissionrpc client against the fake RPC server, from the startup check to a batch
+func TestFakeRPCServerBatch(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		password   string // the server expects "secret"
+		rpcMinimum int64
+		reachable  bool
+		waitError  bool
+		errorClass string
+	}{
+		{name: "compatible server", password: "secret", reachable: true},
+		{name: "wrong password", password: "wrong", waitError: true, errorClass: rpcErrorAuth},
+		{name: "incompatible version", password: "secret", rpcMinimum: transmissionrpc.RPCVersion + 1, reachable: true,
+			waitError: true, errorClass: rpcErrorVersion},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fixture, err := loadTransmissionFixture("testdata/fixture.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.rpcMinimum != 0 {
+				fixture.RPCVersion = tc.rpcMinimum
+				fixture.RPCVersionMinimum = tc.rpcMinimum
+			}
+			ft, err := newFakeTransmissionFromFixture(fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := newFakeRPCServer(ft, "butler", "secret")
+			defer server.Close()
+			serverJSON, err := json.Marshal(fakeRPCServerConfig(t, server, "butler", tc.password))
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := loadTestConfig(t, fmt.Sprintf(`{
+				"server": %s,
+				"butler": {"check_frequency_minutes": 60, "free_seed_days": 1, "target_ratio": 2},
+				"retry": {"retries": 0}
+			}`, serverJSON))
+			insts, err := newInstances(c, nil, nil)
+			if err != nil {
+				t.Fatalf("can't create the instances: %v", err)
+			}
+			inst := insts[0]
+			// Startup check
+			err = inst.waitServer(context.Background(), 0)
+			if (err != nil) != tc.waitError {
+				t.Fatalf("startup check error: %v, expected an error: %v", err, tc.waitError)
+			}
+			if classifyRPCError(err) == rpcErrorAuth && tc.errorClass != rpcErrorAuth {
+				t.Errorf("startup check failed with an auth error: %v", err)
+			}
+			if inst.status.isVersionChecked() != (tc.errorClass == "") {
+				t.Errorf("version checked: %v, expected %v", inst.status.isVersionChecked(), tc.errorClass == "")
+			}
+			// Batch
+			result := inst.batch(context.Background(), false)
+			if result.Success != (tc.errorClass == "") || result.ErrorClass != tc.errorClass {
+				t.Fatalf("batch success: %v (class '%s', error: %s), expected success: %v (class '%s')",
+					result.Success, result.ErrorClass, result.Error, tc.errorClass == "", tc.errorClass)
+			}
+			if !result.Success {
+				for _, method := range ft.getCalls() {
+					if method != "session-get" {
+						t.Errorf("'%s' was called by a failed batch", method)
+					}
+				}
+				return
+			}
+			if result.Torrents != len(fixture.Torrents) {
+				t.Errorf("batch fetched %d torrents, expected %d", result.Torrents, len(fixture.Torrents))
+			}
+			// the torrent-set went through the RPC protocol
+			for _, torrent := range ft.getTorrents() {
+				if *torrent.ID == 2 && *torrent.SeedRatioMode != transmissionrpc.SeedRatioModeGlobal {
+					t.Errorf("torrent 2 seed ratio mode is %s, expected global after its free seed period", torrent.SeedRatioMode)
+				}
+			}
+		})
+	}
+}
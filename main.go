@@ -1,118 +1,169 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"math/rand"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/hekmon/hllogger"
-	"github.com/hekmon/pushover"
-	"github.com/hekmon/transmissionrpc"
 	systemd "github.com/iguanesolutions/go-systemd"
 )
 
 var (
-	logger         *hllogger.HlLogger
-	transmission   *transmissionrpc.Client
-	conf           *config
-	pushoverClient *pushover.Controller
-	butlerRun      sync.Mutex
+	logger        *hllogger.HlLogger
+	conf          *config
+	instances     []*instance
+	notifications *notificationDispatcher
+	butlerRun     sync.Mutex
+	// batchesContext is canceled on shutdown to abort the running batches
+	batchesContext, cancelBatches = context.WithCancel(context.Background())
 )
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "explain":
+			os.Exit(explainCommand(os.Args[2:]))
+		case "simulate":
+			os.Exit(simulateCommand(os.Args[2:]))
+		case "snapshot":
+			os.Exit(snapshotCommand(os.Args[2:]))
+		}
+	}
+
 	// Parse flags
 	logLevelFlag := flag.Int("loglevel", 1, "Set loglevel: Debug(0) Info(1) Warning(2) Error(3) Fatal(4). Default Info.")
 	confFile := flag.String("conf", "config.json", "Relative or absolute path to the json configuration file")
+	dryRunFlag := flag.Bool("dry-run", false, "Plan every action without modifying anything on the transmission server (overrides the dry_run config value)")
+	snapshotFlag := flag.String("snapshot", "", "Run a single dry run batch reading the torrents and session values from a snapshot file instead of the transmission server, then exit")
 	flag.Parse()
 
-	// Init systemd controller
-	var err error
-	if !systemd.IsNotifyEnabled() {
-		logger.Warning("[Main] systemd not detected: systemd special features won't be available")
-	}
-
 	// Init logger
-	var ll hllogger.LogLevel
-	switch *logLevelFlag {
-	case 0:
-		ll = hllogger.Debug
-	case 1:
-		ll = hllogger.Info
-	case 2:
-		ll = hllogger.Warning
-	case 3:
-		ll = hllogger.Error
-	case 4:
-		ll = hllogger.Fatal
-	default:
-		ll = hllogger.Info
-	}
-	logger = hllogger.New(os.Stderr, &hllogger.Config{
-		LogLevel:              ll,
-		SystemdJournaldCompat: systemd.IsNotifyEnabled(),
-	})
+	logger = newLogger(*logLevelFlag)
 	logger.Output(" ")
 	logger.Output(" • Transmission Butler •")
 	logger.Output("      ヽ(　￣д￣)ノ")
 	logger.Output(" ")
 
+	// Init systemd controller
+	var err error
+	if !systemd.IsNotifyEnabled() && *snapshotFlag == "" {
+		logger.Warning("[Main] systemd not detected: systemd special features won't be available")
+	}
+
 	// Load config
 	logger.Info("[Main] Loading configuration")
-	if conf, err = getConfig(*confFile); err != nil {
+	confFilename = *confFile
+	confForceDryRun = *dryRunFlag
+	if conf, err = loadConfig(); err != nil {
 		logger.Fatalf(1, "can't load config: %v", err)
 	}
 	logger.Debugf("[Main] Loaded configuration:\n%+v", conf)
-
-	// Init pushover
-	pushoverClient = pushover.New(conf.Pushover.AppKey, conf.Pushover.UserKey, logger)
-	defer pushoverClient.SendHighPriorityMsg("Application is stopping...", "", "main stopping")
-
-	// Init transmission client
-	transmission, err = transmissionrpc.New(conf.Server.Host, conf.Server.User, conf.Server.Password,
-		&transmissionrpc.AdvancedConfig{
-			HTTPS:     conf.Server.HTTPS,
-			Port:      conf.Server.Port,
-			UserAgent: "github.com/hekmon/transmissionbutler",
-		})
-	if err != nil {
-		logger.Fatalf(2, "[Main] Can't initialize the transmission client: %v", err)
+	if conf.Butler.DryRun {
+		logger.Warning("[Main] Dry run mode enabled: the butler will only report what it would have done")
 	}
-	ok, serverVersion, serverMinimumVersion, err := transmission.RPCVersion()
-	if err != nil {
-		logger.Errorf("[Main] Can't check remote transmission RPC version: %v", err)
-	} else {
-		if ok {
-			logger.Infof("[Main] Remote transmission RPC version (v%d) is compatible with our transmissionrpc library (v%d)",
-				serverVersion, transmissionrpc.RPCVersion)
-		} else {
-			logger.Fatalf(2, "[Main] Remote transmission RPC version (v%d) is incompatible with the transmission library (v%d): remote needs at least v%d",
-				serverVersion, transmissionrpc.RPCVersion, serverMinimumVersion)
+
+	// Replay a snapshot instead of working on the live servers
+	if *snapshotFlag != "" {
+		if err = snapshotBatch(*snapshotFlag); err != nil {
+			logger.Fatalf(1, "[Main] Can't run the snapshot batch: %v", err)
 		}
+		return
 	}
 
-	// Start butler
-	stopSignal := make(chan struct{})
+	// Load the state
+	if state, err = loadStateStore(conf.StateFile); err != nil {
+		logger.Fatalf(1, "can't load state: %v", err)
+	}
+	if state == nil {
+		logger.Info("[Main] No state file set: the butler decisions won't be remembered")
+	}
+
+	// Init notifications
+	notifications = newNotificationDispatcher(conf)
+	defer notifications.Notify(notification{
+		Priority: priorityHigh,
+		Message:  "Application is stopping...",
+		Event:    "main stopping",
+	})
+
+	// Init transmission clients (with RPC retries jittered differently on each run)
+	rand.Seed(time.Now().UnixNano())
+	if instances, err = newInstances(conf, notifications, nil); err != nil {
+		logger.Fatalf(2, "[Main] Can't initialize the transmission instances: %v", err)
+	}
+
+	// Handles system signals properly (already while waiting for the servers)
 	var wg sync.WaitGroup
 	wg.Add(1)
-	logger.Info("[Main] Starting butler")
-	go butler(stopSignal, &wg)
-
-	// Handles system signals properly
 	var mainStop sync.Mutex
 	mainStop.Lock()
 	logger.Debug("[Main] Starting signal handling goroutine")
-	go handleSignals(stopSignal, &wg, &mainStop)
+	go handleSignals(&wg, &mainStop)
+	waitServers(batchesContext, instances, conf.Retry.StartupWait)
+	if batchesContext.Err() != nil {
+		// stopped while waiting: the butler never started
+		wg.Done()
+		mainStop.Lock()
+		logger.Info("[Main] Exiting")
+		return
+	}
+
+	// Start the HTTP server (metrics & control API)
+	if conf.HTTP.Listen != "" {
+		httpServer := startHTTPServer()
+		defer stopHTTPServer(httpServer)
+	}
+
+	// Watch the configuration file for changes
+	if conf.WatchConfig {
+		if err = watchConfig(); err != nil {
+			logger.Errorf("[Main] Can't watch the configuration file: %v", err)
+		}
+	}
+
+	// Start butler
+	beatInterval := startWatchdog()
+	logger.Info("[Main] Starting butler")
+	go butler(batchesContext, &wg, beatInterval)
 
 	// We are ready
 	if err = systemd.NotifyReady(); err != nil {
 		logger.Errorf("[Main] Can't send systemd ready notification: %v", err)
 	}
-	pushoverClient.SendLowPriorityMsg("Application is started ヽ(　￣д￣)ノ", "", "main")
+	notifications.Notify(notification{
+		Priority: priorityLow,
+		Message:  "Application is started ヽ(　￣д￣)ノ",
+		Event:    "main",
+	})
 
-	// Wait butler's clean stop before exiting main goroutine
+	// Wait butler's clean stop (or the shutdown deadline) before exiting main goroutine
 	mainStop.Lock()
-
-	// Lock the butler run in case the worker is done but not a forced run issued by USR1
-	butlerRun.Lock()
 	logger.Info("[Main] Exiting")
 }
+
+func newLogger(logLevel int) *hllogger.HlLogger {
+	var ll hllogger.LogLevel
+	switch logLevel {
+	case 0:
+		ll = hllogger.Debug
+	case 1:
+		ll = hllogger.Info
+	case 2:
+		ll = hllogger.Warning
+	case 3:
+		ll = hllogger.Error
+	case 4:
+		ll = hllogger.Fatal
+	default:
+		ll = hllogger.Info
+	}
+	return hllogger.New(os.Stderr, &hllogger.Config{
+		LogLevel:              ll,
+		SystemdJournaldCompat: systemd.IsNotifyEnabled(),
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hekmon/cunits/v2"
+	"github.com/hekmon/hllogger"
+	"github.com/hekmon/transmissionrpc"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// logs are only shown with -v
+	output, level := ioutil.Discard, hllogger.Fatal
+	if testing.Verbose() {
+		output, level = os.Stderr, hllogger.Debug
+	}
+	logger = hllogger.New(output, &hllogger.Config{LogLevel: level})
+	os.Exit(m.Run())
+}
+
+// loadTestConfig loads and validates a JSON configuration as the butler would, and sets it as the current one
+func loadTestConfig(t *testing.T, data string) *config {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "transmissionbutler")
+	if err != nil {
+		t.Fatalf("can't create temporary dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.json")
+	if err = ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatalf("can't write test config: %v", err)
+	}
+	c, err := getConfig(filename)
+	if err != nil {
+		t.Fatalf("can't load test config: %v", err)
+	}
+	confAccess.Lock()
+	conf = c
+	confAccess.Unlock()
+	return c
+}
+
+// testNow is the clock of the test instances
+var testNow = time.Date(2026, 6, 15, 12, 0, 0, 0, time.Local)
+
+// newTestInstance returns an instance working on a fake transmission holding torrents, with the given butler config values
+// added to a 60 minutes check frequency. The state store is only set by useTestState.
+func newTestInstance(t *testing.T, butler string, torrents ...*transmissionrpc.Torrent) (inst *instance, ft *fakeTransmission) {
+	t.Helper()
+	if butler != "" {
+		butler = ", " + butler
+	}
+	c := loadTestConfig(t, fmt.Sprintf(`{
+		"server": {"host": "127.0.0.1", "port": 9091},
+		"butler": {"check_frequency_minutes": 60%s},
+		"retry": {"retries": 0},
+		"state_file": "unused.json"
+	}`, butler))
+	ft = newFakeTransmission(torrents, 100*cunits.GiB)
+	ft.session.SeedRatioLimit = &c.Servers[0].Butler.TargetRatio
+	inst = newInstance("", &c.Servers[0].Butler, ft, nil)
+	inst.clock = func() time.Time { return testNow }
+	return
+}
+
+// useTestState sets an empty state store as the current one, the returned function restores the stateless butler
+func useTestState(t *testing.T) (restore func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "transmissionbutler")
+	if err != nil {
+		t.Fatalf("can't create temporary dir: %v", err)
+	}
+	if state, err = loadStateStore(filepath.Join(dir, "state.json")); err != nil {
+		t.Fatalf("can't load test state: %v", err)
+	}
+	return func() {
+		state = nil
+		os.RemoveAll(dir)
+	}
+}
+
+// testTorrent describes a torrent relatively to testNow
+type testTorrent struct {
+	id      int64
+	name    string
+	status  transmissionrpc.TorrentStatus
+	done    time.Duration // ago, 0 if not finished
+	mode    transmissionrpc.SeedRatioMode
+	limit   float64
+	ratio   float64
+	seeding time.Duration
+	size    cunits.Bits
+	tracker string
+	dir     string
+	rate    int64
+	active  time.Duration // ago, 0 for done
+}
+
+func (tt testTorrent) build() *transmissionrpc.Torrent {
+	name := tt.name
+	if name == "" {
+		name = fmt.Sprintf("torrent %d", tt.id)
+	}
+	hash := fmt.Sprintf("%040x", tt.id)
+	doneDate := time.Unix(0, 0)
+	if tt.done > 0 {
+		doneDate = testNow.Add(-tt.done)
+	}
+	activityDate := doneDate
+	if tt.active > 0 {
+		activityDate = testNow.Add(-tt.active)
+	}
+	size := tt.size
+	if size == 0 {
+		size = cunits.GiB
+	}
+	dir := tt.dir
+	if dir == "" {
+		dir = "/data"
+	}
+	tracker := tt.tracker
+	if tracker == "" {
+		tracker = "tracker.example.org"
+	}
+	uploaded := int64(tt.ratio * size.Byte())
+	torrent := &transmissionrpc.Torrent{
+		ID:             &tt.id,
+		Name:           &name,
+		HashString:     &hash,
+		Status:         &tt.status,
+		DoneDate:       &doneDate,
+		ActivityDate:   &activityDate,
+		SeedRatioMode:  &tt.mode,
+		SeedRatioLimit: &tt.limit,
+		UploadRatio:    &tt.ratio,
+		UploadedEver:   &uploaded,
+		SecondsSeeding: &tt.seeding,
+		TotalSize:      &size,
+		DownloadDir:    &dir,
+		RateUpload:     &tt.rate,
+		Trackers:       []*transmissionrpc.Tracker{{Announce: fmt.Sprintf("http://%s/announce", tracker)}},
+	}
+	return torrent
+}
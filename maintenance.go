@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	Maintenance windows: times of the day during which an action is allowed,
+	its candidates are postponed to a later batch outside of them.
+*/
+
+// windowGroups are shortcuts for several actions, an action set on its own takes precedence
+var windowGroups = map[string][]string{
+	"deletions":      {actionDelete, actionIdle, actionEvict, actionPurge},
+	"ratio_switches": {actionFreeSeed, actionGlobalRatio, actionCustomRatio, actionPolicyRatio},
+}
+
+var windowActions = []string{actionFreeSeed, actionGlobalRatio, actionCustomRatio, actionPolicyRatio, actionDelete, actionIdle,
+	actionEvict, actionPurge, actionStop, actionMove}
+
+// timeWindow is a range of the day in minutes, it ends the next day if end is before start
+type timeWindow struct {
+	start, end int
+}
+
+func (tw timeWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", tw.start/60, tw.start%60, tw.end/60, tw.end%60)
+}
+
+func parseTimeWindow(raw string) (tw timeWindow, err error) {
+	bounds := strings.Split(strings.TrimSpace(raw), "-")
+	if len(bounds) != 2 {
+		return tw, fmt.Errorf("window '%s' must be formatted as 'HH:MM-HH:MM'", raw)
+	}
+	for index, bound := range bounds {
+		parsed, parseErr := time.Parse("15:04", strings.TrimSpace(bound))
+		if parseErr != nil {
+			return tw, fmt.Errorf("window '%s' must be formatted as 'HH:MM-HH:MM': invalid time '%s'", raw, bound)
+		}
+		if index == 0 {
+			tw.start = parsed.Hour()*60 + parsed.Minute()
+		} else {
+			tw.end = parsed.Hour()*60 + parsed.Minute()
+		}
+	}
+	if tw.start == tw.end {
+		return tw, fmt.Errorf("window '%s' is empty", raw)
+	}
+	return
+}
+
+func (tw timeWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if tw.start < tw.end {
+		return minute >= tw.start && minute < tw.end
+	}
+	return minute >= tw.start || minute < tw.end
+}
+
+// nextOpening returns the next time the window opens after t
+func (tw timeWindow) nextOpening(t time.Time) time.Time {
+	opening := time.Date(t.Year(), t.Month(), t.Day(), tw.start/60, tw.start%60, 0, 0, t.Location())
+	if !opening.After(t) {
+		opening = opening.AddDate(0, 0, 1)
+	}
+	return opening
+}
+
+// compileWindows validates the windows config and expands the groups, by action
+func compileWindows(raw map[string][]string) (windows map[string][]timeWindow, err error) {
+	if len(raw) == 0 {
+		return
+	}
+	windows = make(map[string][]timeWindow, len(windowActions))
+	// groups first: actions set on their own override them
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		_, iGroup := windowGroups[keys[i]]
+		_, jGroup := windowGroups[keys[j]]
+		return iGroup && !jGroup
+	})
+	for _, key := range keys {
+		actions, isGroup := windowGroups[key]
+		if !isGroup {
+			valid := false
+			for _, action := range windowActions {
+				if key == action {
+					valid = true
+					break
+				}
+			}
+			if !valid {
+				return nil, fmt.Errorf("windows: unknown action '%s': valid values are 'deletions', 'ratio_switches', '%s'",
+					key, strings.Join(windowActions, "', '"))
+			}
+			actions = []string{key}
+		}
+		if len(raw[key]) == 0 {
+			return nil, fmt.Errorf("windows: '%s' needs at least one window (remove it to allow it any time)", key)
+		}
+		parsed := make([]timeWindow, len(raw[key]))
+		for index, window := range raw[key] {
+			if parsed[index], err = parseTimeWindow(window); err != nil {
+				return nil, fmt.Errorf("windows: %s: %v", key, err)
+			}
+		}
+		for _, action := range actions {
+			windows[action] = parsed
+		}
+	}
+	return
+}
+
+// getActionWindow tells if an action is allowed at t, and if not when it will be
+func (bc *butlerConfig) getActionWindow(action string, t time.Time) (allowed bool, nextOpening time.Time, windows []timeWindow) {
+	windows, restricted := bc.windows[action]
+	if !restricted {
+		return true, t, nil
+	}
+	for _, window := range windows {
+		if window.contains(t) {
+			return true, t, windows
+		}
+		if opening := window.nextOpening(t); nextOpening.IsZero() || opening.Before(nextOpening) {
+			nextOpening = opening
+		}
+	}
+	return
+}
+
+// postpone returns true when an action is outside its maintenance windows: its candidates are left for a later batch
+func (inst *instance) postpone(action string, candidates int, result *batchResult) bool {
+	if candidates == 0 {
+		return false
+	}
+	allowed, nextOpening, windows := inst.butler.getActionWindow(action, inst.clock())
+	if allowed {
+		return false
+	}
+	windowList := make([]string, len(windows))
+	for index, window := range windows {
+		windowList[index] = window.String()
+	}
+	inst.log.Infof("Postponing %d %s candidate(s) until %v: outside of the %s maintenance window(s)", candidates, action,
+		nextOpening.Format("2006-01-02 15:04"), strings.Join(windowList, ", "))
+	result.Postponed[action] += candidates
+	if result.nextWindow.IsZero() || nextOpening.Before(result.nextWindow) {
+		result.nextWindow = nextOpening
+		result.nextWindowAction = action
+	}
+	return true
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hekmon/cunits/v2"
+	"github.com/hekmon/transmissionrpc"
+)
+
+/*
+	Minimal registry rendering the prometheus text exposition format
+	https://prometheus.io/docs/instrumenting/exposition_formats/
+*/
+
+const (
+	metricTypeCounter = "counter"
+	metricTypeGauge   = "gauge"
+)
+
+type metricFamily struct {
+	help   string
+	kind   string
+	values map[string]float64 // key is the rendered label set
+}
+
+type metricsRegistry struct {
+	access   sync.Mutex
+	families map[string]*metricFamily
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		families: make(map[string]*metricFamily),
+	}
+}
+
+func (mr *metricsRegistry) register(name, kind, help string) {
+	defer mr.access.Unlock()
+	mr.access.Lock()
+	mr.families[name] = &metricFamily{
+		help:   help,
+		kind:   kind,
+		values: make(map[string]float64),
+	}
+}
+
+// set sets the value of a metric, labels are given as key/value pairs
+func (mr *metricsRegistry) set(name string, value float64, labels ...string) {
+	defer mr.access.Unlock()
+	mr.access.Lock()
+	if family, found := mr.families[name]; found {
+		family.values[renderLabels(labels)] = value
+	}
+}
+
+// add adds value to a metric, labels are given as key/value pairs
+func (mr *metricsRegistry) add(name string, value float64, labels ...string) {
+	defer mr.access.Unlock()
+	mr.access.Lock()
+	if family, found := mr.families[name]; found {
+		family.values[renderLabels(labels)] += value
+	}
+}
+
+// reset removes the label sets of a metric starting with the given key/value pairs (all of them if none is given)
+func (mr *metricsRegistry) reset(name string, labels ...string) {
+	defer mr.access.Unlock()
+	mr.access.Lock()
+	family, found := mr.families[name]
+	if !found {
+		return
+	}
+	if len(labels) < 2 {
+		family.values = make(map[string]float64)
+		return
+	}
+	prefix := strings.TrimSuffix(renderLabels(labels), "}")
+	for labelSet := range family.values {
+		if labelSet == prefix+"}" || strings.HasPrefix(labelSet, prefix+",") {
+			delete(family.values, labelSet)
+		}
+	}
+}
+
+func (mr *metricsRegistry) WriteTo(w io.Writer) (n int64, err error) {
+	defer mr.access.Unlock()
+	mr.access.Lock()
+	names := make([]string, 0, len(mr.families))
+	for name := range mr.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var builder strings.Builder
+	for _, name := range names {
+		family := mr.families[name]
+		if len(family.values) == 0 {
+			continue
+		}
+		fmt.Fprintf(&builder, "# HELP %s %s\n# TYPE %s %s\n", name, family.help, name, family.kind)
+		labelSets := make([]string, 0, len(family.values))
+		for labelSet := range family.values {
+			labelSets = append(labelSets, labelSet)
+		}
+		sort.Strings(labelSets)
+		for _, labelSet := range labelSets {
+			fmt.Fprintf(&builder, "%s%s %s\n", name, labelSet, strconv.FormatFloat(family.values[labelSet], 'g', -1, 64))
+		}
+	}
+	written, err := io.WriteString(w, builder.String())
+	return int64(written), err
+}
+
+func renderLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for index := 0; index+1 < len(labels); index += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[index], labelValueEscaper.Replace(labels[index+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// toMetricLabelValue turns a human readable value into a snake case one ("can't find peers" => "cant_find_peers")
+func toMetricLabelValue(value string) string {
+	return strings.Replace(strings.Replace(strings.Trim(value, "<>"), "'", "", -1), " ", "_", -1)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+/*
+	Butler metrics
+*/
+
+const (
+	metricTorrents            = "transmissionbutler_torrents"
+	metricBatchActions        = "transmissionbutler_batch_actions"
+	metricActionsTotal        = "transmissionbutler_actions_total"
+	metricBatchDuration       = "transmissionbutler_batch_duration_seconds"
+	metricBatchesTotal        = "transmissionbutler_batches_total"
+	metricLastSuccessfulBatch = "transmissionbutler_last_successful_batch_timestamp_seconds"
+	metricRPCErrorsTotal      = "transmissionbutler_rpc_errors_total"
+	metricRPCRetriesTotal     = "transmissionbutler_rpc_retries_total"
+	metricFreeSpace           = "transmissionbutler_download_dir_free_space_bytes"
+)
+
+const (
+	actionNone        = "none"
+	actionFreeSeed    = "free_seed"
+	actionGlobalRatio = "global_ratio"
+	actionCustomRatio = "custom_ratio"
+	actionPolicyRatio = "policy_ratio"
+	actionDelete      = "delete"
+	actionEvict       = "evict"
+	actionQuarantine  = "quarantine"
+	actionPurge       = "purge"
+	actionProtected   = "protected"
+	actionStop        = "stop"
+	actionMove        = "move"
+	actionIdle        = "idle"
+)
+
+type butlerMetrics struct {
+	*metricsRegistry
+}
+
+var metrics = newButlerMetrics()
+
+func newButlerMetrics() (bm *butlerMetrics) {
+	bm = &butlerMetrics{
+		metricsRegistry: newMetricsRegistry(),
+	}
+	bm.register(metricTorrents, metricTypeGauge, "Number of torrents by status and seed ratio mode during the last batch.")
+	bm.register(metricBatchActions, metricTypeGauge, "Number of torrents handled by action during the last batch.")
+	bm.register(metricActionsTotal, metricTypeCounter, "Total number of torrents handled by action.")
+	bm.register(metricBatchDuration, metricTypeGauge, "Duration of the last batch.")
+	bm.register(metricBatchesTotal, metricTypeCounter, "Total number of batches by result.")
+	bm.register(metricLastSuccessfulBatch, metricTypeGauge, "Unix timestamp of the end of the last successful batch.")
+	bm.register(metricRPCErrorsTotal, metricTypeCounter, "Total number of transmission RPC errors by method.")
+	bm.register(metricRPCRetriesTotal, metricTypeCounter, "Total number of retried transmission RPC calls by method and error class.")
+	bm.register(metricFreeSpace, metricTypeGauge, "Free space available in the transmission download dir.")
+	return
+}
+
+func (bm *butlerMetrics) rpcError(instance, method string) {
+	bm.add(metricRPCErrorsTotal, 1, "instance", instance, "method", method)
+}
+
+func (bm *butlerMetrics) rpcRetry(instance, method, class string) {
+	bm.add(metricRPCRetriesTotal, 1, "instance", instance, "method", method, "class", class)
+}
+
+func (bm *butlerMetrics) freeSpace(instance string, freeSpace cunits.Bits) {
+	bm.set(metricFreeSpace, freeSpace.Byte(), "instance", instance)
+}
+
+func (bm *butlerMetrics) torrents(instance string, torrents []*transmissionrpc.Torrent) {
+	counts := make(map[[2]string]float64)
+	for _, torrent := range torrents {
+		if torrent == nil || torrent.Status == nil || torrent.SeedRatioMode == nil {
+			continue
+		}
+		counts[[2]string{toMetricLabelValue(torrent.Status.String()), toMetricLabelValue(torrent.SeedRatioMode.String())}]++
+	}
+	bm.reset(metricTorrents, "instance", instance)
+	for labels, count := range counts {
+		bm.set(metricTorrents, count, "instance", instance, "status", labels[0], "seed_ratio_mode", labels[1])
+	}
+}
+
+func (bm *butlerMetrics) batch(result *batchResult) {
+	bm.set(metricBatchDuration, result.Duration.Seconds(), "instance", result.Instance)
+	if !result.Success {
+		bm.add(metricBatchesTotal, 1, "instance", result.Instance, "result", "failure")
+		return
+	}
+	bm.add(metricBatchesTotal, 1, "instance", result.Instance, "result", "success")
+	bm.set(metricLastSuccessfulBatch, float64(result.Start.Add(result.Duration).Unix()), "instance", result.Instance)
+	if result.DryRun {
+		// nothing was actually done
+		return
+	}
+	for action, count := range result.Actions {
+		bm.set(metricBatchActions, float64(count), "instance", result.Instance, "action", action)
+		bm.add(metricActionsTotal, float64(count), "instance", result.Instance, "action", action)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	notificationDefaultTitle = "Transmission Butler"
+	notificationHTTPTimeout  = 10 * time.Second
+	notificationSMTPTimeout  = 30 * time.Second // dial then whole session
+)
+
+type notificationPriority int
+
+const (
+	priorityLow notificationPriority = iota
+	priorityNormal
+	priorityHigh
+)
+
+func (np notificationPriority) String() string {
+	switch np {
+	case priorityLow:
+		return "low"
+	case priorityNormal:
+		return "normal"
+	case priorityHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("unknown (%d)", np)
+	}
+}
+
+func (np notificationPriority) MarshalJSON() ([]byte, error) {
+	return json.Marshal(np.String())
+}
+
+// notification is a structured event emitted by the butler to every enabled backend
+type notification struct {
+	Priority notificationPriority `json:"priority"`
+	Title    string               `json:"title"`
+	Message  string               `json:"message"`
+	Event    string               `json:"event"`
+	Instance string               `json:"instance,omitempty"`
+	Torrents []string             `json:"torrents,omitempty"`
+	Time     time.Time            `json:"time"`
+}
+
+func (n *notification) getTitle() string {
+	if n.Title == "" {
+		return notificationDefaultTitle
+	}
+	return n.Title
+}
+
+// notifier is a notification backend
+type notifier interface {
+	Name() string
+	Send(n *notification) error
+}
+
+// notificationDispatcher fans out each notification to all the enabled backends
+type notificationDispatcher struct {
+	backends []notifier
+}
+
+func newNotificationDispatcher(c *config) (nd *notificationDispatcher) {
+	nd = new(notificationDispatcher)
+	httpClient := &http.Client{Timeout: notificationHTTPTimeout}
+	if c.isPushoverEnabled() {
+		nd.backends = append(nd.backends, newPushoverNotifier(c.Pushover))
+	}
+	if c.Notifications.Webhook != nil {
+		nd.backends = append(nd.backends, newWebhookNotifier(c.Notifications.Webhook, httpClient))
+	}
+	if c.Notifications.SMTP != nil {
+		nd.backends = append(nd.backends, newSMTPNotifier(c.Notifications.SMTP))
+	}
+	if c.Notifications.Ntfy != nil {
+		nd.backends = append(nd.backends, newNtfyNotifier(c.Notifications.Ntfy, httpClient))
+	}
+	if c.Notifications.Gotify != nil {
+		nd.backends = append(nd.backends, newGotifyNotifier(c.Notifications.Gotify, httpClient))
+	}
+	return
+}
+
+// Notify sends the notification to every backend concurrently and waits for all of them
+func (nd *notificationDispatcher) Notify(n notification) {
+	if nd == nil || len(nd.backends) == 0 {
+		logger.Debugf("[Notifier] %s: no notification backend enabled: '%s' won't be sent", n.Event, n.getTitle())
+		return
+	}
+	if n.Time.IsZero() {
+		n.Time = time.Now()
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(nd.backends))
+	for _, backend := range nd.backends {
+		go func(backend notifier) {
+			defer wg.Done()
+			if err := backend.Send(&n); err != nil {
+				logger.Errorf("[Notifier] %s: can't send notification with %s: %v", n.Event, backend.Name(), err)
+			} else {
+				logger.Debugf("[Notifier] %s: notification sent with %s", n.Event, backend.Name())
+			}
+		}(backend)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/*
+	ntfy
+*/
+
+type ntfyNotifier struct {
+	conf       *ntfyConfig
+	httpClient *http.Client
+}
+
+func newNtfyNotifier(c *ntfyConfig, httpClient *http.Client) *ntfyNotifier {
+	return &ntfyNotifier{
+		conf:       c,
+		httpClient: httpClient,
+	}
+}
+
+func (nn *ntfyNotifier) Name() string {
+	return "ntfy"
+}
+
+// Send publishes the notification to the configured ntfy topic URL
+// https://docs.ntfy.sh/publish/
+func (nn *ntfyNotifier) Send(n *notification) (err error) {
+	req, err := http.NewRequest(http.MethodPost, nn.conf.URL, strings.NewReader(n.Message))
+	if err != nil {
+		return fmt.Errorf("can't prepare request: %v", err)
+	}
+	req.Header.Set("Title", n.getTitle())
+	req.Header.Set("Tags", strings.Replace(n.Event, " ", "_", -1))
+	switch n.Priority {
+	case priorityLow:
+		req.Header.Set("Priority", "2")
+	case priorityHigh:
+		req.Header.Set("Priority", "4")
+	default:
+		req.Header.Set("Priority", "3")
+	}
+	if nn.conf.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+nn.conf.Token)
+	}
+	return sendNotificationRequest(nn.httpClient, req)
+}
+
+/*
+	Gotify
+*/
+
+type gotifyNotifier struct {
+	conf       *gotifyConfig
+	httpClient *http.Client
+}
+
+func newGotifyNotifier(c *gotifyConfig, httpClient *http.Client) *gotifyNotifier {
+	return &gotifyNotifier{
+		conf:       c,
+		httpClient: httpClient,
+	}
+}
+
+func (gn *gotifyNotifier) Name() string {
+	return "gotify"
+}
+
+type gotifyMessage struct {
+	Title    string `json:"title"`
+	Message  string `json:"message"`
+	Priority int    `json:"priority"`
+}
+
+// Send creates a message on the configured gotify server with the application token
+// https://gotify.net/api-docs#/message/createMessage
+func (gn *gotifyNotifier) Send(n *notification) (err error) {
+	msg := gotifyMessage{
+		Title:   n.getTitle(),
+		Message: n.Message,
+	}
+	switch n.Priority {
+	case priorityLow:
+		msg.Priority = 2
+	case priorityHigh:
+		msg.Priority = 8
+	default:
+		msg.Priority = 5
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("can't marshal message as JSON: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(gn.conf.URL, "/")+"/message", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("can't prepare request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", gn.conf.Token)
+	return sendNotificationRequest(gn.httpClient, req)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/hekmon/pushover"
+)
+
+type pushoverNotifier struct {
+	client *pushover.Controller
+}
+
+func newPushoverNotifier(c pushoverConfig) *pushoverNotifier {
+	return &pushoverNotifier{
+		client: pushover.New(c.AppKey, c.UserKey, logger),
+	}
+}
+
+func (pn *pushoverNotifier) Name() string {
+	return "pushover"
+}
+
+// Send relies on the pushover controller which logs its own errors
+func (pn *pushoverNotifier) Send(n *notification) error {
+	switch n.Priority {
+	case priorityLow:
+		pn.client.SendLowPriorityMsg(n.Message, n.Title, n.Event)
+	case priorityHigh:
+		pn.client.SendHighPriorityMsg(n.Message, n.Title, n.Event)
+	default:
+		pn.client.SendNormalPriorityMsg(n.Message, n.Title, n.Event)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type smtpNotifier struct {
+	conf *smtpConfig
+}
+
+func newSMTPNotifier(c *smtpConfig) *smtpNotifier {
+	return &smtpNotifier{
+		conf: c,
+	}
+}
+
+func (sn *smtpNotifier) Name() string {
+	return "smtp"
+}
+
+// Send emails the notification to the configured recipients
+func (sn *smtpNotifier) Send(n *notification) (err error) {
+	addr := net.JoinHostPort(sn.conf.Host, strconv.Itoa(int(sn.conf.Port)))
+	var auth smtp.Auth
+	if sn.conf.User != "" {
+		auth = smtp.PlainAuth("", sn.conf.User, sn.conf.Password, sn.conf.Host)
+	}
+	msg := sn.buildMessage(n)
+	dialer := &net.Dialer{Timeout: notificationSMTPTimeout}
+	var conn net.Conn
+	if sn.conf.TLS {
+		// Implicit TLS (usually port 465)
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: sn.conf.Host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("can't connect to '%s': %v", addr, err)
+	}
+	// the whole session is bounded: notifications are sent from the batches
+	if err = conn.SetDeadline(time.Now().Add(notificationSMTPTimeout)); err != nil {
+		conn.Close()
+		return fmt.Errorf("can't set the connection deadline: %v", err)
+	}
+	client, err := smtp.NewClient(conn, sn.conf.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("can't initialize SMTP session: %v", err)
+	}
+	defer client.Close()
+	if !sn.conf.TLS {
+		// STARTTLS is used if the server supports it
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err = client.StartTLS(&tls.Config{ServerName: sn.conf.Host}); err != nil {
+				return fmt.Errorf("STARTTLS failed: %v", err)
+			}
+		}
+	}
+	if auth != nil {
+		if err = client.Auth(auth); err != nil {
+			return fmt.Errorf("authentication failed: %v", err)
+		}
+	}
+	if err = client.Mail(sn.conf.From); err != nil {
+		return fmt.Errorf("MAIL FROM failed: %v", err)
+	}
+	for _, rcpt := range sn.conf.To {
+		if err = client.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("RCPT TO '%s' failed: %v", rcpt, err)
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("DATA failed: %v", err)
+	}
+	if _, err = writer.Write(msg); err != nil {
+		writer.Close()
+		return fmt.Errorf("can't write message: %v", err)
+	}
+	if err = writer.Close(); err != nil {
+		return fmt.Errorf("can't finalize message: %v", err)
+	}
+	return client.Quit()
+}
+
+func (sn *smtpNotifier) buildMessage(n *notification) []byte {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "From: %s\r\n", sn.conf.From)
+	fmt.Fprintf(&buffer, "To: %s\r\n", strings.Join(sn.conf.To, ", "))
+	fmt.Fprintf(&buffer, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", fmt.Sprintf("[%s] %s", notificationDefaultTitle, n.getTitle())))
+	fmt.Fprintf(&buffer, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	if n.Priority == priorityHigh {
+		buffer.WriteString("X-Priority: 1\r\nImportance: high\r\n")
+	}
+	buffer.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	buffer.WriteString(strings.Replace(n.Message, "\n", "\r\n", -1))
+	buffer.WriteString("\r\n")
+	return buffer.Bytes()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+type webhookNotifier struct {
+	conf       *webhookConfig
+	httpClient *http.Client
+}
+
+func newWebhookNotifier(c *webhookConfig, httpClient *http.Client) *webhookNotifier {
+	return &webhookNotifier{
+		conf:       c,
+		httpClient: httpClient,
+	}
+}
+
+func (wn *webhookNotifier) Name() string {
+	return "webhook"
+}
+
+// Send POSTs the notification as JSON to the configured URL
+func (wn *webhookNotifier) Send(n *notification) (err error) {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("can't marshal notification as JSON: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, wn.conf.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("can't prepare request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range wn.conf.Headers {
+		req.Header.Set(key, value)
+	}
+	return sendNotificationRequest(wn.httpClient, req)
+}
+
+func sendNotificationRequest(httpClient *http.Client, req *http.Request) (err error) {
+	req.Header.Set("User-Agent", "github.com/hekmon/transmissionbutler")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP error %d: %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	return
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hekmon/cunits/v2"
+	"github.com/hekmon/transmissionrpc"
+)
+
+/*
+	Quarantine: the data of the deleted torrents is moved to a trash dir by transmission
+	and purged by the butler later on. The trash dir must be reachable by the butler at the same path.
+*/
+
+const quarantineManifestName = "manifest.json"
+
+// quarantineAccess serializes the manifests changes, several instances can share a trash dir
+var quarantineAccess sync.Mutex
+
+type quarantineManifest struct {
+	Entries []*quarantineEntry `json:"entries"`
+}
+
+type quarantineEntry struct {
+	Time        time.Time `json:"time"`
+	Instance    string    `json:"instance,omitempty"`
+	Hash        string    `json:"hash"`
+	Name        string    `json:"name"`
+	Path        string    `json:"path"`
+	Size        int64     `json:"size_bytes"`
+	UploadRatio float64   `json:"upload_ratio"`
+}
+
+// loadQuarantineManifest reads the manifest of a trash dir (a missing manifest is an empty one), quarantineAccess must be held
+func loadQuarantineManifest(dir string) (manifest *quarantineManifest, err error) {
+	manifest = new(quarantineManifest)
+	data, err := ioutil.ReadFile(filepath.Join(dir, quarantineManifestName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		} else {
+			err = fmt.Errorf("can't read quarantine manifest: %v", err)
+		}
+		return
+	}
+	if err = json.Unmarshal(data, manifest); err != nil {
+		err = fmt.Errorf("can't decode quarantine manifest: %v", err)
+	}
+	return
+}
+
+// save writes the manifest in its trash dir, quarantineAccess must be held
+func (qm *quarantineManifest) save(dir string) (err error) {
+	data, err := json.MarshalIndent(qm, "", "    ")
+	if err != nil {
+		return fmt.Errorf("can't encode quarantine manifest: %v", err)
+	}
+	if err = writeFileAtomic(filepath.Join(dir, quarantineManifestName), data); err != nil {
+		return fmt.Errorf("can't write quarantine manifest: %v", err)
+	}
+	return
+}
+
+// getQuarantineLocation returns the trash sub dir of a torrent, named after its hash to avoid collisions
+func getQuarantineLocation(dir, hash string) (location string, err error) {
+	if hash == "" || strings.Trim(hash, "0123456789abcdefABCDEF") != "" {
+		return "", fmt.Errorf("invalid torrent hash '%s'", hash)
+	}
+	return filepath.Join(dir, hash), nil
+}
+
+// quarantineTorrents moves the torrents data to the trash dir then removes them from transmission.
+// quarantined contains the torrents removed from transmission, even if err is not nil.
+// Once ctx is done no more torrents are moved, the moved ones are still removed.
+func (inst *instance) quarantineTorrents(ctx context.Context, torrents []*transmissionrpc.Torrent) (quarantined []*transmissionrpc.Torrent, err error) {
+	dir := inst.butler.Quarantine.Dir
+	defer quarantineAccess.Unlock()
+	quarantineAccess.Lock()
+	// Nothing is done if the manifest can't be read: quarantined data must always be accounted
+	manifest, err := loadQuarantineManifest(dir)
+	if err != nil {
+		return
+	}
+	// Move the data
+	moved := make([]*transmissionrpc.Torrent, 0, len(torrents))
+	locations := make([]string, 0, len(torrents))
+	for _, torrent := range torrents {
+		if ctx.Err() != nil {
+			break
+		}
+		var hash string
+		if torrent.HashString != nil {
+			hash = *torrent.HashString
+		}
+		location, locErr := getQuarantineLocation(dir, hash)
+		if locErr != nil {
+			inst.log.Errorf("Can't quarantine torrent id %d (%s): %v", *torrent.ID, *torrent.Name, locErr)
+			continue
+		}
+		if moveErr := inst.client.TorrentSetLocation(*torrent.ID, location, true); moveErr != nil {
+			metrics.rpcError(inst.name, "torrent-set-location")
+			inst.log.Errorf("Can't move torrent id %d (%s) to the quarantine dir: %v", *torrent.ID, *torrent.Name, moveErr)
+			continue
+		}
+		moved = append(moved, torrent)
+		locations = append(locations, location)
+	}
+	if len(moved) == 0 {
+		err = fmt.Errorf("no torrent could be moved to '%s'", dir)
+		return
+	}
+	// Remove the torrents, keeping their data
+	IDList := make([]int64, len(moved))
+	for index, torrent := range moved {
+		IDList[index] = *torrent.ID
+	}
+	if err = inst.client.TorrentRemove(&transmissionrpc.TorrentRemovePayload{
+		IDs:             IDList,
+		DeleteLocalData: false,
+	}); err != nil {
+		metrics.rpcError(inst.name, "torrent-remove")
+		err = fmt.Errorf("can't remove the moved torrents (they are still seeding from the quarantine dir): %v", err)
+		return
+	}
+	quarantined = moved
+	// Record them
+	now := inst.clock()
+	for index, torrent := range quarantined {
+		entry := &quarantineEntry{
+			Time:     now,
+			Instance: inst.name,
+			Hash:     *torrent.HashString,
+			Name:     *torrent.Name,
+			Path:     filepath.Join(locations[index], *torrent.Name),
+		}
+		if torrent.TotalSize != nil {
+			entry.Size = int64(torrent.TotalSize.Byte())
+		}
+		if torrent.UploadRatio != nil {
+			entry.UploadRatio = *torrent.UploadRatio
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+	}
+	if err = manifest.save(dir); err != nil {
+		err = fmt.Errorf("the quarantined torrents won't be purged automatically: %v", err)
+	}
+	return
+}
+
+// purgeQuarantine deletes the quarantined data of the instance older than the retention,
+// then the oldest remaining entries until toFree is reached (unless outside of the purge maintenance windows)
+func (inst *instance) purgeQuarantine(ctx context.Context, toFree cunits.Bits, result *batchResult, dryRun bool) (purged int, freed cunits.Bits) {
+	dir := inst.butler.Quarantine.Dir
+	defer quarantineAccess.Unlock()
+	quarantineAccess.Lock()
+	manifest, err := loadQuarantineManifest(dir)
+	if err != nil {
+		inst.log.Errorf("Can't purge the quarantine dir '%s': %v", dir, err)
+		return
+	}
+	// Select
+	var candidates []*quarantineEntry
+	kept := make([]*quarantineEntry, 0, len(manifest.Entries))
+	now := inst.clock()
+	for _, entry := range manifest.Entries {
+		if entry.Instance == inst.name && inst.butler.Quarantine.Retention > 0 &&
+			!now.Before(entry.Time.Add(inst.butler.Quarantine.Retention)) {
+			candidates = append(candidates, entry)
+			freed += cunits.ImportInByte(float64(entry.Size))
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+	if freed < toFree {
+		sort.SliceStable(kept, func(i, j int) bool { return kept[i].Time.Before(kept[j].Time) })
+		remaining := make([]*quarantineEntry, 0, len(kept))
+		for _, entry := range kept {
+			if freed < toFree && entry.Instance == inst.name {
+				candidates = append(candidates, entry)
+				freed += cunits.ImportInByte(float64(entry.Size))
+			} else {
+				remaining = append(remaining, entry)
+			}
+		}
+		kept = remaining
+	}
+	if len(candidates) == 0 {
+		return
+	}
+	if inst.postpone(actionPurge, len(candidates), result) {
+		return 0, 0
+	}
+	nameList := make([]string, len(candidates))
+	for index, entry := range candidates {
+		nameList[index] = fmt.Sprintf("%s (%s, quarantined on %s)", entry.Name,
+			cunits.ImportInByte(float64(entry.Size)), entry.Time.Format("2006-01-02"))
+	}
+	// Dry run ?
+	if dryRun {
+		var suffix string
+		if len(nameList) > 1 {
+			suffix = "s"
+		}
+		inst.butlerReportPlan(fmt.Sprintf("Would purge %d quarantined torrent%s (%s)", len(nameList), suffix, freed),
+			nameList, "quarantine purge")
+		purged = len(candidates)
+		return
+	}
+	// Run
+	freed = 0
+	var purgedList []string
+	for index, entry := range candidates {
+		if ctx.Err() != nil {
+			// purged on the next batch
+			kept = append(kept, entry)
+			continue
+		}
+		location, err := getQuarantineLocation(dir, entry.Hash)
+		if err == nil {
+			err = os.RemoveAll(location)
+		}
+		if err != nil {
+			inst.log.Errorf("Can't purge quarantined torrent '%s': %v", entry.Name, err)
+			kept = append(kept, entry)
+			continue
+		}
+		purged++
+		freed += cunits.ImportInByte(float64(entry.Size))
+		purgedList = append(purgedList, nameList[index])
+	}
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].Time.Before(kept[j].Time) })
+	manifest.Entries = kept
+	if err = manifest.save(dir); err != nil {
+		inst.log.Errorf("Can't update the quarantine manifest after purging: %v", err)
+	}
+	if purged == 0 {
+		return
+	}
+	var suffix string
+	if purged > 1 {
+		suffix = "s"
+	}
+	inst.log.Infof("Successfully purged %d quarantined torrent%s (%s)", purged, suffix, freed)
+	inst.notify(notification{
+		Priority: priorityNormal,
+		Title:    fmt.Sprintf("%d quarantined torrent%s purged", purged, suffix),
+		Message:  fmt.Sprintf("%s freed by purging:\n%s", freed, butlerMakeStrList(purgedList)),
+		Event:    "quarantine purge",
+		Torrents: purgedList,
+	})
+	return
+}
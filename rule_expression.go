@@ -0,0 +1,698 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/hekmon/cunits/v2"
+	"github.com/hekmon/transmissionrpc"
+)
+
+/*
+	Rule expressions: boolean expressions over the torrent fields, compiled when the configuration is loaded.
+
+	tracker == "foo.org" && totalSize > 50GiB && (age > 30d || ratio >= 2)
+*/
+
+type exprKind int
+
+const (
+	exprBool exprKind = iota
+	exprNumber
+	exprSize     // bytes
+	exprDuration // nanoseconds
+	exprString
+	exprStrings // multi valued string field: true if any value matches
+)
+
+func (ek exprKind) String() string {
+	switch ek {
+	case exprBool:
+		return "boolean"
+	case exprNumber:
+		return "number"
+	case exprSize:
+		return "size"
+	case exprDuration:
+		return "duration"
+	case exprString, exprStrings:
+		return "string"
+	default:
+		return fmt.Sprintf("unknown (%d)", ek)
+	}
+}
+
+// exprTorrent is what an expression is evaluated against
+type exprTorrent struct {
+	torrent *transmissionrpc.Torrent
+	labels  []string
+	now     time.Time
+}
+
+type exprField struct {
+	kind exprKind
+	get  func(et *exprTorrent) exprValue
+}
+
+var exprFields = map[string]exprField{
+	"name": {exprString, func(et *exprTorrent) exprValue {
+		return exprValue{str: []string{getExprString(et.torrent.Name)}}
+	}},
+	"hash": {exprString, func(et *exprTorrent) exprValue {
+		return exprValue{str: []string{strings.ToLower(getExprString(et.torrent.HashString))}}
+	}},
+	"downloadDir": {exprString, func(et *exprTorrent) exprValue {
+		return exprValue{str: []string{getExprString(et.torrent.DownloadDir)}}
+	}},
+	"status": {exprString, func(et *exprTorrent) exprValue {
+		if et.torrent.Status == nil {
+			return exprValue{str: []string{""}}
+		}
+		return exprValue{str: []string{et.torrent.Status.String()}}
+	}},
+	"ratioMode": {exprString, func(et *exprTorrent) exprValue {
+		if et.torrent.SeedRatioMode == nil {
+			return exprValue{str: []string{""}}
+		}
+		return exprValue{str: []string{et.torrent.SeedRatioMode.String()}}
+	}},
+	"tracker": {exprStrings, func(et *exprTorrent) exprValue {
+		var hosts []string
+		for _, tracker := range et.torrent.Trackers {
+			if tracker == nil {
+				continue
+			}
+			// every parent domain matches too: tracker == "example.org" is true for tracker.example.org
+			for domain := getTrackerHost(tracker.Announce); domain != ""; domain = getParentDomain(domain) {
+				hosts = append(hosts, domain)
+			}
+		}
+		return exprValue{str: hosts}
+	}},
+	"label": {exprStrings, func(et *exprTorrent) exprValue {
+		return exprValue{str: et.labels}
+	}},
+	"totalSize": {exprSize, func(et *exprTorrent) exprValue {
+		if et.torrent.TotalSize == nil {
+			return exprValue{}
+		}
+		return exprValue{num: et.torrent.TotalSize.Byte()}
+	}},
+	"uploadRate": {exprSize, func(et *exprTorrent) exprValue {
+		return exprValue{num: float64(getTorrentUploadRate(et.torrent))}
+	}},
+	"ratio": {exprNumber, func(et *exprTorrent) exprValue {
+		if et.torrent.UploadRatio == nil {
+			return exprValue{}
+		}
+		return exprValue{num: *et.torrent.UploadRatio}
+	}},
+	"age": {exprDuration, func(et *exprTorrent) exprValue {
+		// time since the download completed, 0 while downloading
+		if et.torrent.DoneDate == nil || et.torrent.DoneDate.Unix() <= 0 {
+			return exprValue{}
+		}
+		return exprValue{num: float64(et.now.Sub(*et.torrent.DoneDate))}
+	}},
+	"seedTime": {exprDuration, func(et *exprTorrent) exprValue {
+		if et.torrent.SecondsSeeding == nil {
+			return exprValue{}
+		}
+		return exprValue{num: float64(*et.torrent.SecondsSeeding)}
+	}},
+}
+
+func getExprString(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+type exprValue struct {
+	b   bool
+	num float64
+	str []string
+}
+
+type exprNode interface {
+	kind() exprKind
+	eval(et *exprTorrent) exprValue
+}
+
+// ruleExpression is a compiled rule expression
+type ruleExpression struct {
+	source string
+	root   exprNode
+}
+
+func (re *ruleExpression) String() string {
+	return re.source
+}
+
+func (re *ruleExpression) match(torrent *transmissionrpc.Torrent, labels []string, now time.Time) bool {
+	return re.root.eval(&exprTorrent{
+		torrent: torrent,
+		labels:  labels,
+		now:     now,
+	}).b
+}
+
+// compileRuleExpression parses and type checks an expression
+func compileRuleExpression(source string) (re *ruleExpression, err error) {
+	tokens, err := lexRuleExpression(source)
+	if err != nil {
+		return
+	}
+	parser := &exprParser{tokens: tokens}
+	root, err := parser.parseOr()
+	if err != nil {
+		return
+	}
+	if token := parser.peek(); token.kind != tokenEOF {
+		return nil, fmt.Errorf("column %d: unexpected '%s'", token.column, token.text)
+	}
+	if root.kind() != exprBool {
+		return nil, fmt.Errorf("the expression is a %s, not a condition", root.kind())
+	}
+	return &ruleExpression{
+		source: source,
+		root:   root,
+	}, nil
+}
+
+/*
+	Lexer
+*/
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenSize
+	tokenDuration
+	tokenOperator
+)
+
+type exprToken struct {
+	kind   tokenKind
+	text   string
+	column int
+	value  float64
+}
+
+var exprDurationUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+var exprOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "<", ">", "!", "(", ")", "-"}
+
+func lexRuleExpression(source string) (tokens []exprToken, err error) {
+	runes := []rune(source)
+	for index := 0; index < len(runes); {
+		r := runes[index]
+		column := index + 1
+		switch {
+		case unicode.IsSpace(r):
+			index++
+		case r == '"':
+			// string literal with \" and \\ escapes, other backslashes are kept for the regular expressions
+			var value strings.Builder
+			index++
+			for ; index < len(runes) && runes[index] != '"'; index++ {
+				if runes[index] == '\\' && index+1 < len(runes) && (runes[index+1] == '"' || runes[index+1] == '\\') {
+					index++
+				}
+				value.WriteRune(runes[index])
+			}
+			if index >= len(runes) {
+				return nil, fmt.Errorf("column %d: unterminated string", column)
+			}
+			index++
+			tokens = append(tokens, exprToken{kind: tokenString, text: value.String(), column: column})
+		case unicode.IsDigit(r):
+			start := index
+			for index < len(runes) && (unicode.IsDigit(runes[index]) || runes[index] == '.') {
+				index++
+			}
+			number := string(runes[start:index])
+			unitStart := index
+			for index < len(runes) && unicode.IsLetter(runes[index]) {
+				index++
+			}
+			token := exprToken{kind: tokenNumber, text: string(runes[start:index]), column: column}
+			if token.value, err = strconv.ParseFloat(number, 64); err != nil {
+				return nil, fmt.Errorf("column %d: invalid number '%s'", column, number)
+			}
+			if unit := string(runes[unitStart:index]); unit != "" {
+				if duration, found := exprDurationUnits[unit]; found {
+					token.kind = tokenDuration
+					token.value *= float64(duration)
+				} else if size, sizeErr := cunits.Parse(number + unit); sizeErr == nil {
+					token.kind = tokenSize
+					token.value = size.Byte()
+				} else {
+					return nil, fmt.Errorf("column %d: unknown unit '%s' (durations: s, m, h, d, w; sizes: B, KB, KiB, MB, MiB, GB, GiB, TB, TiB...)",
+						unitStart+1, unit)
+				}
+			}
+			tokens = append(tokens, token)
+		case unicode.IsLetter(r) || r == '_':
+			start := index
+			for index < len(runes) && (unicode.IsLetter(runes[index]) || unicode.IsDigit(runes[index]) || runes[index] == '_') {
+				index++
+			}
+			tokens = append(tokens, exprToken{kind: tokenIdent, text: string(runes[start:index]), column: column})
+		default:
+			var operator string
+			for _, candidate := range exprOperators {
+				if strings.HasPrefix(string(runes[index:]), candidate) {
+					operator = candidate
+					break
+				}
+			}
+			if operator == "" {
+				return nil, fmt.Errorf("column %d: unexpected character '%c'", column, r)
+			}
+			index += len([]rune(operator))
+			tokens = append(tokens, exprToken{kind: tokenOperator, text: operator, column: column})
+		}
+	}
+	tokens = append(tokens, exprToken{kind: tokenEOF, text: "end of expression", column: len(runes) + 1})
+	return
+}
+
+/*
+	Parser (recursive descent)
+
+	or         := and ("||" and)*
+	and        := unary ("&&" unary)*
+	unary      := "!" unary | "(" or ")" | comparison
+	comparison := operand (("==" | "!=" | "<" | "<=" | ">" | ">=" | "=~") operand)?
+	operand    := field | string | ["-"] number | size | duration | true | false
+
+	A comparison must have exactly one field operand.
+*/
+
+type exprParser struct {
+	tokens   []exprToken
+	position int
+}
+
+func (ep *exprParser) peek() exprToken {
+	return ep.tokens[ep.position]
+}
+
+func (ep *exprParser) next() (token exprToken) {
+	token = ep.tokens[ep.position]
+	if token.kind != tokenEOF {
+		ep.position++
+	}
+	return
+}
+
+func (ep *exprParser) isOperator(operator string) bool {
+	token := ep.peek()
+	return token.kind == tokenOperator && token.text == operator
+}
+
+func (ep *exprParser) parseOr() (node exprNode, err error) {
+	if node, err = ep.parseAnd(); err != nil {
+		return
+	}
+	for ep.isOperator("||") {
+		token := ep.next()
+		var right exprNode
+		if right, err = ep.parseAnd(); err != nil {
+			return
+		}
+		if node, err = newExprLogical(token, node, right); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (ep *exprParser) parseAnd() (node exprNode, err error) {
+	if node, err = ep.parseUnary(); err != nil {
+		return
+	}
+	for ep.isOperator("&&") {
+		token := ep.next()
+		var right exprNode
+		if right, err = ep.parseUnary(); err != nil {
+			return
+		}
+		if node, err = newExprLogical(token, node, right); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (ep *exprParser) parseUnary() (node exprNode, err error) {
+	switch {
+	case ep.isOperator("!"):
+		token := ep.next()
+		if node, err = ep.parseUnary(); err != nil {
+			return
+		}
+		if node.kind() != exprBool {
+			return nil, fmt.Errorf("column %d: '!' needs a condition, not a %s", token.column, node.kind())
+		}
+		return &exprNot{operand: node}, nil
+	case ep.isOperator("("):
+		token := ep.next()
+		if node, err = ep.parseOr(); err != nil {
+			return
+		}
+		if !ep.isOperator(")") {
+			closing := ep.peek()
+			return nil, fmt.Errorf("column %d: expected ')' to close the '(' of column %d, got '%s'", closing.column, token.column, closing.text)
+		}
+		ep.next()
+		return
+	default:
+		return ep.parseComparison()
+	}
+}
+
+func (ep *exprParser) parseComparison() (node exprNode, err error) {
+	left, err := ep.parseOperand()
+	if err != nil {
+		return
+	}
+	token := ep.peek()
+	if token.kind != tokenOperator {
+		return left, nil
+	}
+	switch token.text {
+	case "==", "!=", "<", "<=", ">", ">=", "=~":
+	default:
+		return left, nil
+	}
+	ep.next()
+	right, err := ep.parseOperand()
+	if err != nil {
+		return
+	}
+	return newExprComparison(token, left, right)
+}
+
+func (ep *exprParser) parseOperand() (node exprNode, err error) {
+	token := ep.next()
+	switch token.kind {
+	case tokenIdent:
+		switch token.text {
+		case "true", "false":
+			return &exprLiteral{valueKind: exprBool, value: exprValue{b: token.text == "true"}}, nil
+		}
+		field, found := exprFields[token.text]
+		if !found {
+			return nil, fmt.Errorf("column %d: unknown field '%s' (valid fields: %s)", token.column, token.text, getExprFieldNames())
+		}
+		return &exprFieldNode{name: token.text, field: field}, nil
+	case tokenString:
+		return &exprLiteral{valueKind: exprString, value: exprValue{str: []string{token.text}}}, nil
+	case tokenNumber:
+		return &exprLiteral{valueKind: exprNumber, value: exprValue{num: token.value}}, nil
+	case tokenOperator:
+		if token.text == "-" {
+			number := ep.next()
+			if number.kind != tokenNumber {
+				return nil, fmt.Errorf("column %d: '-' must be followed by a number, got '%s'", number.column, number.text)
+			}
+			return &exprLiteral{valueKind: exprNumber, value: exprValue{num: -number.value}}, nil
+		}
+		return nil, fmt.Errorf("column %d: expected a field or a value, got '%s'", token.column, token.text)
+	case tokenSize:
+		return &exprLiteral{valueKind: exprSize, value: exprValue{num: token.value}}, nil
+	case tokenDuration:
+		return &exprLiteral{valueKind: exprDuration, value: exprValue{num: token.value}}, nil
+	default:
+		return nil, fmt.Errorf("column %d: expected a field or a value, got '%s'", token.column, token.text)
+	}
+}
+
+func getExprFieldNames() string {
+	names := make([]string, 0, len(exprFields))
+	for name := range exprFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+/*
+	Nodes
+*/
+
+type exprLiteral struct {
+	valueKind exprKind
+	value     exprValue
+}
+
+func (el *exprLiteral) kind() exprKind                 { return el.valueKind }
+func (el *exprLiteral) eval(et *exprTorrent) exprValue { return el.value }
+
+type exprFieldNode struct {
+	name  string
+	field exprField
+}
+
+func (ef *exprFieldNode) kind() exprKind                 { return ef.field.kind }
+func (ef *exprFieldNode) eval(et *exprTorrent) exprValue { return ef.field.get(et) }
+
+type exprNot struct {
+	operand exprNode
+}
+
+func (en *exprNot) kind() exprKind { return exprBool }
+func (en *exprNot) eval(et *exprTorrent) exprValue {
+	return exprValue{b: !en.operand.eval(et).b}
+}
+
+type exprLogical struct {
+	and         bool
+	left, right exprNode
+}
+
+func newExprLogical(token exprToken, left, right exprNode) (exprNode, error) {
+	for _, operand := range []exprNode{left, right} {
+		if operand.kind() != exprBool {
+			return nil, fmt.Errorf("column %d: '%s' needs conditions on both sides, not a %s", token.column, token.text, operand.kind())
+		}
+	}
+	return &exprLogical{
+		and:   token.text == "&&",
+		left:  left,
+		right: right,
+	}, nil
+}
+
+func (el *exprLogical) kind() exprKind { return exprBool }
+func (el *exprLogical) eval(et *exprTorrent) exprValue {
+	left := el.left.eval(et).b
+	if el.and != left {
+		// false && ... or true || ...
+		return exprValue{b: left}
+	}
+	return el.right.eval(et)
+}
+
+type exprComparison struct {
+	operator    string
+	left, right exprNode
+	pattern     *regexp.Regexp
+}
+
+func newExprComparison(token exprToken, left, right exprNode) (node exprNode, err error) {
+	leftKind, rightKind := left.kind(), right.kind()
+	_, leftField := left.(*exprFieldNode)
+	_, rightField := right.(*exprFieldNode)
+	if leftField == rightField {
+		// two values or two fields: the result does not depend on the torrent (or is meaningless)
+		return nil, fmt.Errorf("column %d: '%s' must compare a field with a value", token.column, token.text)
+	}
+	comparison := &exprComparison{
+		operator: token.text,
+		left:     left,
+		right:    right,
+	}
+	switch token.text {
+	case "=~":
+		literal, isLiteral := right.(*exprLiteral)
+		if (leftKind != exprString && leftKind != exprStrings) || !isLiteral || rightKind != exprString {
+			return nil, fmt.Errorf("column %d: '=~' needs a string field on its left and a regular expression string on its right", token.column)
+		}
+		if comparison.pattern, err = regexp.Compile(literal.value.str[0]); err != nil {
+			return nil, fmt.Errorf("column %d: invalid regular expression: %v", token.column, err)
+		}
+	case "==", "!=":
+		if leftKind == exprStrings && rightKind == exprStrings {
+			return nil, fmt.Errorf("column %d: can't compare two multi valued fields", token.column)
+		}
+		if leftKind.String() != rightKind.String() {
+			return nil, fmt.Errorf("column %d: can't compare a %s with a %s", token.column, leftKind, rightKind)
+		}
+	default:
+		switch leftKind {
+		case exprNumber, exprSize, exprDuration:
+		default:
+			return nil, fmt.Errorf("column %d: '%s' can't be used on a %s", token.column, token.text, leftKind)
+		}
+		if leftKind != rightKind {
+			return nil, fmt.Errorf("column %d: can't compare a %s with a %s", token.column, leftKind, rightKind)
+		}
+	}
+	return comparison, nil
+}
+
+func (ec *exprComparison) kind() exprKind { return exprBool }
+func (ec *exprComparison) eval(et *exprTorrent) exprValue {
+	left := ec.left.eval(et)
+	switch ec.operator {
+	case "=~":
+		for _, value := range left.str {
+			if ec.pattern.MatchString(value) {
+				return exprValue{b: true}
+			}
+		}
+		return exprValue{}
+	case "==", "!=":
+		right := ec.right.eval(et)
+		var equal bool
+		switch ec.left.kind() {
+		case exprBool:
+			equal = left.b == right.b
+		case exprString, exprStrings:
+			// multi valued fields are equal if any of their values is
+		outer:
+			for _, leftValue := range left.str {
+				for _, rightValue := range right.str {
+					if strings.EqualFold(leftValue, rightValue) {
+						equal = true
+						break outer
+					}
+				}
+			}
+		default:
+			equal = left.num == right.num
+		}
+		return exprValue{b: equal == (ec.operator == "==")}
+	default:
+		right := ec.right.eval(et)
+		switch ec.operator {
+		case "<":
+			return exprValue{b: left.num < right.num}
+		case "<=":
+			return exprValue{b: left.num <= right.num}
+		case ">":
+			return exprValue{b: left.num > right.num}
+		default:
+			return exprValue{b: left.num >= right.num}
+		}
+	}
+}
+
+/*
+	Rule actions
+*/
+
+const (
+	ruleActionFreeSeed    = "free_seed"
+	ruleActionGlobalRatio = "global_ratio"
+	ruleActionCustomRatio = "custom_ratio"
+	ruleActionDelete      = "delete"
+	ruleActionStop        = "stop"  // not stopped again once restarted by the user (tracked in the state file)
+	ruleActionPause       = "pause" // kept stopped and never deleted
+	ruleActionMove        = "move"
+)
+
+// ruleAction is what a matching rule does to a torrent instead of the default decision tree
+type ruleAction struct {
+	name  string
+	ratio float64
+	dir   string
+	force bool // delete, stop, pause or move whatever the torrent status and free seed period
+}
+
+func (ra *ruleAction) String() string {
+	switch ra.name {
+	case ruleActionCustomRatio:
+		return fmt.Sprintf("%s(%.02f)", ra.name, ra.ratio)
+	case ruleActionMove:
+		if ra.force {
+			return fmt.Sprintf("%s(%s, force)", ra.name, ra.dir)
+		}
+		return fmt.Sprintf("%s(%s)", ra.name, ra.dir)
+	default:
+		if ra.force {
+			return fmt.Sprintf("%s(force)", ra.name)
+		}
+		return ra.name
+	}
+}
+
+// parseRuleAction parses "name" or "name(argument)", the argument may be quoted. The move dir can be followed by ", force".
+func parseRuleAction(source string) (ra *ruleAction, err error) {
+	source = strings.TrimSpace(source)
+	ra = new(ruleAction)
+	var argument string
+	var hasArgument bool
+	if open := strings.Index(source, "("); open != -1 {
+		if !strings.HasSuffix(source, ")") {
+			return nil, fmt.Errorf("action '%s' is missing its closing ')'", source)
+		}
+		ra.name = strings.TrimSpace(source[:open])
+		argument = strings.TrimSpace(source[open+1 : len(source)-1])
+		if comma := strings.LastIndex(argument, ","); ra.name == ruleActionMove && comma != -1 &&
+			strings.TrimSpace(argument[comma+1:]) == "force" {
+			argument = strings.TrimSpace(argument[:comma])
+			ra.force = true
+		}
+		if unquoted, unquoteErr := strconv.Unquote(argument); unquoteErr == nil {
+			argument = unquoted
+		}
+		hasArgument = true
+	} else {
+		ra.name = source
+	}
+	switch ra.name {
+	case ruleActionFreeSeed, ruleActionGlobalRatio:
+		if hasArgument {
+			return nil, fmt.Errorf("action '%s' takes no argument", ra.name)
+		}
+	case ruleActionDelete, ruleActionStop, ruleActionPause:
+		if hasArgument && argument != "force" {
+			return nil, fmt.Errorf("action '%s' only takes 'force' as argument, got '%s'", ra.name, argument)
+		}
+		ra.force = hasArgument
+	case ruleActionCustomRatio:
+		if ra.ratio, err = strconv.ParseFloat(argument, 64); err != nil || ra.ratio <= 0 {
+			return nil, fmt.Errorf("action '%s' needs a ratio greater than 0, got '%s'", ra.name, argument)
+		}
+	case ruleActionMove:
+		if !filepath.IsAbs(argument) {
+			return nil, fmt.Errorf("action '%s' needs an absolute dir, got '%s'", ra.name, argument)
+		}
+		ra.dir = filepath.Clean(argument)
+	default:
+		return nil, fmt.Errorf("action '%s' is invalid: valid actions are %s, %s, %s(ratio), %s[(force)], %s[(force)], %s[(force)] and "+
+			"%s(dir[, force])", ra.name, ruleActionFreeSeed, ruleActionGlobalRatio, ruleActionCustomRatio, ruleActionDelete, ruleActionStop, ruleActionPause, ruleActionMove)
+	}
+	return
+}
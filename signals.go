@@ -1,35 +1,36 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
 	systemd "github.com/iguanesolutions/go-systemd"
 )
 
-func handleSignals(butlerSignal chan<- struct{}, butlerStopped *sync.WaitGroup, mainStop *sync.Mutex) {
+func handleSignals(butlerStopped *sync.WaitGroup, mainStop *sync.Mutex) {
 	// If we exit, allow main goroutine to do so
 	defer mainStop.Unlock()
 	// Register signals
 	var sig os.Signal
-	signalChannel := make(chan os.Signal)
-	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGHUP)
 	// Waiting for signals to catch
 	var err error
 	for {
 		sig = <-signalChannel
 		switch sig {
 		case syscall.SIGUSR1:
-			if err = systemd.NotifyReloading(); err != nil {
-				logger.Errorf("[Main] Sending reloading notification to systemd failed: %v", err)
-			}
 			logger.Infof("[Main] Signal '%v' caught: forcing the butler to run now", sig)
-			butlerBatch()
-			if err = systemd.NotifyReady(); err != nil {
-				logger.Errorf("[Main] Sending ready notification to systemd failed: %v", err)
-			}
+			// run apart so the stop signals can still be caught
+			go forcedBatches()
+		case syscall.SIGHUP:
+			logger.Infof("[Main] Signal '%v' caught: reloading the configuration", sig)
+			// apart too: the reload waits for the running batches (reloads are serialized by confReload)
+			go reloadConfig(fmt.Sprintf("signal '%v'", sig))
 		case syscall.SIGTERM:
 			fallthrough
 		case syscall.SIGINT:
@@ -38,15 +39,51 @@ func handleSignals(butlerSignal chan<- struct{}, butlerStopped *sync.WaitGroup,
 			if err = systemd.NotifyStopping(); err != nil {
 				logger.Errorf("[Main] Sending stopping notification to systemd failed: %v", err)
 			}
-			// Start stop (haha)
-			butlerSignal <- struct{}{}
-			logger.Debug("[Main] Stop signal sent to butler, waiting for its goroutine to finish")
+			// Start stop (haha): running batches are aborted before their next step
+			timeout := currentConf().ShutdownTimeout
+			if err = notifyExtendTimeout(timeout + shutdownMargin); err != nil {
+				logger.Errorf("[Main] Can't extend the systemd stop timeout: %v", err)
+			}
+			cancelBatches()
+			logger.Debugf("[Main] Batches canceled, waiting up to %v for the butler to finish", timeout)
 			// Wait stop
-			butlerStopped.Wait()
-			logger.Debug("[Main] butler has stopped, unlocking main goroutine to exit")
+			if waitButlerStop(butlerStopped, timeout) {
+				logger.Debug("[Main] butler has stopped, unlocking main goroutine to exit")
+			} else {
+				logger.Errorf("[Main] The butler did not stop within the shutdown deadline (%v): exiting anyway", timeout)
+			}
 			return
 		default:
 			logger.Warningf("[Main] Signal '%v' caught but no process set to handle it: skipping", sig)
 		}
 	}
 }
+
+// forcedBatches runs the batches out of schedule
+func forcedBatches() {
+	if err := systemd.NotifyReloading(); err != nil {
+		logger.Errorf("[Main] Sending reloading notification to systemd failed: %v", err)
+	}
+	butlerBatches(batchesContext, currentConf().Butler.DryRun)
+	updateSystemdStatus()
+	if err := systemd.NotifyReady(); err != nil {
+		logger.Errorf("[Main] Sending ready notification to systemd failed: %v", err)
+	}
+}
+
+// waitButlerStop waits for the butler loop and the forced batches (signal or API) to be done, returns false after timeout
+func waitButlerStop(butlerStopped *sync.WaitGroup, timeout time.Duration) bool {
+	stopped := make(chan struct{})
+	go func() {
+		butlerStopped.Wait()
+		// the run lock is kept: nothing can start anymore
+		butlerRun.Lock()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/hekmon/cunits/v2"
+	"github.com/hekmon/transmissionrpc"
+)
+
+const (
+	uploadModelCurrent = "current"
+	uploadModelDecay   = "decay"
+	uploadModelRatio   = "ratio"
+)
+
+// simulation runs the butler against an in-memory transmission while advancing a virtual clock
+type simulation struct {
+	inst        *instance
+	ft          *fakeTransmission
+	start       time.Time
+	now         time.Time
+	model       string
+	halfLife    time.Duration
+	ratioPerDay float64
+	rates       map[int64]float64 // initial upload rates in bytes per second
+	events      []simulationEvent
+	usage       []simulationUsage
+}
+
+type simulationEvent struct {
+	Time    time.Time
+	Torrent string
+	Event   string
+}
+
+type simulationUsage struct {
+	Time      time.Time
+	Torrents  int
+	Used      cunits.Bits
+	FreeSpace cunits.Bits
+}
+
+func newSimulation(inst *instance, ft *fakeTransmission, start time.Time, model string, halfLife time.Duration, ratioPerDay float64) (sim *simulation) {
+	sim = &simulation{
+		inst:        inst,
+		ft:          ft,
+		start:       start,
+		now:         start,
+		model:       model,
+		halfLife:    halfLife,
+		ratioPerDay: ratioPerDay,
+		rates:       make(map[int64]float64),
+	}
+	inst.clock = func() time.Time { return sim.now }
+	for _, torrent := range ft.getTorrents() {
+		if torrent.RateUpload != nil {
+			sim.rates[*torrent.ID] = float64(*torrent.RateUpload)
+		}
+	}
+	return
+}
+
+// run simulates the butler batches over the given duration
+func (sim *simulation) run(duration time.Duration) {
+	end := sim.start.Add(duration)
+	nextUsage := sim.start
+	for !sim.now.After(end) {
+		if !sim.now.Before(nextUsage) {
+			sim.recordUsage()
+			nextUsage = nextUsage.Add(24 * time.Hour)
+		}
+		before := sim.ft.getTorrents()
+		result := sim.inst.batch(context.Background(), false)
+		sim.diff(before, sim.ft.getTorrents())
+		// Same scheduling as the daemon: next run or opening of a maintenance window with postponed candidates
+		next := sim.inst.butler.nextRun(sim.now)
+		if !result.nextWindow.IsZero() && result.nextWindow.After(sim.now) && result.nextWindow.Before(next) {
+			next = result.nextWindow
+		}
+		step := next.Sub(sim.now)
+		sim.seed(step)
+		sim.now = next
+	}
+}
+
+// diff records the changes made by the butler during a batch
+func (sim *simulation) diff(before, after []*transmissionrpc.Torrent) {
+	remaining := make(map[int64]*transmissionrpc.Torrent, len(after))
+	for _, torrent := range after {
+		remaining[*torrent.ID] = torrent
+	}
+	for _, previous := range before {
+		torrent, found := remaining[*previous.ID]
+		if !found {
+			action := "deleted"
+			if record, found := state.getDeletion(sim.inst.name, previous); found && record.Action == actionIdle {
+				action = "deleted as idle"
+			} else if previous.Status != nil && *previous.Status != transmissionrpc.TorrentStatusStopped {
+				action = "evicted"
+			}
+			sim.addEvent(sim.now, previous, fmt.Sprintf("%s (ratio %.02f, %s freed)", action, getSimulationRatio(previous), getSimulationSize(previous)))
+			continue
+		}
+		if previous.Status != nil && torrent.Status != nil && *previous.Status != transmissionrpc.TorrentStatusStopped &&
+			*torrent.Status == transmissionrpc.TorrentStatusStopped {
+			sim.addEvent(sim.now, torrent, fmt.Sprintf("stopped (ratio %.02f)", getSimulationRatio(torrent)))
+		}
+		if previous.DownloadDir != nil && torrent.DownloadDir != nil && *previous.DownloadDir != *torrent.DownloadDir {
+			sim.addEvent(sim.now, torrent, fmt.Sprintf("moved to '%s'", *torrent.DownloadDir))
+		}
+		if previous.SeedRatioMode == nil || torrent.SeedRatioMode == nil {
+			continue
+		}
+		if *previous.SeedRatioMode != *torrent.SeedRatioMode ||
+			(*torrent.SeedRatioMode == transmissionrpc.SeedRatioModeCustom && *previous.SeedRatioLimit != *torrent.SeedRatioLimit) {
+			sim.addEvent(sim.now, torrent, fmt.Sprintf("switched to %s (ratio %.02f)", getSimulationMode(torrent), getSimulationRatio(torrent)))
+		}
+	}
+}
+
+// seed advances the torrents upload following the upload model and applies the transmission seed limits
+func (sim *simulation) seed(elapsed time.Duration) {
+	sinceStart := sim.now.Add(elapsed).Sub(sim.start)
+	var stopped []*transmissionrpc.Torrent
+	sim.ft.update(func(torrent *transmissionrpc.Torrent, session *transmissionrpc.SessionArguments) {
+		if torrent.Status == nil || (*torrent.Status != transmissionrpc.TorrentStatusSeed &&
+			*torrent.Status != transmissionrpc.TorrentStatusSeedWait) {
+			return
+		}
+		if torrent.SecondsSeeding != nil {
+			secondsSeeding := *torrent.SecondsSeeding + elapsed
+			torrent.SecondsSeeding = &secondsSeeding
+		}
+		if torrent.TotalSize == nil || *torrent.TotalSize == 0 || torrent.UploadRatio == nil {
+			return
+		}
+		uploaded := sim.getUploadRate(torrent, sinceStart) * elapsed.Seconds()
+		uploadRatio := *torrent.UploadRatio + uploaded/torrent.TotalSize.Byte()
+		torrent.UploadRatio = &uploadRatio
+		if uploaded >= 1 {
+			// keep the idle detection inputs coherent
+			uploadedEver := int64(uploadRatio * torrent.TotalSize.Byte())
+			activityDate := sim.now.Add(elapsed)
+			torrent.UploadedEver = &uploadedEver
+			torrent.ActivityDate = &activityDate
+		}
+		// Transmission stops the torrents reaching their ratio limit
+		var limit float64
+		switch {
+		case torrent.SeedRatioMode == nil:
+			return
+		case *torrent.SeedRatioMode == transmissionrpc.SeedRatioModeCustom && torrent.SeedRatioLimit != nil:
+			limit = *torrent.SeedRatioLimit
+		case *torrent.SeedRatioMode == transmissionrpc.SeedRatioModeGlobal && session.SeedRatioLimited != nil &&
+			*session.SeedRatioLimited && session.SeedRatioLimit != nil:
+			limit = *session.SeedRatioLimit
+		default:
+			return
+		}
+		if uploadRatio >= limit {
+			status := transmissionrpc.TorrentStatusStopped
+			torrent.Status = &status
+			stopped = append(stopped, torrent)
+		}
+	})
+	for _, torrent := range stopped {
+		sim.addEvent(sim.now.Add(elapsed), torrent, fmt.Sprintf("stopped by transmission (ratio %.02f reached)", getSimulationRatio(torrent)))
+	}
+}
+
+func (sim *simulation) getUploadRate(torrent *transmissionrpc.Torrent, sinceStart time.Duration) float64 {
+	switch sim.model {
+	case uploadModelDecay:
+		return sim.rates[*torrent.ID] * math.Pow(0.5, float64(sinceStart)/float64(sim.halfLife))
+	case uploadModelRatio:
+		return sim.ratioPerDay * torrent.TotalSize.Byte() / (24 * time.Hour).Seconds()
+	default:
+		return sim.rates[*torrent.ID]
+	}
+}
+
+func (sim *simulation) addEvent(at time.Time, torrent *transmissionrpc.Torrent, event string) {
+	var name string
+	if torrent.Name != nil {
+		name = *torrent.Name
+	}
+	sim.events = append(sim.events, simulationEvent{
+		Time:    at,
+		Torrent: name,
+		Event:   event,
+	})
+}
+
+func (sim *simulation) recordUsage() {
+	torrents := sim.ft.getTorrents()
+	usage := simulationUsage{
+		Time:      sim.now,
+		Torrents:  len(torrents),
+		FreeSpace: sim.ft.getFreeSpace(),
+	}
+	for _, torrent := range torrents {
+		if torrent.TotalSize != nil {
+			usage.Used += *torrent.TotalSize
+		}
+	}
+	sim.usage = append(sim.usage, usage)
+}
+
+func (sim *simulation) report(w io.Writer) {
+	fmt.Fprintln(w, "Timeline:")
+	if len(sim.events) == 0 {
+		fmt.Fprintln(w, "  nothing would happen")
+	}
+	for _, event := range sim.events {
+		fmt.Fprintf(w, "  day %6.2f  %s  %s: %s\n", event.Time.Sub(sim.start).Hours()/24,
+			event.Time.Format("2006-01-02 15:04"), event.Torrent, event.Event)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Disk usage:")
+	for _, usage := range sim.usage {
+		fmt.Fprintf(w, "  day %4.0f  %s  %4d torrent(s)  %12s used  %12s free\n", usage.Time.Sub(sim.start).Hours()/24,
+			usage.Time.Format("2006-01-02"), usage.Torrents, usage.Used, usage.FreeSpace)
+	}
+}
+
+func getSimulationMode(torrent *transmissionrpc.Torrent) string {
+	switch *torrent.SeedRatioMode {
+	case transmissionrpc.SeedRatioModeNoRatio:
+		return "free seed"
+	case transmissionrpc.SeedRatioModeGlobal:
+		return "global ratio"
+	case transmissionrpc.SeedRatioModeCustom:
+		return fmt.Sprintf("custom ratio %.02f", *torrent.SeedRatioLimit)
+	default:
+		return torrent.SeedRatioMode.String()
+	}
+}
+
+func getSimulationRatio(torrent *transmissionrpc.Torrent) float64 {
+	if torrent.UploadRatio == nil {
+		return 0
+	}
+	return *torrent.UploadRatio
+}
+
+func getSimulationSize(torrent *transmissionrpc.Torrent) cunits.Bits {
+	if torrent.TotalSize == nil {
+		return 0
+	}
+	return *torrent.TotalSize
+}
+
+// simulateCommand projects what the butler would do to a snapshot of torrents over the next days
+func simulateCommand(args []string) int {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	confFile := flags.String("conf", "config.json", "Relative or absolute path to the json configuration file")
+	snapshotFile := flags.String("snapshot", "snapshot.json", "Relative or absolute path to the json snapshot (or fixture) of torrents")
+	instanceName := flags.String("instance", "", "Server whose butler values are used when several are configured")
+	days := flags.Int("days", 90, "Number of days to simulate")
+	model := flags.String("upload-model", uploadModelCurrent, fmt.Sprintf("Upload rate model: '%s' (the snapshot upload rate of each torrent), '%s' (the snapshot upload rate halved every -half-life-days) or '%s' (-ratio-per-day for every torrent)",
+		uploadModelCurrent, uploadModelDecay, uploadModelRatio))
+	halfLife := flags.Float64("half-life-days", 7, "Upload rate half life in days for the decay model")
+	ratioPerDay := flags.Float64("ratio-per-day", 0.1, "Ratio gained each day for the ratio model")
+	logLevel := flags.Int("loglevel", 2, "Set loglevel: Debug(0) Info(1) Warning(2) Error(3) Fatal(4). Default Warning.")
+	flags.Parse(args)
+	logger = newLogger(*logLevel)
+	switch *model {
+	case uploadModelCurrent, uploadModelDecay, uploadModelRatio:
+	default:
+		fmt.Fprintf(os.Stderr, "unknown upload model '%s'\n", *model)
+		return 1
+	}
+	if *halfLife <= 0 {
+		fmt.Fprintln(os.Stderr, "half life must be greater than 0")
+		return 1
+	}
+	// Load the configuration and the snapshot
+	var err error
+	if conf, err = getConfig(*confFile); err != nil {
+		fmt.Fprintf(os.Stderr, "can't load config: %v\n", err)
+		return 1
+	}
+	conf.HTTP.Listen = ""
+	instanceConf, err := conf.getServer(*instanceName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't select the server: %v\n", err)
+		return 1
+	}
+	fixture, err := loadTransmissionFixture(*snapshotFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't load snapshot: %v\n", err)
+		return 1
+	}
+	ft, err := newFakeTransmissionFromFixture(fixture)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't load snapshot: %v\n", err)
+		return 1
+	}
+	// Simulate (for real on the fake transmission)
+	butler := instanceConf.Butler
+	butler.DryRun = false
+	// the trash dir is on the real filesystem: simulate quarantined torrents as deleted ones
+	butler.Quarantine = nil
+	start := time.Now()
+	if fixture.Time != nil {
+		start = *fixture.Time
+	}
+	// in memory state: idle torrents detection and deletions reasons
+	state = &stateStore{
+		data: stateData{
+			Instances: make(map[string]*instanceState),
+		},
+	}
+	if fixture.State != nil {
+		if fixture.State.Torrents == nil {
+			fixture.State.Torrents = make(map[string]*torrentState)
+		}
+		state.data.Instances[instanceConf.Name] = fixture.State
+	}
+	sim := newSimulation(newInstance(instanceConf.Name, &butler, ft, nil), ft, start, *model,
+		time.Duration(*halfLife*float64(24*time.Hour)), *ratioPerDay)
+	fmt.Printf("Simulating %d torrent(s) from %s over %d days (work %s, upload model: %s)\n\n",
+		len(fixture.Torrents), start.Format("2006-01-02 15:04"), *days, butler.describeSchedule(), *model)
+	sim.run(time.Duration(*days) * 24 * time.Hour)
+	sim.report(os.Stdout)
+	return 0
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// snapshotCommand dumps the torrents and session values of a transmission server into a snapshot file
+func snapshotCommand(args []string) int {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	confFile := flags.String("conf", "config.json", "Relative or absolute path to the json configuration file")
+	instanceName := flags.String("instance", "", "Server to snapshot when several are configured")
+	output := flags.String("output", "snapshot.json", "Relative or absolute path of the snapshot file to write ('-' for stdout)")
+	flags.Parse(args)
+	c, err := getConfig(*confFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't load config: %v\n", err)
+		return 1
+	}
+	ic, err := c.getServer(*instanceName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't select the server: %v\n", err)
+		return 1
+	}
+	client, err := newTransmissionClient(ic.serverConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't initialize the transmission client: %v\n", err)
+		return 1
+	}
+	// Dump what a batch would read
+	now := time.Now()
+	snapshot := &transmissionFixture{
+		Version:  snapshotVersion,
+		Time:     &now,
+		Instance: ic.Name,
+	}
+	if snapshot.Session, err = client.SessionArgumentsGet(); err != nil {
+		fmt.Fprintf(os.Stderr, "can't get session values: %v\n", err)
+		return 2
+	}
+	if snapshot.Session.RPCVersion != nil {
+		snapshot.RPCVersion = *snapshot.Session.RPCVersion
+	}
+	if snapshot.Session.RPCVersionMinimum != nil {
+		snapshot.RPCVersionMinimum = *snapshot.Session.RPCVersionMinimum
+	}
+	if snapshot.Session.DownloadDir != nil {
+		freeSpace, err := client.FreeSpace(*snapshot.Session.DownloadDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "can't get free space: %v\n", err)
+			return 2
+		}
+		snapshot.FreeSpace = fmt.Sprintf("%d B", int64(freeSpace.Byte()))
+	}
+	if snapshot.Torrents, err = client.TorrentGet(fields, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "can't get torrents: %v\n", err)
+		return 2
+	}
+	if snapshot.Labels, err = client.TorrentLabels(nil); err != nil {
+		fmt.Fprintf(os.Stderr, "can't get torrents labels: %v\n", err)
+		return 2
+	}
+	// The original seed settings known by the state are part of the decisions
+	if c.StateFile != "" {
+		ss, err := loadStateStore(c.StateFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "can't load state: %v\n", err)
+			return 1
+		}
+		history := ss.history(ic.Name)
+		snapshot.State = &history
+	}
+	if err = saveTransmissionFixture(*output, snapshot); err != nil {
+		fmt.Fprintf(os.Stderr, "can't save snapshot: %v\n", err)
+		return 1
+	}
+	if *output != "-" {
+		fmt.Fprintf(os.Stderr, "Snapshot of %d torrent(s) written to '%s'\n", len(snapshot.Torrents), *output)
+	}
+	return 0
+}
+
+// snapshotBatch runs a dry run batch against a snapshot instead of a live server, as it was when the snapshot was taken
+func snapshotBatch(filename string) (err error) {
+	snapshot, err := loadTransmissionFixture(filename)
+	if err != nil {
+		return
+	}
+	ic, err := conf.getServer(snapshot.Instance)
+	if err != nil {
+		return fmt.Errorf("can't select the server: %v", err)
+	}
+	ft, err := newFakeTransmissionFromFixture(snapshot)
+	if err != nil {
+		return
+	}
+	// Use the snapshot state in memory only, it is never saved
+	if snapshot.State != nil {
+		state = &stateStore{
+			data: stateData{
+				Instances: map[string]*instanceState{ic.Name: snapshot.State},
+			},
+		}
+		if snapshot.State.Torrents == nil {
+			snapshot.State.Torrents = make(map[string]*torrentState)
+		}
+	}
+	inst := newInstance(ic.Name, &ic.Butler, ft, nil)
+	if snapshot.Time != nil {
+		snapshotTime := *snapshot.Time
+		inst.clock = func() time.Time { return snapshotTime }
+	}
+	inst.log.Infof("Running a dry run batch against the snapshot '%s' (%d torrent(s))", filename, len(snapshot.Torrents))
+	result := inst.batch(context.Background(), true)
+	if !result.Success {
+		return fmt.Errorf("batch failed: %s", result.Error)
+	}
+	return
+}
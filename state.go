@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hekmon/transmissionrpc"
+)
+
+const (
+	stateMaxSwitches  = 20
+	stateMaxDeletions = 1000
+)
+
+/*
+	On disk state of the butler decisions, keyed by instance name then torrent hash
+*/
+
+type stateStore struct {
+	access sync.Mutex
+	path   string
+	dirty  bool
+	data   stateData
+}
+
+type stateData struct {
+	Instances map[string]*instanceState `json:"instances"`
+}
+
+type instanceState struct {
+	Torrents  map[string]*torrentState   `json:"torrents"`
+	Deletions []deletionRecord           `json:"deletions"`
+	Activity  map[string]*activityRecord `json:"activity,omitempty"`
+}
+
+// torrentState records what the butler did to a torrent and its seed settings before the butler first changed them
+type torrentState struct {
+	Name              string         `json:"name"`
+	OriginalRatioMode string         `json:"original_ratio_mode"`
+	OriginalRatio     float64        `json:"original_ratio"`
+	Switches          []switchRecord `json:"switches"`
+	Stopped           *time.Time     `json:"stopped,omitempty"` // by a stop rule action
+}
+
+type switchRecord struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	From   string    `json:"from"`
+	Ratio  float64   `json:"ratio,omitempty"`
+}
+
+type deletionRecord struct {
+	Time        time.Time `json:"time"`
+	Hash        string    `json:"hash"`
+	Name        string    `json:"name"`
+	Action      string    `json:"action"`
+	UploadRatio float64   `json:"upload_ratio"`
+	Size        string    `json:"size"`
+}
+
+// activityRecord tracks the upload activity of a torrent between batches
+type activityRecord struct {
+	UploadedEver int64     `json:"uploaded_ever"`
+	LastUpload   time.Time `json:"last_upload"`
+}
+
+var state *stateStore
+
+// loadStateStore opens the state file (a missing file is an empty state), an empty path disables the store
+func loadStateStore(path string) (ss *stateStore, err error) {
+	if path == "" {
+		return
+	}
+	ss = &stateStore{
+		path: path,
+		data: stateData{
+			Instances: make(map[string]*instanceState),
+		},
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		} else {
+			err = fmt.Errorf("can't read state file '%s': %v", path, err)
+		}
+		return
+	}
+	if err = json.Unmarshal(data, &ss.data); err != nil {
+		err = fmt.Errorf("can't decode state file '%s' as JSON: %v", path, err)
+		return
+	}
+	if ss.data.Instances == nil {
+		ss.data.Instances = make(map[string]*instanceState)
+	}
+	return
+}
+
+// save writes the state to disk if it has changed, using a temporary file to never leave a partial state
+func (ss *stateStore) save() (err error) {
+	if ss == nil {
+		return
+	}
+	defer ss.access.Unlock()
+	ss.access.Lock()
+	if !ss.dirty {
+		return
+	}
+	data, err := json.MarshalIndent(ss.data, "", "    ")
+	if err != nil {
+		return fmt.Errorf("can't encode state: %v", err)
+	}
+	if err = writeFileAtomic(ss.path, data); err != nil {
+		return
+	}
+	ss.dirty = false
+	return
+}
+
+// writeFileAtomic writes data in a temporary file then renames it: readers never see a partial file
+func writeFileAtomic(path string, data []byte) (err error) {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return fmt.Errorf("can't create temporary file: %v", err)
+	}
+	if _, err = tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("can't write temporary file: %v", err)
+	}
+	if err = tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("can't close temporary file: %v", err)
+	}
+	if err = os.Rename(tmpFile.Name(), path); err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("can't replace '%s': %v", path, err)
+	}
+	return
+}
+
+// getInstance must be called with access held
+func (ss *stateStore) getInstance(instance string) (is *instanceState) {
+	if is = ss.data.Instances[instance]; is == nil {
+		is = &instanceState{
+			Torrents: make(map[string]*torrentState),
+		}
+		ss.data.Instances[instance] = is
+	}
+	return
+}
+
+// getOriginalRatio returns the seed settings of a torrent before the butler first changed them
+func (ss *stateStore) getOriginalRatio(instance string, torrent *transmissionrpc.Torrent) (mode string, ratio float64, found bool) {
+	if ss == nil || torrent.HashString == nil {
+		return
+	}
+	defer ss.access.Unlock()
+	ss.access.Lock()
+	ts, found := ss.getInstance(instance).Torrents[*torrent.HashString]
+	if !found {
+		return
+	}
+	return ts.OriginalRatioMode, ts.OriginalRatio, true
+}
+
+// getLastSwitch returns the last seed ratio mode change done by the butler on a torrent
+func (ss *stateStore) getLastSwitch(instance string, torrent *transmissionrpc.Torrent) (record switchRecord, found bool) {
+	if ss == nil || torrent.HashString == nil {
+		return
+	}
+	defer ss.access.Unlock()
+	ss.access.Lock()
+	ts, found := ss.getInstance(instance).Torrents[*torrent.HashString]
+	if !found || len(ts.Switches) == 0 {
+		return record, false
+	}
+	return ts.Switches[len(ts.Switches)-1], true
+}
+
+// recordSwitch keeps track of a seed ratio mode change done by the butler (saving the original settings on the first one)
+func (ss *stateStore) recordSwitch(instance string, torrent *transmissionrpc.Torrent, action string, ratio float64) {
+	if ss == nil || torrent.HashString == nil {
+		return
+	}
+	defer ss.access.Unlock()
+	ss.access.Lock()
+	ts := ss.getTorrent(instance, torrent)
+	ts.Switches = append(ts.Switches, switchRecord{
+		Time:   time.Now(),
+		Action: action,
+		From:   torrent.SeedRatioMode.String(),
+		Ratio:  ratio,
+	})
+	if len(ts.Switches) > stateMaxSwitches {
+		ts.Switches = ts.Switches[len(ts.Switches)-stateMaxSwitches:]
+	}
+	ss.dirty = true
+}
+
+// recordStop keeps track of a torrent stopped by a stop rule action
+func (ss *stateStore) recordStop(instance string, torrent *transmissionrpc.Torrent) {
+	if ss == nil || torrent.HashString == nil {
+		return
+	}
+	defer ss.access.Unlock()
+	ss.access.Lock()
+	now := time.Now()
+	ss.getTorrent(instance, torrent).Stopped = &now
+	ss.dirty = true
+}
+
+// wasStopped returns true if a stop rule action already stopped a torrent
+func (ss *stateStore) wasStopped(instance string, torrent *transmissionrpc.Torrent) bool {
+	if ss == nil || torrent.HashString == nil {
+		return false
+	}
+	defer ss.access.Unlock()
+	ss.access.Lock()
+	ts, found := ss.getInstance(instance).Torrents[*torrent.HashString]
+	return found && ts.Stopped != nil
+}
+
+// getTorrent returns the state of a torrent, saving its current seed settings as the original ones if it is not tracked
+// yet. It must be called with access held.
+func (ss *stateStore) getTorrent(instance string, torrent *transmissionrpc.Torrent) (ts *torrentState) {
+	is := ss.getInstance(instance)
+	ts, found := is.Torrents[*torrent.HashString]
+	if !found {
+		ts = &torrentState{
+			OriginalRatioMode: torrent.SeedRatioMode.String(),
+			OriginalRatio:     *torrent.SeedRatioLimit,
+		}
+		is.Torrents[*torrent.HashString] = ts
+	}
+	ts.Name = *torrent.Name
+	return
+}
+
+// recordDeletion moves a torrent from the tracked torrents to the deletions history
+func (ss *stateStore) recordDeletion(instance string, torrent *transmissionrpc.Torrent, action string) {
+	if ss == nil || torrent.HashString == nil {
+		return
+	}
+	defer ss.access.Unlock()
+	ss.access.Lock()
+	is := ss.getInstance(instance)
+	record := deletionRecord{
+		Time:   time.Now(),
+		Hash:   *torrent.HashString,
+		Name:   *torrent.Name,
+		Action: action,
+	}
+	if torrent.UploadRatio != nil {
+		record.UploadRatio = *torrent.UploadRatio
+	}
+	if torrent.TotalSize != nil {
+		record.Size = torrent.TotalSize.String()
+	}
+	is.Deletions = append(is.Deletions, record)
+	if len(is.Deletions) > stateMaxDeletions {
+		is.Deletions = is.Deletions[len(is.Deletions)-stateMaxDeletions:]
+	}
+	delete(is.Torrents, *torrent.HashString)
+	delete(is.Activity, *torrent.HashString)
+	ss.dirty = true
+}
+
+// recordActivity updates the last upload time of the torrents whose uploaded bytes grew since the previous batch
+func (ss *stateStore) recordActivity(instance string, torrents []*transmissionrpc.Torrent, now time.Time) {
+	if ss == nil {
+		return
+	}
+	defer ss.access.Unlock()
+	ss.access.Lock()
+	is := ss.getInstance(instance)
+	if is.Activity == nil {
+		is.Activity = make(map[string]*activityRecord, len(torrents))
+	}
+	for _, torrent := range torrents {
+		if torrent == nil || torrent.HashString == nil || torrent.UploadedEver == nil {
+			continue
+		}
+		record, found := is.Activity[*torrent.HashString]
+		switch {
+		case !found:
+			// first time seen: the last activity is the best guess
+			record = &activityRecord{
+				UploadedEver: *torrent.UploadedEver,
+				LastUpload:   now,
+			}
+			if torrent.ActivityDate != nil && torrent.ActivityDate.Unix() > 0 && torrent.ActivityDate.Before(now) {
+				record.LastUpload = *torrent.ActivityDate
+			}
+			is.Activity[*torrent.HashString] = record
+		case *torrent.UploadedEver > record.UploadedEver:
+			record.UploadedEver = *torrent.UploadedEver
+			record.LastUpload = now
+		case *torrent.UploadedEver < record.UploadedEver:
+			// statistics reset: start over
+			record.UploadedEver = *torrent.UploadedEver
+		default:
+			continue
+		}
+		ss.dirty = true
+	}
+}
+
+// getLastUpload returns when the torrent uploaded for the last time, as seen by the batches
+func (ss *stateStore) getLastUpload(instance string, torrent *transmissionrpc.Torrent) (lastUpload time.Time, found bool) {
+	if ss == nil || torrent.HashString == nil {
+		return
+	}
+	defer ss.access.Unlock()
+	ss.access.Lock()
+	record, found := ss.getInstance(instance).Activity[*torrent.HashString]
+	if !found {
+		return
+	}
+	return record.LastUpload, true
+}
+
+// getDeletion returns the last deletion record of a torrent
+func (ss *stateStore) getDeletion(instance string, torrent *transmissionrpc.Torrent) (record deletionRecord, found bool) {
+	if ss == nil || torrent.HashString == nil {
+		return
+	}
+	defer ss.access.Unlock()
+	ss.access.Lock()
+	deletions := ss.getInstance(instance).Deletions
+	for index := len(deletions) - 1; index >= 0; index-- {
+		if deletions[index].Hash == *torrent.HashString {
+			return deletions[index], true
+		}
+	}
+	return
+}
+
+// prune forgets the torrents which are not in transmission anymore (removed by users)
+func (ss *stateStore) prune(instance string, torrents []*transmissionrpc.Torrent) {
+	if ss == nil {
+		return
+	}
+	present := make(map[string]bool, len(torrents))
+	for _, torrent := range torrents {
+		if torrent == nil || torrent.HashString == nil {
+			// can't know for sure which ones are gone
+			return
+		}
+		present[*torrent.HashString] = true
+	}
+	defer ss.access.Unlock()
+	ss.access.Lock()
+	is := ss.getInstance(instance)
+	for hash := range is.Torrents {
+		if !present[hash] {
+			delete(is.Torrents, hash)
+			ss.dirty = true
+		}
+	}
+	for hash := range is.Activity {
+		if !present[hash] {
+			delete(is.Activity, hash)
+			ss.dirty = true
+		}
+	}
+}
+
+// history returns a copy of the state of an instance
+func (ss *stateStore) history(instance string) (history instanceState) {
+	if ss == nil {
+		return
+	}
+	defer ss.access.Unlock()
+	ss.access.Lock()
+	is := ss.getInstance(instance)
+	history.Torrents = make(map[string]*torrentState, len(is.Torrents))
+	for hash, ts := range is.Torrents {
+		tsCopy := *ts
+		tsCopy.Switches = append([]switchRecord(nil), ts.Switches...)
+		history.Torrents[hash] = &tsCopy
+	}
+	history.Deletions = append([]deletionRecord(nil), is.Deletions...)
+	if is.Activity != nil {
+		history.Activity = make(map[string]*activityRecord, len(is.Activity))
+		for hash, record := range is.Activity {
+			recordCopy := *record
+			history.Activity[hash] = &recordCopy
+		}
+	}
+	return
+}
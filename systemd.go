@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// sdNotify sends a raw state to systemd, for the states go-systemd does not know about
+func sdNotify(state string) (err error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("can't open unix socket: %v", err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("can't write into the unix socket: %v", err)
+	}
+	return
+}
+
+// notifyExtendTimeout asks systemd to extend the startup (or stop) timeout by d from now (systemd 236 or newer)
+func notifyExtendTimeout(d time.Duration) error {
+	return sdNotify(fmt.Sprintf("EXTEND_TIMEOUT_USEC=%d", d.Microseconds()))
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hekmon/cunits/v2"
+	"github.com/hekmon/transmissionrpc"
+)
+
+const (
+	transmissionUserAgent  = "github.com/hekmon/transmissionbutler"
+	transmissionRPCTimeout = 30 * time.Second
+	transmissionCSRFHeader = "X-Transmission-Session-Id"
+)
+
+// transmissionClient is the part of the transmission RPC API used by the butler
+type transmissionClient interface {
+	TorrentGet(fields []string, ids []int64) (torrents []*transmissionrpc.Torrent, err error)
+	TorrentLabels(ids []int64) (labels map[int64][]string, err error)
+	TorrentSet(payload *transmissionrpc.TorrentSetPayload) (err error)
+	TorrentRemove(payload *transmissionrpc.TorrentRemovePayload) (err error)
+	TorrentSetLocation(id int64, location string, move bool) (err error)
+	TorrentStopIDs(ids []int64) (err error)
+	SessionArgumentsGet() (sessionArgs *transmissionrpc.SessionArguments, err error)
+	SessionArgumentsSet(payload *transmissionrpc.SessionArguments) (err error)
+	FreeSpace(path string) (freeSpace cunits.Bits, err error)
+	RPCVersion() (ok bool, serverVersion int64, serverMinimumVersion int64, err error)
+}
+
+var _ transmissionClient = (*rpcClient)(nil)
+
+// rpcClient is a transmission JSON-RPC client: the transmissionrpc library only provides its types, its client can't fetch
+// the labels
+type rpcClient struct {
+	url        string
+	user       string
+	password   string
+	httpClient *http.Client
+	access     sync.Mutex
+	sessionID  string
+}
+
+// newTransmissionClient returns the client of a server: every RPC call goes through the same HTTP client and session id
+func newTransmissionClient(server serverConfig) (transmissionClient, error) {
+	if server.Host == "" {
+		return nil, errors.New("host can't be empty")
+	}
+	scheme := "http"
+	if server.HTTPS {
+		scheme = "https"
+	}
+	return &rpcClient{
+		url:        fmt.Sprintf("%s://%s:%d/transmission/rpc", scheme, server.Host, server.Port),
+		user:       server.User,
+		password:   server.Password,
+		httpClient: &http.Client{Timeout: transmissionRPCTimeout},
+	}, nil
+}
+
+// TorrentGet returns the given fields of the torrents (all of them if ids is empty)
+func (rc *rpcClient) TorrentGet(fields []string, ids []int64) (torrents []*transmissionrpc.Torrent, err error) {
+	var answer struct {
+		Torrents []*transmissionrpc.Torrent `json:"torrents"`
+	}
+	if err = rc.call("torrent-get", torrentGetPayload{Fields: fields, IDs: ids}, &answer); err != nil {
+		return
+	}
+	torrents = answer.Torrents
+	return
+}
+
+// TorrentLabels returns the labels of the torrents (all of them if ids is empty), servers older than transmission 3.0 have none
+func (rc *rpcClient) TorrentLabels(ids []int64) (labels map[int64][]string, err error) {
+	var answer struct {
+		Torrents []struct {
+			ID     int64    `json:"id"`
+			Labels []string `json:"labels"`
+		} `json:"torrents"`
+	}
+	if err = rc.call("torrent-get", torrentGetPayload{Fields: []string{"id", "labels"}, IDs: ids}, &answer); err != nil {
+		return
+	}
+	labels = make(map[int64][]string, len(answer.Torrents))
+	for _, torrent := range answer.Torrents {
+		if len(torrent.Labels) > 0 {
+			labels[torrent.ID] = torrent.Labels
+		}
+	}
+	return
+}
+
+func (rc *rpcClient) TorrentSet(payload *transmissionrpc.TorrentSetPayload) (err error) {
+	if payload == nil || len(payload.IDs) == 0 {
+		return errors.New("there must be at least one ID")
+	}
+	return rc.call("torrent-set", payload, nil)
+}
+
+func (rc *rpcClient) TorrentRemove(payload *transmissionrpc.TorrentRemovePayload) (err error) {
+	if payload == nil {
+		return errors.New("payload can't be nil")
+	}
+	return rc.call("torrent-remove", payload, nil)
+}
+
+func (rc *rpcClient) TorrentSetLocation(id int64, location string, move bool) (err error) {
+	return rc.call("torrent-set-location", struct {
+		IDs      []int64 `json:"ids"`
+		Location string  `json:"location"`
+		Move     bool    `json:"move"`
+	}{
+		IDs:      []int64{id},
+		Location: location,
+		Move:     move,
+	}, nil)
+}
+
+func (rc *rpcClient) TorrentStopIDs(ids []int64) (err error) {
+	return rc.call("torrent-stop", struct {
+		IDs []int64 `json:"ids,omitempty"`
+	}{
+		IDs: ids,
+	}, nil)
+}
+
+func (rc *rpcClient) SessionArgumentsGet() (sessionArgs *transmissionrpc.SessionArguments, err error) {
+	err = rc.call("session-get", nil, &sessionArgs)
+	return
+}
+
+func (rc *rpcClient) SessionArgumentsSet(payload *transmissionrpc.SessionArguments) (err error) {
+	if payload == nil {
+		return errors.New("payload can't be nil")
+	}
+	// read only values
+	payload.BlocklistSize = nil
+	payload.ConfigDir = nil
+	payload.RPCVersion = nil
+	payload.RPCVersionMinimum = nil
+	payload.Version = nil
+	return rc.call("session-set", payload, nil)
+}
+
+func (rc *rpcClient) FreeSpace(path string) (freeSpace cunits.Bits, err error) {
+	var answer struct {
+		Path string `json:"path"`
+		Size int64  `json:"size-bytes"`
+	}
+	if err = rc.call("free-space", struct {
+		Path string `json:"path"`
+	}{
+		Path: path,
+	}, &answer); err != nil {
+		return
+	}
+	if answer.Path != path {
+		err = fmt.Errorf("returned path '%s' does not match with requested path '%s'", answer.Path, path)
+		return
+	}
+	freeSpace = cunits.ImportInByte(float64(answer.Size))
+	return
+}
+
+// RPCVersion returns true if the RPC version of the transmissionrpc library is at least the minimum version of the server
+func (rc *rpcClient) RPCVersion() (ok bool, serverVersion int64, serverMinimumVersion int64, err error) {
+	sessionArgs, err := rc.SessionArgumentsGet()
+	if err != nil {
+		err = fmt.Errorf("can't get session values: %w", err)
+		return
+	}
+	if sessionArgs.RPCVersion == nil || sessionArgs.RPCVersionMinimum == nil {
+		err = errors.New("session values lack the RPC versions")
+		return
+	}
+	serverVersion = *sessionArgs.RPCVersion
+	serverMinimumVersion = *sessionArgs.RPCVersionMinimum
+	ok = transmissionrpc.RPCVersion >= serverMinimumVersion
+	return
+}
+
+type torrentGetPayload struct {
+	Fields []string `json:"fields"`
+	IDs    []int64  `json:"ids,omitempty"`
+}
+
+// call sends a raw RPC request, handling the session id handshake
+func (rc *rpcClient) call(method string, arguments, result interface{}) (err error) {
+	if err = rc.request(method, arguments, result); err != nil {
+		err = fmt.Errorf("'%s' rpc method failed: %w", method, err)
+	}
+	return
+}
+
+func (rc *rpcClient) request(method string, arguments, result interface{}) (err error) {
+	body, err := json.Marshal(struct {
+		Method    string      `json:"method"`
+		Arguments interface{} `json:"arguments,omitempty"`
+	}{
+		Method:    method,
+		Arguments: arguments,
+	})
+	if err != nil {
+		return fmt.Errorf("can't encode request: %v", err)
+	}
+	for retry := true; ; retry = false {
+		var req *http.Request
+		if req, err = http.NewRequest(http.MethodPost, rc.url, bytes.NewReader(body)); err != nil {
+			return fmt.Errorf("can't create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", transmissionUserAgent)
+		req.Header.Set(transmissionCSRFHeader, rc.getSessionID())
+		if rc.user != "" || rc.password != "" {
+			req.SetBasicAuth(rc.user, rc.password)
+		}
+		var resp *http.Response
+		if resp, err = rc.httpClient.Do(req); err != nil {
+			return fmt.Errorf("request error: %w", err)
+		}
+		if resp.StatusCode == http.StatusConflict && retry {
+			resp.Body.Close()
+			rc.setSessionID(resp.Header.Get(transmissionCSRFHeader))
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return &httpStatusError{statusCode: resp.StatusCode}
+		}
+		answer := struct {
+			Arguments interface{} `json:"arguments"`
+			Result    string      `json:"result"`
+		}{
+			Arguments: result,
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+			return fmt.Errorf("can't decode answer: %w", err)
+		}
+		if answer.Result != "success" {
+			return &rpcResultError{result: answer.Result}
+		}
+		return
+	}
+}
+
+// httpStatusError is an answer refused by the transmission server (or a proxy in front of it)
+type httpStatusError struct {
+	statusCode int
+}
+
+func (hse *httpStatusError) Error() string {
+	return fmt.Sprintf("HTTP error %d: %s", hse.statusCode, http.StatusText(hse.statusCode))
+}
+
+// rpcResultError is a request processed but refused by transmission
+type rpcResultError struct {
+	result string
+}
+
+func (rre *rpcResultError) Error() string {
+	return fmt.Sprintf("payload does not indicate success: %s", rre.result)
+}
+
+func (rc *rpcClient) getSessionID() string {
+	defer rc.access.Unlock()
+	rc.access.Lock()
+	return rc.sessionID
+}
+
+func (rc *rpcClient) setSessionID(sessionID string) {
+	defer rc.access.Unlock()
+	rc.access.Lock()
+	rc.sessionID = sessionID
+}
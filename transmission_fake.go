@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/hekmon/cunits/v2"
+	"github.com/hekmon/transmissionrpc"
+)
+
+// fakeTransmission is an in-memory transmission server implementing transmissionClient, for tests and simulations
+type fakeTransmission struct {
+	access     sync.Mutex
+	torrents   map[int64]*transmissionrpc.Torrent
+	labels     map[int64][]string
+	session    transmissionrpc.SessionArguments
+	freeSpace  cunits.Bits
+	rpcVersion int64
+	rpcMinimum int64
+	failures   map[string]error
+	calls      []string
+}
+
+func newFakeTransmission(torrents []*transmissionrpc.Torrent, freeSpace cunits.Bits) (ft *fakeTransmission) {
+	seedRatioLimit := float64(2)
+	seedRatioLimited := false
+	downloadDir := "/var/lib/transmission-daemon/downloads"
+	ft = &fakeTransmission{
+		torrents: make(map[int64]*transmissionrpc.Torrent, len(torrents)),
+		labels:   make(map[int64][]string),
+		session: transmissionrpc.SessionArguments{
+			SeedRatioLimit:   &seedRatioLimit,
+			SeedRatioLimited: &seedRatioLimited,
+			DownloadDir:      &downloadDir,
+		},
+		freeSpace:  freeSpace,
+		rpcVersion: transmissionrpc.RPCVersion,
+		rpcMinimum: 1,
+		failures:   make(map[string]error),
+	}
+	for _, torrent := range torrents {
+		ft.addTorrent(torrent)
+	}
+	return
+}
+
+// addTorrent adds (or replaces) a torrent, its id must be set
+func (ft *fakeTransmission) addTorrent(torrent *transmissionrpc.Torrent) {
+	defer ft.access.Unlock()
+	ft.access.Lock()
+	copied := *torrent
+	ft.torrents[*torrent.ID] = &copied
+}
+
+// setLabels sets the labels of a torrent
+func (ft *fakeTransmission) setLabels(id int64, labels []string) {
+	defer ft.access.Unlock()
+	ft.access.Lock()
+	if len(labels) == 0 {
+		delete(ft.labels, id)
+	} else {
+		ft.labels[id] = append([]string(nil), labels...)
+	}
+}
+
+// setFailure makes every call of an RPC method ("torrent-get", "torrent-set", ...) fail with err (nil to reset)
+func (ft *fakeTransmission) setFailure(method string, err error) {
+	defer ft.access.Unlock()
+	ft.access.Lock()
+	if err == nil {
+		delete(ft.failures, method)
+	} else {
+		ft.failures[method] = err
+	}
+}
+
+func (ft *fakeTransmission) setRPCVersion(version, minimum int64) {
+	defer ft.access.Unlock()
+	ft.access.Lock()
+	ft.rpcVersion = version
+	ft.rpcMinimum = minimum
+}
+
+// getCalls returns the RPC methods called so far
+func (ft *fakeTransmission) getCalls() []string {
+	defer ft.access.Unlock()
+	ft.access.Lock()
+	return append([]string(nil), ft.calls...)
+}
+
+// getTorrents returns a copy of the torrents, ordered by id
+func (ft *fakeTransmission) getTorrents() (torrents []*transmissionrpc.Torrent) {
+	defer ft.access.Unlock()
+	ft.access.Lock()
+	return ft.list(nil)
+}
+
+// update applies changes to every torrent, the session can be read to apply transmission own rules
+func (ft *fakeTransmission) update(change func(torrent *transmissionrpc.Torrent, session *transmissionrpc.SessionArguments)) {
+	defer ft.access.Unlock()
+	ft.access.Lock()
+	for id, torrent := range ft.torrents {
+		// work on a copy: torrents returned earlier must not change
+		copied := *torrent
+		change(&copied, &ft.session)
+		ft.torrents[id] = &copied
+	}
+}
+
+// getFreeSpace returns the current free space without recording a call
+func (ft *fakeTransmission) getFreeSpace() cunits.Bits {
+	defer ft.access.Unlock()
+	ft.access.Lock()
+	return ft.freeSpace
+}
+
+// call must be called with access held
+func (ft *fakeTransmission) call(method string) error {
+	ft.calls = append(ft.calls, method)
+	if err := ft.failures[method]; err != nil {
+		return fmt.Errorf("'%s' rpc method failed: %w", method, err)
+	}
+	return nil
+}
+
+// list must be called with access held
+func (ft *fakeTransmission) list(ids []int64) (torrents []*transmissionrpc.Torrent) {
+	torrents = make([]*transmissionrpc.Torrent, 0, len(ft.torrents))
+	if len(ids) == 0 {
+		for _, torrent := range ft.torrents {
+			copied := *torrent
+			torrents = append(torrents, &copied)
+		}
+	} else {
+		for _, id := range ids {
+			if torrent, found := ft.torrents[id]; found {
+				copied := *torrent
+				torrents = append(torrents, &copied)
+			}
+		}
+	}
+	sort.Slice(torrents, func(i, j int) bool { return *torrents[i].ID < *torrents[j].ID })
+	return
+}
+
+func (ft *fakeTransmission) TorrentGet(fields []string, ids []int64) (torrents []*transmissionrpc.Torrent, err error) {
+	defer ft.access.Unlock()
+	ft.access.Lock()
+	if err = ft.call("torrent-get"); err != nil {
+		return
+	}
+	return ft.list(ids), nil
+}
+
+func (ft *fakeTransmission) TorrentLabels(ids []int64) (labels map[int64][]string, err error) {
+	defer ft.access.Unlock()
+	ft.access.Lock()
+	if err = ft.call("torrent-get"); err != nil {
+		return
+	}
+	labels = make(map[int64][]string, len(ft.labels))
+	for _, torrent := range ft.list(ids) {
+		if torrentLabels, found := ft.labels[*torrent.ID]; found {
+			labels[*torrent.ID] = append([]string(nil), torrentLabels...)
+		}
+	}
+	return
+}
+
+func (ft *fakeTransmission) TorrentSet(payload *transmissionrpc.TorrentSetPayload) (err error) {
+	defer ft.access.Unlock()
+	ft.access.Lock()
+	if err = ft.call("torrent-set"); err != nil {
+		return
+	}
+	for _, id := range payload.IDs {
+		torrent, found := ft.torrents[id]
+		if !found {
+			continue
+		}
+		// new pointers: copies returned earlier must not change
+		if payload.SeedRatioMode != nil {
+			mode := *payload.SeedRatioMode
+			torrent.SeedRatioMode = &mode
+		}
+		if payload.SeedRatioLimit != nil {
+			limit := *payload.SeedRatioLimit
+			torrent.SeedRatioLimit = &limit
+		}
+	}
+	return
+}
+
+func (ft *fakeTransmission) TorrentRemove(payload *transmissionrpc.TorrentRemovePayload) (err error) {
+	defer ft.access.Unlock()
+	ft.access.Lock()
+	if err = ft.call("torrent-remove"); err != nil {
+		return
+	}
+	for _, id := range payload.IDs {
+		torrent, found := ft.torrents[id]
+		if !found {
+			continue
+		}
+		if payload.DeleteLocalData && torrent.TotalSize != nil {
+			ft.freeSpace += *torrent.TotalSize
+		}
+		delete(ft.torrents, id)
+		delete(ft.labels, id)
+	}
+	return
+}
+
+func (ft *fakeTransmission) TorrentSetLocation(id int64, location string, move bool) (err error) {
+	defer ft.access.Unlock()
+	ft.access.Lock()
+	if err = ft.call("torrent-set-location"); err != nil {
+		return
+	}
+	if torrent, found := ft.torrents[id]; found {
+		dir := location
+		torrent.DownloadDir = &dir
+	}
+	return
+}
+
+func (ft *fakeTransmission) TorrentStopIDs(ids []int64) (err error) {
+	defer ft.access.Unlock()
+	ft.access.Lock()
+	if err = ft.call("torrent-stop"); err != nil {
+		return
+	}
+	for _, id := range ids {
+		if torrent, found := ft.torrents[id]; found {
+			status := transmissionrpc.TorrentStatusStopped
+			torrent.Status = &status
+		}
+	}
+	return
+}
+
+func (ft *fakeTransmission) SessionArgumentsGet() (sessionArgs *transmissionrpc.SessionArguments, err error) {
+	defer ft.access.Unlock()
+	ft.access.Lock()
+	if err = ft.call("session-get"); err != nil {
+		return
+	}
+	copied := ft.session
+	copied.RPCVersion = &ft.rpcVersion
+	copied.RPCVersionMinimum = &ft.rpcMinimum
+	return &copied, nil
+}
+
+func (ft *fakeTransmission) SessionArgumentsSet(payload *transmissionrpc.SessionArguments) (err error) {
+	defer ft.access.Unlock()
+	ft.access.Lock()
+	if err = ft.call("session-set"); err != nil {
+		return
+	}
+	if payload.SeedRatioLimit != nil {
+		limit := *payload.SeedRatioLimit
+		ft.session.SeedRatioLimit = &limit
+	}
+	if payload.SeedRatioLimited != nil {
+		limited := *payload.SeedRatioLimited
+		ft.session.SeedRatioLimited = &limited
+	}
+	if payload.DownloadDir != nil {
+		dir := *payload.DownloadDir
+		ft.session.DownloadDir = &dir
+	}
+	return
+}
+
+func (ft *fakeTransmission) FreeSpace(path string) (freeSpace cunits.Bits, err error) {
+	defer ft.access.Unlock()
+	ft.access.Lock()
+	if err = ft.call("free-space"); err != nil {
+		return
+	}
+	return ft.freeSpace, nil
+}
+
+func (ft *fakeTransmission) RPCVersion() (ok bool, serverVersion int64, serverMinimumVersion int64, err error) {
+	defer ft.access.Unlock()
+	ft.access.Lock()
+	if err = ft.call("session-get"); err != nil {
+		err = fmt.Errorf("can't get session values: %w", err)
+		return
+	}
+	return transmissionrpc.RPCVersion >= ft.rpcMinimum, ft.rpcVersion, ft.rpcMinimum, nil
+}
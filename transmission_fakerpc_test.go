@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/hekmon/transmissionrpc"
+)
+
+const fakeRPCPath = "/transmission/rpc"
+
+// fakeRPCHandler speaks the transmission RPC protocol on top of an in-memory fake transmission
+type fakeRPCHandler struct {
+	ft        *fakeTransmission
+	user      string
+	password  string
+	sessionID string
+}
+
+func newFakeRPCHandler(ft *fakeTransmission, user, password string) *fakeRPCHandler {
+	return &fakeRPCHandler{
+		ft:        ft,
+		user:      user,
+		password:  password,
+		sessionID: strconv.FormatInt(rand.Int63(), 36),
+	}
+}
+
+// newFakeRPCServer starts a local transmission stand-in on a random port, see fakeRPCServerConfig()
+func newFakeRPCServer(ft *fakeTransmission, user, password string) *httptest.Server {
+	return httptest.NewServer(newFakeRPCHandler(ft, user, password))
+}
+
+// fakeRPCServerConfig returns the server config to reach a fake RPC server
+func fakeRPCServerConfig(t *testing.T, server *httptest.Server, user, password string) serverConfig {
+	address, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("can't parse the fake RPC server URL: %v", err)
+	}
+	port, err := strconv.ParseUint(address.Port(), 10, 16)
+	if err != nil {
+		t.Fatalf("can't parse the fake RPC server port: %v", err)
+	}
+	return serverConfig{
+		Host:     address.Hostname(),
+		Port:     uint16(port),
+		User:     user,
+		Password: password,
+	}
+}
+
+type fakeRPCRequest struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       *int            `json:"tag"`
+}
+
+type fakeRPCAnswer struct {
+	Arguments interface{} `json:"arguments"`
+	Result    string      `json:"result"`
+	Tag       *int        `json:"tag,omitempty"`
+}
+
+func (frh *fakeRPCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != fakeRPCPath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	// Authentication
+	if frh.user != "" || frh.password != "" {
+		user, password, _ := r.BasicAuth()
+		if subtle.ConstantTimeCompare([]byte(user), []byte(frh.user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(frh.password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Transmission"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+	}
+	// CSRF handshake
+	if r.Header.Get(transmissionCSRFHeader) != frh.sessionID {
+		w.Header().Set(transmissionCSRFHeader, frh.sessionID)
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		return
+	}
+	// Call
+	var request fakeRPCRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("can't decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+	answer := fakeRPCAnswer{
+		Arguments: struct{}{},
+		Result:    "success",
+		Tag:       request.Tag,
+	}
+	if arguments, err := frh.call(request.Method, request.Arguments); err != nil {
+		answer.Result = err.Error()
+	} else if arguments != nil {
+		answer.Arguments = arguments
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&answer)
+}
+
+func (frh *fakeRPCHandler) call(method string, rawArguments json.RawMessage) (arguments interface{}, err error) {
+	if len(rawArguments) == 0 {
+		rawArguments = json.RawMessage("{}")
+	}
+	switch method {
+	case "session-get":
+		return frh.ft.SessionArgumentsGet()
+	case "session-set":
+		var payload transmissionrpc.SessionArguments
+		if err = json.Unmarshal(rawArguments, &payload); err != nil {
+			return
+		}
+		err = frh.ft.SessionArgumentsSet(&payload)
+		return
+	case "torrent-get":
+		return frh.torrentGet(rawArguments)
+	case "torrent-set":
+		var payload transmissionrpc.TorrentSetPayload
+		if err = json.Unmarshal(rawArguments, &payload); err != nil {
+			return
+		}
+		err = frh.ft.TorrentSet(&payload)
+		return
+	case "torrent-remove":
+		var payload transmissionrpc.TorrentRemovePayload
+		if err = json.Unmarshal(rawArguments, &payload); err != nil {
+			return
+		}
+		err = frh.ft.TorrentRemove(&payload)
+		return
+	case "torrent-set-location":
+		var payload struct {
+			IDs      []int64 `json:"ids"`
+			Location string  `json:"location"`
+			Move     bool    `json:"move"`
+		}
+		if err = json.Unmarshal(rawArguments, &payload); err != nil {
+			return
+		}
+		for _, id := range payload.IDs {
+			if err = frh.ft.TorrentSetLocation(id, payload.Location, payload.Move); err != nil {
+				return
+			}
+		}
+		return
+	case "torrent-stop":
+		var payload struct {
+			IDs []int64 `json:"ids"`
+		}
+		if err = json.Unmarshal(rawArguments, &payload); err != nil {
+			return
+		}
+		err = frh.ft.TorrentStopIDs(payload.IDs)
+		return
+	case "free-space":
+		var payload struct {
+			Path string `json:"path"`
+		}
+		if err = json.Unmarshal(rawArguments, &payload); err != nil {
+			return
+		}
+		freeSpace, err := frh.ft.FreeSpace(payload.Path)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"path":       payload.Path,
+			"size-bytes": int64(freeSpace.Byte()),
+		}, nil
+	default:
+		return nil, fmt.Errorf("method name not recognized")
+	}
+}
+
+func (frh *fakeRPCHandler) torrentGet(rawArguments json.RawMessage) (arguments interface{}, err error) {
+	var payload struct {
+		Fields []string      `json:"fields"`
+		IDs    []interface{} `json:"ids"`
+	}
+	if err = json.Unmarshal(rawArguments, &payload); err != nil {
+		return
+	}
+	if len(payload.Fields) == 0 {
+		return nil, fmt.Errorf("no fields specified")
+	}
+	// ids can be numbers or hashes
+	var ids []int64
+	var hashes map[string]bool
+	for _, id := range payload.IDs {
+		switch value := id.(type) {
+		case float64:
+			ids = append(ids, int64(value))
+		case string:
+			if hashes == nil {
+				hashes = make(map[string]bool)
+			}
+			hashes[value] = true
+		}
+	}
+	torrents, err := frh.ft.TorrentGet(payload.Fields, nil)
+	if err != nil {
+		return
+	}
+	var withLabels bool
+	for _, field := range payload.Fields {
+		withLabels = withLabels || field == "labels"
+	}
+	var labels map[int64][]string
+	if withLabels {
+		if labels, err = frh.ft.TorrentLabels(nil); err != nil {
+			return
+		}
+	}
+	selected := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		selected[id] = true
+	}
+	encoded := make([]map[string]json.RawMessage, 0, len(torrents))
+	for _, torrent := range torrents {
+		if len(payload.IDs) > 0 && !selected[*torrent.ID] && (torrent.HashString == nil || !hashes[*torrent.HashString]) {
+			continue
+		}
+		var wire map[string]json.RawMessage
+		if wire, err = encodeTorrent(torrent, payload.Fields); err != nil {
+			return nil, fmt.Errorf("can't encode torrent %d: %v", *torrent.ID, err)
+		}
+		if withLabels {
+			if wire["labels"], err = json.Marshal(append([]string{}, labels[*torrent.ID]...)); err != nil {
+				return nil, fmt.Errorf("can't encode torrent %d labels: %v", *torrent.ID, err)
+			}
+		}
+		encoded = append(encoded, wire)
+	}
+	return map[string]interface{}{"torrents": encoded}, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/hekmon/cunits/v2"
+	"github.com/hekmon/transmissionrpc"
+)
+
+// snapshotVersion is the current format version of the snapshots, fixtures written by hand may omit it
+const snapshotVersion = 1
+
+// transmissionFixture is the content of a transmission server, torrents use the RPC wire format.
+// Snapshots taken from live servers use the same format.
+type transmissionFixture struct {
+	Version           int                               `json:"version,omitempty"`
+	Time              *time.Time                        `json:"time,omitempty"`
+	Instance          string                            `json:"instance,omitempty"`
+	Session           *transmissionrpc.SessionArguments `json:"session"`
+	FreeSpace         string                            `json:"free_space"`
+	RPCVersion        int64                             `json:"rpc_version"`
+	RPCVersionMinimum int64                             `json:"rpc_version_minimum"`
+	Torrents          []*transmissionrpc.Torrent        `json:"torrents"`
+	Labels            map[int64][]string                `json:"-"` // part of the torrents in the wire format
+	State             *instanceState                    `json:"state,omitempty"`
+}
+
+func loadTransmissionFixture(filename string) (fixture *transmissionFixture, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		err = fmt.Errorf("can't open '%s' for reading: %v", filename, err)
+		return
+	}
+	if err = json.Unmarshal(data, &fixture); err != nil {
+		err = fmt.Errorf("can't decode '%s' as JSON: %v", filename, err)
+		return
+	}
+	if fixture.Version > snapshotVersion {
+		err = fmt.Errorf("'%s' has been written by a newer version (format %d, supported up to %d)", filename, fixture.Version, snapshotVersion)
+		return
+	}
+	for index, torrent := range fixture.Torrents {
+		if torrent == nil || torrent.ID == nil {
+			err = fmt.Errorf("torrent #%d of '%s' has no id", index, filename)
+			return
+		}
+	}
+	// transmissionrpc does not know about labels
+	var labels struct {
+		Torrents []struct {
+			ID     int64    `json:"id"`
+			Labels []string `json:"labels"`
+		} `json:"torrents"`
+	}
+	if err = json.Unmarshal(data, &labels); err != nil {
+		err = fmt.Errorf("can't decode '%s' torrents labels: %v", filename, err)
+		return
+	}
+	fixture.Labels = make(map[int64][]string)
+	for _, torrent := range labels.Torrents {
+		if len(torrent.Labels) > 0 {
+			fixture.Labels[torrent.ID] = torrent.Labels
+		}
+	}
+	return
+}
+
+// saveTransmissionFixture writes a fixture with its torrents in the RPC wire format ("-" for stdout)
+func saveTransmissionFixture(filename string, fixture *transmissionFixture) (err error) {
+	type rawFixture transmissionFixture
+	encoded := struct {
+		*rawFixture
+		Torrents []map[string]json.RawMessage `json:"torrents"`
+	}{
+		rawFixture: (*rawFixture)(fixture),
+		Torrents:   make([]map[string]json.RawMessage, len(fixture.Torrents)),
+	}
+	for index, torrent := range fixture.Torrents {
+		if encoded.Torrents[index], err = encodeTorrent(torrent, nil); err != nil {
+			return fmt.Errorf("can't encode torrent #%d: %v", index, err)
+		}
+		if labels := fixture.Labels[*torrent.ID]; len(labels) > 0 {
+			if encoded.Torrents[index]["labels"], err = json.Marshal(labels); err != nil {
+				return fmt.Errorf("can't encode torrent #%d labels: %v", index, err)
+			}
+		}
+	}
+	data, err := json.MarshalIndent(encoded, "", "    ")
+	if err != nil {
+		return fmt.Errorf("can't encode fixture: %v", err)
+	}
+	data = append(data, '\n')
+	if filename == "-" {
+		_, err = os.Stdout.Write(data)
+		return
+	}
+	if err = ioutil.WriteFile(filename, data, 0640); err != nil {
+		return fmt.Errorf("can't write '%s': %v", filename, err)
+	}
+	return
+}
+
+// newFakeTransmissionFromFixture creates an in-memory transmission server holding the fixture content
+func newFakeTransmissionFromFixture(fixture *transmissionFixture) (ft *fakeTransmission, err error) {
+	var freeSpace cunits.Bits
+	if fixture.FreeSpace != "" {
+		if freeSpace, err = cunits.Parse(fixture.FreeSpace); err != nil {
+			err = fmt.Errorf("can't parse fixture free space '%s': %v", fixture.FreeSpace, err)
+			return
+		}
+	}
+	ft = newFakeTransmission(fixture.Torrents, freeSpace)
+	for id, labels := range fixture.Labels {
+		ft.setLabels(id, labels)
+	}
+	if fixture.Session != nil {
+		ft.session = *fixture.Session
+	}
+	if fixture.RPCVersion != 0 || fixture.RPCVersionMinimum != 0 {
+		ft.setRPCVersion(fixture.RPCVersion, fixture.RPCVersionMinimum)
+	}
+	return
+}
+
+// encodeTorrent returns the RPC wire format of a torrent, limited to the given fields (all of them if none is given)
+func encodeTorrent(torrent *transmissionrpc.Torrent, fields []string) (encoded map[string]json.RawMessage, err error) {
+	data, err := json.Marshal(torrent)
+	if err != nil {
+		return
+	}
+	var all map[string]json.RawMessage
+	if err = json.Unmarshal(data, &all); err != nil {
+		return
+	}
+	// transmissionrpc marshals sizes as bits while the wire format is bytes
+	for field, size := range map[string]*cunits.Bits{
+		"totalSize":    torrent.TotalSize,
+		"pieceSize":    torrent.PieceSize,
+		"sizeWhenDone": torrent.SizeWhenDone,
+	} {
+		if size != nil {
+			all[field] = json.RawMessage(fmt.Sprintf("%d", int64(size.Byte())))
+		}
+	}
+	if len(fields) == 0 {
+		fields = make([]string, 0, len(all))
+		for field := range all {
+			fields = append(fields, field)
+		}
+	}
+	encoded = make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if value, found := all[field]; found && string(value) != "null" {
+			encoded[field] = value
+		}
+	}
+	return
+}
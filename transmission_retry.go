@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/hekmon/cunits/v2"
+	"github.com/hekmon/transmissionrpc"
+)
+
+// RPC errors classes: only the transient ones are retried
+const (
+	rpcErrorAuth       = "auth"
+	rpcErrorConnection = "connection"
+	rpcErrorTimeout    = "timeout"
+	rpcErrorResult     = "rpc"
+	rpcErrorUnknown    = "unknown"
+	rpcErrorVersion    = "version"  // incompatible RPC version, not returned by classifyRPCError
+	rpcErrorCanceled   = "canceled" // batch aborted on shutdown (or API client gone), not returned by classifyRPCError
+)
+
+// classifyRPCError returns the class of an error returned by the transmission clients
+func classifyRPCError(err error) string {
+	if err == nil {
+		return ""
+	}
+	var (
+		re          *rpcError
+		statusErr   *httpStatusError
+		resultErr   *rpcResultError
+		netErr      net.Error
+		syscallErrs = []error{syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.EPIPE, syscall.ENETUNREACH, syscall.EHOSTUNREACH}
+	)
+	switch {
+	case errors.As(err, &re):
+		return re.class
+	case errors.As(err, &statusErr):
+		switch {
+		case statusErr.statusCode == http.StatusUnauthorized, statusErr.statusCode == http.StatusForbidden:
+			return rpcErrorAuth
+		case statusErr.statusCode >= http.StatusInternalServerError:
+			return rpcErrorConnection
+		default:
+			return rpcErrorUnknown
+		}
+	case errors.As(err, &resultErr):
+		return rpcErrorResult
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return rpcErrorTimeout
+	case requestNotSent(err), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return rpcErrorConnection
+	}
+	for _, syscallErr := range syscallErrs {
+		if errors.Is(err, syscallErr) {
+			return rpcErrorConnection
+		}
+	}
+	return rpcErrorUnknown
+}
+
+// requestNotSent returns true if the error proves the request never reached the server: the connection could not be
+// established
+func requestNotSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial" || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// isRetryable returns false for the errors which would happen again: a wrong password or a request refused by transmission
+func isRetryable(class string) bool {
+	return class != rpcErrorAuth && class != rpcErrorResult
+}
+
+// checkConnectionLoss makes the next batch check the remote RPC version again if the server became unreachable
+func (inst *instance) checkConnectionLoss(err error) {
+	if class := classifyRPCError(err); class == rpcErrorConnection || class == rpcErrorTimeout {
+		inst.status.setVersionChecked(false)
+	}
+}
+
+var _ transmissionClient = (*retryClient)(nil)
+
+// retryClient retries the failed calls of a transmission client with a jittered exponential backoff
+type retryClient struct {
+	client   transmissionClient
+	instance string
+	log      instanceLogger
+	conf     retryConfig
+	ctx      context.Context // the retries stop once it is done, calls in flight are never interrupted
+}
+
+func newRetryClient(client transmissionClient, instance string, log instanceLogger, conf retryConfig) *retryClient {
+	return &retryClient{
+		client:   client,
+		instance: instance,
+		log:      log,
+		conf:     conf,
+		ctx:      context.Background(),
+	}
+}
+
+// withContext returns a copy of the client whose retries stop once ctx is done
+func (rc *retryClient) withContext(ctx context.Context) *retryClient {
+	copied := *rc
+	copied.ctx = ctx
+	return &copied
+}
+
+// unwrap returns the decorated client, to be reused with another retry config
+func (rc *retryClient) unwrap() transmissionClient {
+	return rc.client
+}
+
+// do calls fn until it succeeds, fails with a permanent error or the retries are exhausted. A mutating call (which must
+// not be applied twice) is only retried when its request never reached the server.
+func (rc *retryClient) do(method string, mutating bool, fn func() error) (err error) {
+	delay := rc.conf.Delay
+	for attempt := 0; ; attempt++ {
+		if err = fn(); err == nil {
+			if attempt > 0 {
+				rc.log.Infof("'%s' rpc call succeeded after %d attempt(s)", method, attempt+1)
+			}
+			return
+		}
+		class := classifyRPCError(err)
+		if !isRetryable(class) || mutating && !requestNotSent(err) || attempt >= rc.conf.Retries || rc.ctx.Err() != nil {
+			err = &rpcError{err: err, class: class, attempts: attempt + 1, canceled: rc.ctx.Err() != nil}
+			return
+		}
+		// equal jitter: between half and all of the current delay
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		rc.log.Warningf("'%s' rpc call failed (%s error), retrying in %v (%d/%d): %v", method, class, wait.Round(time.Millisecond),
+			attempt+1, rc.conf.Retries, err)
+		metrics.rpcRetry(rc.instance, method, class)
+		select {
+		case <-time.After(wait):
+		case <-rc.ctx.Done():
+			err = &rpcError{err: err, class: class, attempts: attempt + 1, canceled: true}
+			return
+		}
+		if delay *= 2; delay > rc.conf.MaxDelay {
+			delay = rc.conf.MaxDelay
+		}
+	}
+}
+
+// rpcError is a failed RPC call along with its class
+type rpcError struct {
+	err      error
+	class    string
+	attempts int
+	canceled bool // retries were stopped by the context
+}
+
+func (re *rpcError) Unwrap() error {
+	return re.err
+}
+
+func (re *rpcError) Error() string {
+	if re.canceled {
+		return fmt.Sprintf("%v (%s error, retries canceled after %d attempt(s))", re.err, re.class, re.attempts)
+	}
+	if re.attempts > 1 {
+		return fmt.Sprintf("%v (%s error, gave up after %d attempts)", re.err, re.class, re.attempts)
+	}
+	return fmt.Sprintf("%v (%s error)", re.err, re.class)
+}
+
+func (rc *retryClient) TorrentGet(fields []string, ids []int64) (torrents []*transmissionrpc.Torrent, err error) {
+	err = rc.do("torrent-get", false, func() (err error) {
+		torrents, err = rc.client.TorrentGet(fields, ids)
+		return
+	})
+	return
+}
+
+func (rc *retryClient) TorrentLabels(ids []int64) (labels map[int64][]string, err error) {
+	err = rc.do("torrent-get", false, func() (err error) {
+		labels, err = rc.client.TorrentLabels(ids)
+		return
+	})
+	return
+}
+
+func (rc *retryClient) TorrentSet(payload *transmissionrpc.TorrentSetPayload) (err error) {
+	return rc.do("torrent-set", false, func() error {
+		return rc.client.TorrentSet(payload)
+	})
+}
+
+func (rc *retryClient) TorrentRemove(payload *transmissionrpc.TorrentRemovePayload) (err error) {
+	return rc.do("torrent-remove", true, func() error {
+		return rc.client.TorrentRemove(payload)
+	})
+}
+
+func (rc *retryClient) TorrentSetLocation(id int64, location string, move bool) (err error) {
+	return rc.do("torrent-set-location", move, func() error {
+		return rc.client.TorrentSetLocation(id, location, move)
+	})
+}
+
+func (rc *retryClient) TorrentStopIDs(ids []int64) (err error) {
+	return rc.do("torrent-stop", true, func() error {
+		return rc.client.TorrentStopIDs(ids)
+	})
+}
+
+func (rc *retryClient) SessionArgumentsGet() (sessionArgs *transmissionrpc.SessionArguments, err error) {
+	err = rc.do("session-get", false, func() (err error) {
+		sessionArgs, err = rc.client.SessionArgumentsGet()
+		return
+	})
+	return
+}
+
+func (rc *retryClient) SessionArgumentsSet(payload *transmissionrpc.SessionArguments) (err error) {
+	return rc.do("session-set", false, func() error {
+		return rc.client.SessionArgumentsSet(payload)
+	})
+}
+
+func (rc *retryClient) FreeSpace(path string) (freeSpace cunits.Bits, err error) {
+	err = rc.do("free-space", false, func() (err error) {
+		freeSpace, err = rc.client.FreeSpace(path)
+		return
+	})
+	return
+}
+
+func (rc *retryClient) RPCVersion() (ok bool, serverVersion int64, serverMinimumVersion int64, err error) {
+	err = rc.do("session-get", false, func() (err error) {
+		ok, serverVersion, serverMinimumVersion, err = rc.client.RPCVersion()
+		return
+	})
+	return
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestRetryClient checks which failed calls are retried: a mutating call only when its request never reached the server
+func TestRetryClient(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		err      error
+		mutating bool
+		class    string
+		attempts int
+	}{
+		{name: "connection refused", err: errConnectionRefused, class: rpcErrorConnection, attempts: 3},
+		{name: "mutating call on a refused connection", err: errConnectionRefused, mutating: true, class: rpcErrorConnection, attempts: 3},
+		{name: "truncated answer", err: io.ErrUnexpectedEOF, class: rpcErrorConnection, attempts: 3},
+		{name: "mutating call with a truncated answer", err: io.ErrUnexpectedEOF, mutating: true, class: rpcErrorConnection, attempts: 1},
+		{name: "mutating call timeout", err: context.DeadlineExceeded, mutating: true, class: rpcErrorTimeout, attempts: 1},
+		{name: "mutating call on a reset connection", err: syscall.ECONNRESET, mutating: true, class: rpcErrorConnection, attempts: 1},
+		{name: "dial timeout", err: &net.OpError{Op: "dial", Net: "tcp", Err: context.DeadlineExceeded}, mutating: true,
+			class: rpcErrorTimeout, attempts: 3},
+		{name: "wrong password", err: &httpStatusError{statusCode: 401}, class: rpcErrorAuth, attempts: 1},
+		{name: "refused request", err: &rpcResultError{result: "invalid argument"}, class: rpcErrorResult, attempts: 1},
+		{name: "unknown error", err: errors.New("something went wrong"), class: rpcErrorUnknown, attempts: 3},
+		{name: "mutating call unknown error", err: errors.New("something went wrong"), mutating: true, class: rpcErrorUnknown, attempts: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rc := newRetryClient(nil, "", newInstanceLogger(""), retryConfig{Retries: 2, Delay: time.Millisecond, MaxDelay: time.Millisecond})
+			attempts := 0
+			err := rc.do("test", tc.mutating, func() error {
+				attempts++
+				return fmt.Errorf("'test' rpc method failed: %w", tc.err)
+			})
+			if class := classifyRPCError(err); class != tc.class {
+				t.Errorf("error class is '%s', expected '%s'", class, tc.class)
+			}
+			if attempts != tc.attempts {
+				t.Errorf("%d attempt(s), expected %d", attempts, tc.attempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	systemd "github.com/iguanesolutions/go-systemd"
+)
+
+// butlerLiveness tracks the progress of the butler loop and of the batches for the systemd watchdog
+type butlerLiveness struct {
+	access     sync.Mutex
+	loop       time.Time      // last iteration of the butler loop
+	batchStart time.Time      // start of the running batches, zero if none
+	stopped    bool           // the butler loop has exited on purpose
+	results    []*batchResult // of the last batches
+}
+
+var liveness butlerLiveness
+
+func (bl *butlerLiveness) beat() {
+	defer bl.access.Unlock()
+	bl.access.Lock()
+	bl.loop = time.Now()
+}
+
+func (bl *butlerLiveness) batchStarted() {
+	defer bl.access.Unlock()
+	bl.access.Lock()
+	bl.batchStart = time.Now()
+}
+
+func (bl *butlerLiveness) batchEnded(results []*batchResult) {
+	defer bl.access.Unlock()
+	bl.access.Lock()
+	bl.batchStart = time.Time{}
+	bl.results = results
+}
+
+func (bl *butlerLiveness) stop() {
+	defer bl.access.Unlock()
+	bl.access.Lock()
+	bl.stopped = true
+}
+
+func (bl *butlerLiveness) getResults() []*batchResult {
+	defer bl.access.Unlock()
+	bl.access.Lock()
+	return bl.results
+}
+
+// check returns an error if the butler loop did not iterate within loopLimit (while not running a batch)
+// or if the running batches started more than batchTimeout ago
+func (bl *butlerLiveness) check(loopLimit, batchTimeout time.Duration) error {
+	defer bl.access.Unlock()
+	bl.access.Lock()
+	switch {
+	case bl.stopped:
+		return nil
+	case !bl.batchStart.IsZero():
+		if running := time.Since(bl.batchStart); running > batchTimeout {
+			return fmt.Errorf("the running batch started %v ago (timeout: %v)", running.Round(time.Second), batchTimeout)
+		}
+	case !bl.loop.IsZero():
+		if idle := time.Since(bl.loop); idle > loopLimit {
+			return fmt.Errorf("the butler loop did not progress for %v", idle.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// startWatchdog sends the systemd watchdog heartbeats as long as the butler is alive, if systemd enabled the watchdog
+func startWatchdog() (beatInterval time.Duration) {
+	wd, err := systemd.NewWatchdog()
+	if err != nil {
+		logger.Debugf("[Main] systemd watchdog disabled: %v", err)
+		return
+	}
+	beatInterval = wd.GetChecksDuration()
+	logger.Infof("[Main] systemd watchdog enabled: sending heartbeats every %v while the butler is alive", beatInterval)
+	go func() {
+		ticker := wd.NewTicker()
+		defer ticker.Stop()
+		var stuck bool
+		for range ticker.C {
+			if err := liveness.check(wd.GetLimitDuration(), currentConf().Watchdog.BatchTimeout); err != nil {
+				if !stuck {
+					logger.Errorf("[Main] The butler looks stuck, stopping the watchdog heartbeats: %v", err)
+					stuck = true
+				}
+				continue
+			}
+			if stuck {
+				logger.Info("[Main] The butler is alive again, resuming the watchdog heartbeats")
+				stuck = false
+			}
+			if err := wd.SendHeartbeat(); err != nil {
+				logger.Errorf("[Main] Can't send the systemd watchdog heartbeat: %v", err)
+			}
+		}
+	}()
+	return
+}
+
+// updateSystemdStatus shows the last batches summary and the next run in 'systemctl status'
+func updateSystemdStatus() {
+	if !systemd.IsNotifyEnabled() {
+		return
+	}
+	results := liveness.getResults()
+	summaries := make([]string, 0, len(results))
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+		summary := fmt.Sprintf("Last batch at %s: %s", result.Start.Format("15:04"), result)
+		if result.Instance != "" {
+			summary = fmt.Sprintf("[%s] %s", result.Instance, summary)
+		}
+		summaries = append(summaries, summary)
+	}
+	status := fmt.Sprintf("Next run at %s", schedule.get().Format("2006-01-02 15:04"))
+	if len(summaries) > 0 {
+		status = fmt.Sprintf("%s | %s", strings.Join(summaries, " | "), status)
+	}
+	if err := systemd.NotifyStatus(status); err != nil {
+		logger.Errorf("[Main] Can't send systemd status: %v", err)
+	}
+}